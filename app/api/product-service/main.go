@@ -2,16 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"database/sql"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/restream/reindexer/v5"
 	_ "github.com/restream/reindexer/v5/bindings/cproto"
 )
@@ -19,11 +21,23 @@ import (
 var rx *reindexer.Reindexer
 var db *sql.DB
 
+// errBadField is ER_BAD_FIELD_ERROR
+const errBadField = 1054
+
+// isMissingColumn reports a column added by a sync-service migration that has not run yet
+func isMissingColumn(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errBadField
+}
+
 // ReindexerProduct matches the structure stored in Reindexer
 type ReindexerProduct struct {
-	ProductID      int64   `reindex:"product_id,hash,pk" json:"product_id"`
-	OptionIDs      []int64 `reindex:"option_ids" json:"option_ids"`
-	OptionValueIDs []int64 `reindex:"option_value_ids" json:"option_value_ids"`
+	ProductID             int64   `reindex:"product_id,hash,pk" json:"product_id"`
+	OptionIDs             []int64 `reindex:"option_ids" json:"option_ids"`
+	OptionValueIDs        []int64 `reindex:"option_value_ids" json:"option_value_ids"`
+	InStock               bool    `reindex:"in_stock" json:"in_stock"`
+	InStockOptionValueIDs []int64 `reindex:"in_stock_option_value_ids" json:"in_stock_option_value_ids"`
+	InStockWarehouseIDs   []int64 `reindex:"in_stock_warehouse_ids" json:"in_stock_warehouse_ids"`
 }
 
 // ProductSearchResponse is the response for product search
@@ -33,13 +47,40 @@ type ProductSearchResponse struct {
 	Facets   map[int64]int      `json:"facets"`
 }
 
-// MetaInfo contains pagination and total count information
+// MetaInfo contains pagination and total count information, plus the index
+// version and the time up to which the index reflects the catalog
 type MetaInfo struct {
-	TotalCount  int  `json:"total_count"`
-	TotalPages  int  `json:"total_pages"`
-	CurrentPage int  `json:"current_page"`
-	NextPage    *int `json:"next_page"`
-	Count       int  `json:"count"`
+	TotalCount   int        `json:"total_count"`
+	TotalPages   int        `json:"total_pages"`
+	CurrentPage  int        `json:"current_page"`
+	NextPage     *int       `json:"next_page"`
+	Count        int        `json:"count"`
+	IndexVersion int64      `json:"index_version"`
+	SyncedAt     *time.Time `json:"synced_at"`
+}
+
+// indexMeta is written to the namespace meta by sync-service
+type indexMeta struct {
+	Version  int64      `json:"version"`
+	SyncedAt *time.Time `json:"synced_at,omitempty"`
+}
+
+// readIndexMeta returns the sync state of the namespace; a missing or
+// unreadable meta only leaves the fields empty
+func readIndexMeta(dbName string) indexMeta {
+	var meta indexMeta
+
+	data, err := rx.GetMeta(dbName, "sync_freshness")
+	if err != nil {
+		log.Printf("Error reading index meta: %v", err)
+		return meta
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			log.Printf("Error decoding index meta: %v", err)
+		}
+	}
+	return meta
 }
 
 // OptionFilter represents filters for a specific option
@@ -101,31 +142,43 @@ func initDB() error {
 	return nil
 }
 
-func searchProducts(filters []OptionFilter, page, count int) (*ProductSearchResponse, error) {
+// applyFilters adds the option filters to a query. With inStock only
+// products with stock are matched, and option values only count when a SKU
+// with stock has them. With warehouseIDs only products with stock in one of
+// those warehouses are matched; option values are not tracked per warehouse.
+// Reservations are not tied to a warehouse, so a warehouse matches while it
+// holds a SKU whose stock is not all reserved.
+func applyFilters(query *reindexer.Query, filters []OptionFilter, inStock bool, warehouseIDs []int64) *reindexer.Query {
+	valuesField := "option_value_ids"
+	if inStock {
+		query = query.Where("in_stock", reindexer.EQ, true)
+		valuesField = "in_stock_option_value_ids"
+	}
+	if len(warehouseIDs) > 0 {
+		query = query.Where("in_stock_warehouse_ids", reindexer.SET, warehouseIDs)
+	}
+
+	// Product must have at least one value from each option
+	for _, filter := range filters {
+		for i, valueID := range filter.OptionValueIDs {
+			if i == 0 {
+				query = query.Where(valuesField, reindexer.EQ, valueID)
+			} else {
+				query = query.Or().Where(valuesField, reindexer.EQ, valueID)
+			}
+		}
+	}
+	return query
+}
+
+func searchProducts(filters []OptionFilter, inStock bool, warehouseIDs []int64, page, count int) (*ProductSearchResponse, error) {
 	dbName := getEnv("REINDEXER_DB", "products_db")
 
 	// Calculate offset
 	offset := page * count
 
 	// Build query for total count
-	totalQuery := rx.Query(dbName)
-
-	// Apply filters - product must have at least one value from each option
-	if len(filters) > 0 {
-		for _, filter := range filters {
-			// For each option, product must have at least one of the specified values
-			if len(filter.OptionValueIDs) > 0 {
-				// Create OR condition for option values within this option
-				for i, valueID := range filter.OptionValueIDs {
-					if i == 0 {
-						totalQuery = totalQuery.Where("option_value_ids", reindexer.EQ, valueID)
-					} else {
-						totalQuery = totalQuery.Or().Where("option_value_ids", reindexer.EQ, valueID)
-					}
-				}
-			}
-		}
-	}
+	totalQuery := applyFilters(rx.Query(dbName), filters, inStock, warehouseIDs)
 
 	// Get total count
 	totalQuery = totalQuery.ReqTotal()
@@ -134,23 +187,8 @@ func searchProducts(filters []OptionFilter, page, count int) (*ProductSearchResp
 
 	totalCount := totalIterator.TotalCount()
 
-	// Build new query for paginated results
-	resultsQuery := rx.Query(dbName)
-
-	// Apply same filters
-	if len(filters) > 0 {
-		for _, filter := range filters {
-			if len(filter.OptionValueIDs) > 0 {
-				for i, valueID := range filter.OptionValueIDs {
-					if i == 0 {
-						resultsQuery = resultsQuery.Where("option_value_ids", reindexer.EQ, valueID)
-					} else {
-						resultsQuery = resultsQuery.Or().Where("option_value_ids", reindexer.EQ, valueID)
-					}
-				}
-			}
-		}
-	}
+	// Build new query for paginated results with the same filters
+	resultsQuery := applyFilters(rx.Query(dbName), filters, inStock, warehouseIDs)
 
 	// Apply pagination
 	resultsQuery = resultsQuery.Limit(count).Offset(offset)
@@ -171,22 +209,7 @@ func searchProducts(filters []OptionFilter, page, count int) (*ProductSearchResp
 
 	// Calculate facets - get all option_value_ids counts with current filters
 	facets := make(map[int64]int)
-	facetQuery := rx.Query(dbName)
-
-	// Apply same filters for facet calculation
-	if len(filters) > 0 {
-		for _, filter := range filters {
-			if len(filter.OptionValueIDs) > 0 {
-				for i, valueID := range filter.OptionValueIDs {
-					if i == 0 {
-						facetQuery = facetQuery.Where("option_value_ids", reindexer.EQ, valueID)
-					} else {
-						facetQuery = facetQuery.Or().Where("option_value_ids", reindexer.EQ, valueID)
-					}
-				}
-			}
-		}
-	}
+	facetQuery := applyFilters(rx.Query(dbName), filters, inStock, warehouseIDs)
 
 	// Execute facet query
 	facetIterator := facetQuery.Exec()
@@ -194,7 +217,11 @@ func searchProducts(filters []OptionFilter, page, count int) (*ProductSearchResp
 
 	for facetIterator.Next() {
 		product := facetIterator.Object().(*ReindexerProduct)
-		for _, ovID := range product.OptionValueIDs {
+		valueIDs := product.OptionValueIDs
+		if inStock {
+			valueIDs = product.InStockOptionValueIDs
+		}
+		for _, ovID := range valueIDs {
 			facets[ovID]++
 		}
 	}
@@ -207,12 +234,16 @@ func searchProducts(filters []OptionFilter, page, count int) (*ProductSearchResp
 		nextPage = &np
 	}
 
+	indexMeta := readIndexMeta(dbName)
+
 	meta := MetaInfo{
-		TotalCount:  totalCount,
-		TotalPages:  totalPages,
-		CurrentPage: page,
-		NextPage:    nextPage,
-		Count:       len(products),
+		TotalCount:   totalCount,
+		TotalPages:   totalPages,
+		CurrentPage:  page,
+		NextPage:     nextPage,
+		Count:        len(products),
+		IndexVersion: indexMeta.Version,
+		SyncedAt:     indexMeta.SyncedAt,
 	}
 
 	response := &ProductSearchResponse{
@@ -313,8 +344,32 @@ func productsHandler(w http.ResponseWriter, r *http.Request) {
 		count = parsed
 	}
 
+	// Parse in_stock
+	inStock := false
+	if inStockStr := r.URL.Query().Get("in_stock"); inStockStr != "" {
+		parsed, err := strconv.ParseBool(inStockStr)
+		if err != nil {
+			http.Error(w, "Invalid in_stock parameter", http.StatusBadRequest)
+			return
+		}
+		inStock = parsed
+	}
+
+	// Parse warehouse: comma-separated IDs, any of them having stock matches
+	var warehouseIDs []int64
+	if warehouseStr := r.URL.Query().Get("warehouse"); warehouseStr != "" {
+		for _, part := range strings.Split(warehouseStr, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+			if err != nil || id <= 0 {
+				http.Error(w, "Invalid warehouse parameter", http.StatusBadRequest)
+				return
+			}
+			warehouseIDs = append(warehouseIDs, id)
+		}
+	}
+
 	// Search products
-	response, err := searchProducts(filters, page, count)
+	response, err := searchProducts(filters, inStock, warehouseIDs, page, count)
 	if err != nil {
 		http.Error(w, "Search error", http.StatusInternalServerError)
 		log.Printf("Error searching products: %v", err)
@@ -337,7 +392,8 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func optionsHandler(w http.ResponseWriter, r *http.Request) {
-	// Query to get all options with their values
+	// Query to get all options with their values. position comes from
+	// sync-service migration 004; without it the order is by ID.
 	query := `
 		SELECT 
 			o.id as option_id,
@@ -347,9 +403,12 @@ func optionsHandler(w http.ResponseWriter, r *http.Request) {
 			ov.value as value_name
 		FROM options o
 		LEFT JOIN option_values ov ON o.id = ov.option_id
-		ORDER BY o.id, ov.id`
+		ORDER BY %s`
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(fmt.Sprintf(query, "o.position, o.id, ov.position, ov.id"))
+	if isMissingColumn(err) {
+		rows, err = db.Query(fmt.Sprintf(query, "o.id, ov.id"))
+	}
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		log.Printf("Error querying options: %v", err)
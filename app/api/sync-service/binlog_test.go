@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func le(size int, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)[:size]
+}
+
+// rawEvent frames an event body with a v4 header
+func rawEvent(eventType replication.EventType, logPos uint32, body []byte) []byte {
+	event := le(4, 1700000000)
+	event = append(event, byte(eventType))
+	event = append(event, le(4, 1)...) // server id
+	event = append(event, le(4, uint64(replication.EventHeaderSize+len(body)))...)
+	event = append(event, le(4, uint64(logPos))...)
+	event = append(event, 0, 0)
+	return append(event, body...)
+}
+
+// formatDescription announces a MySQL 8 server writing events without checksums
+func formatDescription() []byte {
+	body := le(2, 4)
+	body = append(body, make([]byte, 50)...)
+	copy(body[2:], "8.0.36")
+	body = append(body, le(4, 0)...)
+	body = append(body, replication.EventHeaderSize)
+	for i := 0; i < int(replication.HEARTBEAT_LOG_EVENT_V2); i++ {
+		body = append(body, 8)
+	}
+	body = append(body, replication.BINLOG_CHECKSUM_ALG_OFF)
+	return rawEvent(replication.FORMAT_DESCRIPTION_EVENT, 0, append(body, 0, 0, 0, 0))
+}
+
+var skuColumns = []byte{gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_LONG, gomysql.MYSQL_TYPE_VARCHAR}
+
+func tableMap(tableID uint64, schema, table string) []byte {
+	body := le(6, tableID)
+	body = append(body, 0, 0)
+	body = append(body, byte(len(schema)))
+	body = append(body, schema...)
+	body = append(body, 0, byte(len(table)))
+	body = append(body, table...)
+	body = append(body, 0, byte(len(skuColumns)))
+	body = append(body, skuColumns...)
+	body = append(body, 2)
+	body = append(body, le(2, 200)...) // barcode VARCHAR(200)
+	body = append(body, 0)             // null bitmap
+	return rawEvent(replication.TABLE_MAP_EVENT, 100, body)
+}
+
+// writeRows builds a WRITE_ROWS_EVENTv2 for the table map above
+func writeRows(tableID uint64, images ...[]byte) []byte {
+	body := le(6, tableID)
+	body = append(body, 0, 0)
+	body = append(body, 2, 0) // no extra data
+	body = append(body, byte(len(skuColumns)), 0x0f)
+	for _, image := range images {
+		body = append(body, image...)
+	}
+	return rawEvent(replication.WRITE_ROWS_EVENTv2, 200, body)
+}
+
+func skuImage(id, productID int64, count int32, barcode string) []byte {
+	image := []byte{0}
+	image = append(image, le(8, uint64(id))...)
+	image = append(image, le(8, uint64(productID))...)
+	image = append(image, le(4, uint64(uint32(count)))...)
+	image = append(image, byte(len(barcode)))
+	return append(image, barcode...)
+}
+
+// parseEvents runs raw events through go-mysql's parser the way the stream does
+func parseEvents(t *testing.T, watch func(*binlogTable) bool, events ...[]byte) (*binlogEvent, error) {
+	t.Helper()
+	parser := replication.NewBinlogParser()
+	parser.SetRowsEventDecodeFunc(decodeWatchedRows(watch))
+
+	var last *replication.BinlogEvent
+	for i, data := range events {
+		e, err := parser.Parse(data)
+		if err != nil {
+			if i < len(events)-1 {
+				t.Fatalf("event %d: %v", i, err)
+			}
+			return nil, err
+		}
+		last = e
+	}
+	return newBinlogEvent(last, "binlog.000001"), nil
+}
+
+func TestBinlogRowsEvent(t *testing.T) {
+	event, err := parseEvents(t, newBinlogBatch("mydb").watches,
+		formatDescription(),
+		tableMap(42, "mydb", "skus"),
+		writeRows(42, skuImage(1, 10, 5, "4600"), skuImage(2, 11, -1, "")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.isRows() || event.Table.Name != "skus" || event.LogPos != 200 || event.File != "binlog.000001" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	want := [][]interface{}{{int64(1), int64(10), int64(5), "4600"}, {int64(2), int64(11), int64(-1), ""}}
+	if !reflect.DeepEqual(event.Rows, want) {
+		t.Errorf("rows = %#v, want %#v", event.Rows, want)
+	}
+}
+
+func TestBinlogUnwatchedTablesAreSkipped(t *testing.T) {
+	// The image stops in the middle of the first column
+	truncated := []byte{0, 1, 2}
+
+	for _, tt := range []struct {
+		name    string
+		schema  string
+		table   string
+		wantErr bool
+	}{
+		{"other schema", "billing", "skus", false},
+		{"other table", "mydb", "audit_log", false},
+		{"watched table", "mydb", "skus", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := parseEvents(t, newBinlogBatch("mydb").watches,
+				formatDescription(),
+				tableMap(9, tt.schema, tt.table),
+				writeRows(9, truncated),
+			)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (event.Table.Name != tt.table || event.Rows != nil) {
+				t.Errorf("unexpected event %+v", event)
+			}
+		})
+	}
+}
+
+func TestNewBinlogEvent(t *testing.T) {
+	header := func(eventType replication.EventType, timestamp, logPos uint32) *replication.EventHeader {
+		return &replication.EventHeader{EventType: eventType, Timestamp: timestamp, LogPos: logPos}
+	}
+
+	tests := []struct {
+		name      string
+		event     *replication.BinlogEvent
+		want      binlogEvent
+		heartbeat bool
+	}{
+		{
+			"rotate",
+			&replication.BinlogEvent{Header: header(replication.ROTATE_EVENT, 0, 0), Event: &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000002")}},
+			binlogEvent{Type: replication.ROTATE_EVENT, File: "binlog.000002", LogPos: 4},
+			false,
+		},
+		{
+			"xid",
+			&replication.BinlogEvent{Header: header(replication.XID_EVENT, 1700000000, 300), Event: &replication.XIDEvent{XID: 1}},
+			binlogEvent{Type: replication.XID_EVENT, Time: time.Unix(1700000000, 0), File: "binlog.000001", LogPos: 300},
+			false,
+		},
+		{
+			"query",
+			&replication.BinlogEvent{Header: header(replication.QUERY_EVENT, 1700000000, 500), Event: &replication.QueryEvent{Schema: []byte("mydb"), Query: []byte("TRUNCATE TABLE skus")}},
+			binlogEvent{Type: replication.QUERY_EVENT, Time: time.Unix(1700000000, 0), File: "binlog.000001", LogPos: 500, Schema: "mydb", Query: "TRUNCATE TABLE skus"},
+			false,
+		},
+		{
+			"rows",
+			&replication.BinlogEvent{Header: header(replication.UPDATE_ROWS_EVENTv2, 1700000000, 600), Event: &replication.RowsEvent{
+				Table: &replication.TableMapEvent{Schema: []byte("mydb"), Table: []byte("skus")},
+				Rows:  [][]interface{}{{int8(1), int16(2), int32(3), int64(4), uint32(5), "x", nil}},
+			}},
+			binlogEvent{
+				Type: replication.UPDATE_ROWS_EVENTv2, Time: time.Unix(1700000000, 0), File: "binlog.000001", LogPos: 600,
+				Table: &binlogTable{Schema: "mydb", Name: "skus"},
+				Rows:  [][]interface{}{{int64(1), int64(2), int64(3), int64(4), int64(5), "x", nil}},
+			},
+			false,
+		},
+		{
+			"heartbeat",
+			&replication.BinlogEvent{Header: header(replication.HEARTBEAT_EVENT, 0, 700), Event: &replication.GenericEvent{}},
+			binlogEvent{Type: replication.HEARTBEAT_EVENT, File: "binlog.000001", LogPos: 700},
+			true,
+		},
+		{
+			"heartbeat v2",
+			&replication.BinlogEvent{Header: header(replication.HEARTBEAT_LOG_EVENT_V2, 0, 700), Event: &replication.GenericEvent{}},
+			binlogEvent{Type: replication.HEARTBEAT_LOG_EVENT_V2, File: "binlog.000001", LogPos: 700},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		got := newBinlogEvent(tt.event, "binlog.000001")
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: event = %+v, want %+v", tt.name, *got, tt.want)
+		}
+		if got.isHeartbeat() != tt.heartbeat {
+			t.Errorf("%s: isHeartbeat() = %v, want %v", tt.name, got.isHeartbeat(), tt.heartbeat)
+		}
+	}
+}
+
+func TestBinlogErrorCode(t *testing.T) {
+	purged := &gomysql.MyError{Code: errBinlogPurged, State: "HY000", Message: "Could not find first log file"}
+	if code := binlogErrorCode(fmt.Errorf("stream: %w", purged)); code != errBinlogPurged {
+		t.Errorf("code = %d, want %d", code, errBinlogPurged)
+	}
+	if code := binlogErrorCode(fmt.Errorf("connection reset")); code != 0 {
+		t.Errorf("code = %d for a network error, want 0", code)
+	}
+}
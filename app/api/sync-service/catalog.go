@@ -0,0 +1,711 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Catalog write API. Products, SKUs and SKU options are validated, written
+// in one transaction per request and the affected products are reindexed
+// before the response, so a successful write is already searchable. A
+// product that fails to reindex is dead-lettered and retried like any other;
+// the response then carries X-Reindex-Failed: true.
+//
+//	POST   /products              {"name", "article"}
+//	GET    /products/{id}
+//	PATCH  /products/{id}         {"name"?, "article"?}
+//	DELETE /products/{id}
+//	POST   /products/{id}/skus    {"barcode"?, "count"?, "options"?}
+//	GET    /skus/{id}
+//	PATCH  /skus/{id}             {"product_id"?, "barcode"?, "count"?, "options"?}
+//	DELETE /skus/{id}
+//	PUT    /skus/{id}/options     [{"option_value_id", "range_end_value_id"?}]
+
+// reindexFailedHeader marks a committed write whose products are not indexed yet
+const reindexFailedHeader = "X-Reindex-Failed"
+
+// apiError is a client error with its HTTP status
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &apiError{Status: http.StatusNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...interface{}) error {
+	return &apiError{Status: http.StatusConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeAPIError replies with the status of an apiError, 500 otherwise
+func writeAPIError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		writeJSON(w, apiErr.Status, map[string]string{"error": apiErr.Message})
+		return
+	}
+	// A unique key hit by a concurrent write the checks did not see, or a
+	// transaction MySQL rolled back to break a deadlock
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && (mysqlErr.Number == errDuplicateKey || mysqlErr.Number == errDeadlock) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "conflicting write, retry the request"})
+		return
+	}
+
+	http.Error(w, "Database error", http.StatusInternalServerError)
+	log.Printf("Catalog write error: %v", err)
+}
+
+// decodeBody decodes a JSON request body, rejecting unknown fields
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return badRequest("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+func pathID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, badRequest("invalid %s", name)
+	}
+	return id, nil
+}
+
+// checkText trims a text field and checks it against the column size
+func checkText(field string, value *string, maxLen int, required bool) error {
+	if value == nil {
+		if required {
+			return badRequest("%s is required", field)
+		}
+		return nil
+	}
+	*value = strings.TrimSpace(*value)
+	if required && *value == "" {
+		return badRequest("%s must not be empty", field)
+	}
+	if utf8.RuneCountInString(*value) > maxLen {
+		return badRequest("%s must be at most %d characters", field, maxLen)
+	}
+	return nil
+}
+
+type productInput struct {
+	Name    *string `json:"name"`
+	Article *string `json:"article"`
+}
+
+func (in *productInput) validate(create bool) error {
+	if err := checkText("name", in.Name, 255, create || in.Name != nil); err != nil {
+		return err
+	}
+	return checkText("article", in.Article, 100, create || in.Article != nil)
+}
+
+type skuOptionInput struct {
+	OptionValueID   int64  `json:"option_value_id"`
+	RangeEndValueID *int64 `json:"range_end_value_id,omitempty"`
+}
+
+type skuInput struct {
+	ProductID *int64            `json:"product_id"`
+	Barcode   *string           `json:"barcode"`
+	Count     *int              `json:"count"`
+	Options   *[]skuOptionInput `json:"options"`
+}
+
+func (in *skuInput) validate() error {
+	if err := checkText("barcode", in.Barcode, 50, false); err != nil {
+		return err
+	}
+	if in.Count != nil && *in.Count < 0 {
+		return badRequest("count must not be negative")
+	}
+	if in.ProductID != nil && *in.ProductID <= 0 {
+		return badRequest("invalid product_id")
+	}
+	return nil
+}
+
+// withTx runs fn in a transaction and reindexes the products it reports
+// as affected once the transaction is committed. When the reindex fails the
+// write still succeeds and reindexFailedHeader is set on header, if given.
+func withTx(ctx context.Context, header http.Header, fn func(tx *sql.Tx) ([]int64, error)) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	productIDs, err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	if !reindexWritten(ctx, productIDs) && header != nil {
+		header.Set(reindexFailedHeader, "true")
+	}
+	return nil
+}
+
+// reindexWritten reindexes products after a write and reports whether all of
+// them were indexed; failures are already queued as dead letters, so the
+// write itself still succeeds
+func reindexWritten(ctx context.Context, productIDs []int64) bool {
+	timeout, err := time.ParseDuration(getEnv("REINDEX_TIMEOUT", "30s"))
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	// The write is committed, so a client going away must not cut the reindex short
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	// Without continuous sync nothing else marks these changes as indexed
+	track := getEnv("SYNC_MODE", "") == "" && len(productIDs) > 0
+	var readAt sql.NullFloat64
+	if track {
+		if err := db.QueryRowContext(ctx, "SELECT UNIX_TIMESTAMP(NOW(3))").Scan(&readAt); err != nil {
+			log.Printf("Error reading database time: %v", err)
+			track = false
+		}
+	}
+
+	result, err := reindexProducts(ctx, productIDs)
+	if err == nil {
+		err = result.failure()
+	}
+	if err != nil {
+		log.Printf("Error reindexing products %v after write: %v", productIDs, err)
+		return false
+	}
+	if track {
+		if err := recordIndexedProducts(ctx, productIDs, readAt.Float64); err != nil && !isMissingTable(err) {
+			log.Printf("Error recording indexed products: %v", err)
+		}
+	}
+	return true
+}
+
+// recordIndexedProducts stores that the products were indexed as of at, a
+// database UNIX timestamp taken before they were read
+func recordIndexedProducts(ctx context.Context, productIDs []int64, at float64) error {
+	productIDs = uniqueIDs(productIDs)
+	values := make([]string, len(productIDs))
+	args := make([]interface{}, 0, 2*len(productIDs))
+	for i, id := range productIDs {
+		values[i] = "(?, FROM_UNIXTIME(?))"
+		args = append(args, id, at)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO sync_indexed_products (product_id, indexed_at) VALUES %s
+		ON DUPLICATE KEY UPDATE indexed_at = GREATEST(indexed_at, VALUES(indexed_at))`, strings.Join(values, ",")), args...)
+	return err
+}
+
+func productExists(ctx context.Context, tx *sql.Tx, id int64) error {
+	var found int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM products WHERE id = ? FOR UPDATE", id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return notFound("product %d not found", id)
+	}
+	return err
+}
+
+// checkBarcode rejects a barcode already used by another SKU. The read locks
+// the barcode in idx_barcode, including the gap where it would go, so a
+// concurrent write of the same barcode waits for this transaction.
+func checkBarcode(ctx context.Context, tx *sql.Tx, barcode string, skuID int64) error {
+	if barcode == "" {
+		return nil
+	}
+	var other int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM skus WHERE barcode = ? AND id <> ? LIMIT 1 FOR UPDATE", barcode, skuID).Scan(&other)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return conflict("barcode %s is already used by SKU %d", barcode, other)
+}
+
+// replaceSKUOptions validates the options and replaces those of the SKU
+func replaceSKUOptions(ctx context.Context, tx *sql.Tx, skuID int64, options []skuOptionInput) error {
+	seen := make(map[int64]bool)
+	for _, option := range options {
+		if option.OptionValueID <= 0 {
+			return badRequest("invalid option_value_id")
+		}
+		if seen[option.OptionValueID] {
+			return badRequest("option value %d is given twice", option.OptionValueID)
+		}
+		seen[option.OptionValueID] = true
+
+		var optionID int64
+		err := tx.QueryRowContext(ctx, "SELECT option_id FROM option_values WHERE id = ?", option.OptionValueID).Scan(&optionID)
+		if err == sql.ErrNoRows {
+			return badRequest("option value %d does not exist", option.OptionValueID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if option.RangeEndValueID != nil {
+			var endOptionID int64
+			err := tx.QueryRowContext(ctx, "SELECT option_id FROM option_values WHERE id = ?", *option.RangeEndValueID).Scan(&endOptionID)
+			if err == sql.ErrNoRows {
+				return badRequest("option value %d does not exist", *option.RangeEndValueID)
+			}
+			if err != nil {
+				return err
+			}
+			if endOptionID != optionID {
+				return badRequest("range end %d belongs to another option than %d", *option.RangeEndValueID, option.OptionValueID)
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sku_options WHERE sku_id = ?", skuID); err != nil {
+		return fmt.Errorf("error deleting SKU options: %w", err)
+	}
+	for _, option := range options {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO sku_options (sku_id, option_value_id, is_range, range_end_value_id) VALUES (?, ?, ?, ?)",
+			skuID, option.OptionValueID, option.RangeEndValueID != nil, option.RangeEndValueID)
+		if err != nil {
+			return fmt.Errorf("error inserting SKU option: %w", err)
+		}
+	}
+
+	// sku_options has no update time; exports and freshness go by the SKU's
+	if _, err := tx.ExecContext(ctx, "UPDATE skus SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", skuID); err != nil {
+		return fmt.Errorf("error updating SKU: %w", err)
+	}
+	return nil
+}
+
+// readProduct returns a product with its SKUs and options
+func readProduct(id int64) (*Product, error) {
+	page, err := getProducts(id, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Products) == 0 || page.Products[0].ID != id {
+		return nil, notFound("product %d not found", id)
+	}
+	return &page.Products[0], nil
+}
+
+// readSKU returns a SKU with its options
+func readSKU(id int64) (*SKU, error) {
+	var productID int64
+	err := db.QueryRow("SELECT product_id FROM skus WHERE id = ?", id).Scan(&productID)
+	if err == sql.ErrNoRows {
+		return nil, notFound("SKU %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	product, err := readProduct(productID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range product.SKUs {
+		if product.SKUs[i].ID == id {
+			return &product.SKUs[i], nil
+		}
+	}
+	return nil, notFound("SKU %d not found", id)
+}
+
+func createProductHandler(w http.ResponseWriter, r *http.Request) {
+	var in productInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(true); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var id int64
+	err := withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		result, err := tx.ExecContext(r.Context(), "INSERT INTO products (name, article) VALUES (?, ?)", *in.Name, *in.Article)
+		if err != nil {
+			return nil, fmt.Errorf("error creating product: %w", err)
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return nil, err
+		}
+		return []int64{id}, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	product, err := readProduct(id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/products/%d", id))
+	writeJSON(w, http.StatusCreated, product)
+}
+
+// productHandler serves /products/{id}. The methods are dispatched here
+// because method patterns would conflict with the method-less /products/ids.
+func productHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getProductHandler(w, r)
+	case http.MethodPatch:
+		updateProductHandler(w, r)
+	case http.MethodDelete:
+		deleteProductHandler(w, r)
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	product, err := readProduct(id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, product)
+}
+
+func updateProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in productInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(false); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		if err := productExists(r.Context(), tx, id); err != nil {
+			return nil, err
+		}
+		_, err := tx.ExecContext(r.Context(),
+			"UPDATE products SET name = COALESCE(?, name), article = COALESCE(?, article) WHERE id = ?",
+			in.Name, in.Article, id)
+		if err != nil {
+			return nil, fmt.Errorf("error updating product: %w", err)
+		}
+		return []int64{id}, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	product, err := readProduct(id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, product)
+}
+
+func deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		result, err := tx.ExecContext(r.Context(), "DELETE FROM products WHERE id = ?", id)
+		if err != nil {
+			return nil, fmt.Errorf("error deleting product: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil, notFound("product %d not found", id)
+		}
+		return []int64{id}, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createSKUHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in skuInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if in.ProductID != nil {
+		writeAPIError(w, badRequest("product_id is taken from the path"))
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var skuID int64
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		ctx := r.Context()
+		if err := productExists(ctx, tx, productID); err != nil {
+			return nil, err
+		}
+
+		var barcode interface{}
+		if in.Barcode != nil && *in.Barcode != "" {
+			if err := checkBarcode(ctx, tx, *in.Barcode, 0); err != nil {
+				return nil, err
+			}
+			barcode = *in.Barcode
+		}
+		count := 0
+		if in.Count != nil {
+			count = *in.Count
+		}
+
+		result, err := tx.ExecContext(ctx, "INSERT INTO skus (product_id, count, barcode) VALUES (?, ?, ?)", productID, count, barcode)
+		if err != nil {
+			return nil, fmt.Errorf("error creating SKU: %w", err)
+		}
+		if skuID, err = result.LastInsertId(); err != nil {
+			return nil, err
+		}
+
+		if in.Options != nil {
+			if err := replaceSKUOptions(ctx, tx, skuID, *in.Options); err != nil {
+				return nil, err
+			}
+		}
+		return []int64{productID}, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	sku, err := readSKU(skuID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/skus/%d", skuID))
+	writeJSON(w, http.StatusCreated, sku)
+}
+
+func getSKUHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	sku, err := readSKU(id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sku)
+}
+
+// lockSKU returns the product of a SKU, locking the SKU row
+func lockSKU(ctx context.Context, tx *sql.Tx, id int64) (int64, error) {
+	var productID int64
+	err := tx.QueryRowContext(ctx, "SELECT product_id FROM skus WHERE id = ? FOR UPDATE", id).Scan(&productID)
+	if err == sql.ErrNoRows {
+		return 0, notFound("SKU %d not found", id)
+	}
+	return productID, err
+}
+
+func updateSKUHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in skuInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		ctx := r.Context()
+		productID, err := lockSKU(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		affected := []int64{productID}
+
+		if in.ProductID != nil && *in.ProductID != productID {
+			if err := productExists(ctx, tx, *in.ProductID); err != nil {
+				return nil, err
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE skus SET product_id = ? WHERE id = ?", *in.ProductID, id); err != nil {
+				return nil, fmt.Errorf("error moving SKU: %w", err)
+			}
+			affected = append(affected, *in.ProductID)
+		}
+
+		if in.Barcode != nil {
+			if err := checkBarcode(ctx, tx, *in.Barcode, id); err != nil {
+				return nil, err
+			}
+			// An empty barcode clears it
+			if _, err := tx.ExecContext(ctx, "UPDATE skus SET barcode = NULLIF(?, '') WHERE id = ?", *in.Barcode, id); err != nil {
+				return nil, fmt.Errorf("error updating SKU: %w", err)
+			}
+		}
+
+		if in.Count != nil {
+			// skus.count is derived once the SKU has warehouse quantities
+			perWarehouse, err := hasWarehouseStock(ctx, tx, id)
+			if err != nil {
+				return nil, err
+			}
+			if perWarehouse {
+				return nil, conflict("SKU %d keeps stock per warehouse, use the stock API with warehouse_id", id)
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE skus SET count = ? WHERE id = ?", *in.Count, id); err != nil {
+				return nil, fmt.Errorf("error updating SKU: %w", err)
+			}
+		}
+
+		if in.Options != nil {
+			if err := replaceSKUOptions(ctx, tx, id, *in.Options); err != nil {
+				return nil, err
+			}
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	sku, err := readSKU(id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sku)
+}
+
+func replaceSKUOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var options []skuOptionInput
+	if err := decodeBody(r, &options); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		productID, err := lockSKU(r.Context(), tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := replaceSKUOptions(r.Context(), tx, id, options); err != nil {
+			return nil, err
+		}
+		return []int64{productID}, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	sku, err := readSKU(id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sku)
+}
+
+func deleteSKUHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		productID, err := lockSKU(r.Context(), tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(r.Context(), "DELETE FROM skus WHERE id = ?", id); err != nil {
+			return nil, fmt.Errorf("error deleting SKU: %w", err)
+		}
+		return []int64{productID}, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestProductInputValidate(t *testing.T) {
+	long := strings.Repeat("я", 256)
+	tests := []struct {
+		name    string
+		in      productInput
+		create  bool
+		wantErr bool
+	}{
+		{"create", productInput{Name: strPtr(" Boots "), Article: strPtr("B-1")}, true, false},
+		{"create without article", productInput{Name: strPtr("Boots")}, true, true},
+		{"create with blank name", productInput{Name: strPtr("  "), Article: strPtr("B-1")}, true, true},
+		{"name too long", productInput{Name: &long, Article: strPtr("B-1")}, true, true},
+		{"update name only", productInput{Name: strPtr("Boots")}, false, false},
+		{"update nothing", productInput{}, false, false},
+		{"update to blank article", productInput{Article: strPtr("")}, false, true},
+	}
+	for _, tt := range tests {
+		err := tt.in.validate(tt.create)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	in := productInput{Name: strPtr(" Boots "), Article: strPtr("B-1")}
+	if err := in.validate(true); err != nil || *in.Name != "Boots" {
+		t.Errorf("name = %q, err = %v; want it trimmed", *in.Name, err)
+	}
+}
+
+func TestSKUInputValidate(t *testing.T) {
+	var badProduct int64
+	tests := []struct {
+		name    string
+		in      skuInput
+		wantErr bool
+	}{
+		{"empty", skuInput{}, false},
+		{"count", skuInput{Count: intPtr(0)}, false},
+		{"negative count", skuInput{Count: intPtr(-1)}, true},
+		{"barcode too long", skuInput{Barcode: strPtr(strings.Repeat("1", 51))}, true},
+		{"bad product", skuInput{ProductID: &badProduct}, true},
+	}
+	for _, tt := range tests {
+		err := tt.in.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{"name": "Boots"}`, false},
+		{`{"name": "Boots", "price": 1}`, true},
+		{`{"name": `, true},
+		{`["Boots"]`, true},
+	}
+	for _, tt := range tests {
+		var in productInput
+		err := decodeBody(httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(tt.body)), &in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: decodeBody() error = %v, want error %v", tt.body, err, tt.wantErr)
+			continue
+		}
+		var apiErr *apiError
+		if err != nil && (!errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest) {
+			t.Errorf("%s: decodeBody() error = %v, want a 400 apiError", tt.body, err)
+		}
+	}
+}
+
+func TestWriteAPIError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{notFound("product 1 not found"), http.StatusNotFound},
+		{conflict("barcode is used"), http.StatusConflict},
+		{&mysql.MySQLError{Number: errDuplicateKey, Message: "Duplicate entry"}, http.StatusConflict},
+		{fmt.Errorf("error updating stock: %w", &mysql.MySQLError{Number: errDeadlock, Message: "Deadlock found"}), http.StatusConflict},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeAPIError(w, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	t.Run("rollback on error", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE products").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectRollback()
+
+		failure := conflict("refused")
+		header := http.Header{}
+		err := withTx(context.Background(), header, func(tx *sql.Tx) ([]int64, error) {
+			if _, err := tx.Exec("UPDATE products SET name = 'x' WHERE id = 1"); err != nil {
+				return nil, err
+			}
+			return []int64{1}, failure
+		})
+		if err != failure {
+			t.Errorf("err = %v, want %v", err, failure)
+		}
+		if header.Get(reindexFailedHeader) != "" {
+			t.Errorf("%s set without a commit", reindexFailedHeader)
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+
+		header := http.Header{}
+		if err := withTx(context.Background(), header, func(tx *sql.Tx) ([]int64, error) { return nil, nil }); err != nil {
+			t.Fatal(err)
+		}
+		if header.Get(reindexFailedHeader) != "" {
+			t.Errorf("%s set with nothing to reindex", reindexFailedHeader)
+		}
+	})
+
+	t.Run("commit error", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectCommit().WillReturnError(sql.ErrConnDone)
+
+		err := withTx(context.Background(), nil, func(tx *sql.Tx) ([]int64, error) { return []int64{1}, nil })
+		if !errors.Is(err, sql.ErrConnDone) {
+			t.Errorf("err = %v, want %v", err, sql.ErrConnDone)
+		}
+	})
+}
+
+func TestUpdateSKUCountOnWarehouseSKU(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT product_id FROM skus WHERE id = ? FOR UPDATE")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id"}).AddRow(10))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM sku_stocks WHERE sku_id = ?)")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	r := httptest.NewRequest(http.MethodPatch, "/skus/3", strings.NewReader(`{"count": 5}`))
+	r.SetPathValue("id", "3")
+	w := httptest.NewRecorder()
+	updateSKUHandler(w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+}
+
+func TestCreateSKUBarcodeConflict(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM products WHERE id = ? FOR UPDATE")).
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM skus WHERE barcode = ? AND id <> ? LIMIT 1 FOR UPDATE")).
+		WithArgs("4600", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectRollback()
+
+	r := httptest.NewRequest(http.MethodPost, "/products/10/skus", strings.NewReader(`{"barcode": "4600"}`))
+	r.SetPathValue("id", "10")
+	w := httptest.NewRecorder()
+	createSKUHandler(w, r)
+
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "SKU 7") {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+}
+
+func TestCatalogHandlersRejectBadRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		id      string
+		body    string
+	}{
+		{"unknown field", createProductHandler, "", `{"name": "Boots", "article": "B-1", "price": 1}`},
+		{"missing name", createProductHandler, "", `{"article": "B-1"}`},
+		{"bad id", updateProductHandler, "x", `{"name": "Boots"}`},
+		{"product_id in path and body", createSKUHandler, "10", `{"product_id": 11}`},
+		{"negative count", updateSKUHandler, "3", `{"count": -1}`},
+		{"not a list", replaceSKUOptionsHandler, "3", `{"option_value_id": 1}`},
+	}
+	for _, tt := range tests {
+		// No database: these must be refused before a transaction starts
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		if tt.id != "" {
+			r.SetPathValue("id", tt.id)
+		}
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Binlog change-data-capture: tails the row-based binlog, maps changes of the
+// catalog tables to product IDs and reindexes them in small batches.
+
+const (
+	binlogCheckpointKey   = "binlog_checkpoint"
+	binlogHeartbeatPeriod = time.Second
+	binlogRetryDelay      = 5 * time.Second
+	binlogMaxPending      = 1000
+
+	// ER_MASTER_FATAL_ERROR_READING_BINLOG, e.g. the checkpointed file was purged
+	errBinlogPurged = 1236
+)
+
+// binlogCheckpoint is the binlog position up to which all changes reached the index
+type binlogCheckpoint struct {
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+}
+
+// binlogBatch collects the keys touched by committed transactions until they are flushed
+type binlogBatch struct {
+	schema     string
+	productIDs map[int64]bool
+	skuIDs     map[int64]bool
+	valueIDs   map[int64]bool
+	optionIDs  map[int64]bool
+	fullReload bool
+	since      time.Time // oldest change in the batch
+}
+
+func newBinlogBatch(schema string) *binlogBatch {
+	b := &binlogBatch{schema: strings.ToLower(schema)}
+	b.reset()
+	return b
+}
+
+func (b *binlogBatch) reset() {
+	b.productIDs = make(map[int64]bool)
+	b.skuIDs = make(map[int64]bool)
+	b.valueIDs = make(map[int64]bool)
+	b.optionIDs = make(map[int64]bool)
+	b.fullReload = false
+	b.since = time.Time{}
+	setBinlogPending(b.since)
+}
+
+// touch records the time of a change added to the batch
+func (b *binlogBatch) touch(t time.Time) {
+	if b.since.IsZero() && !t.IsZero() {
+		b.since = t
+		setBinlogPending(t)
+	}
+}
+
+func (b *binlogBatch) size() int {
+	return len(b.productIDs) + len(b.skuIDs) + len(b.valueIDs) + len(b.optionIDs)
+}
+
+func (b *binlogBatch) empty() bool {
+	return b.size() == 0 && !b.fullReload
+}
+
+func rowInt(row []interface{}, column int) (int64, bool) {
+	if column >= len(row) {
+		return 0, false
+	}
+	v, ok := row[column].(int64)
+	return v, ok
+}
+
+// target returns the key set a table's rows go to and the column holding the
+// key, or nil for tables that do not affect the index. Column positions
+// follow migration.sql and the sync-service migrations.
+func (b *binlogBatch) target(table *binlogTable) (map[int64]bool, int) {
+	if !strings.EqualFold(table.Schema, b.schema) {
+		return nil, 0
+	}
+
+	switch strings.ToLower(table.Name) {
+	case "products":
+		return b.productIDs, 0 // id
+	case "skus":
+		return b.productIDs, 1 // product_id
+	case "sku_options":
+		return b.skuIDs, 1 // sku_id
+	case "sku_stocks":
+		return b.skuIDs, 0 // sku_id
+	case "stock_reservations":
+		return b.skuIDs, 2 // sku_id
+	case "option_values":
+		return b.valueIDs, 0 // id
+	case "options":
+		// Cascaded deletes of its values are not in the binlog, so the option
+		// itself is resolved through the index
+		return b.optionIDs, 0 // id
+	}
+	return nil, 0
+}
+
+// watches reports whether rows of the table are needed; others are not decoded
+func (b *binlogBatch) watches(table *binlogTable) bool {
+	target, _ := b.target(table)
+	return target != nil
+}
+
+// add records the rows of a rows event
+func (b *binlogBatch) add(event *binlogEvent) {
+	target, column := b.target(event.Table)
+	if target == nil {
+		return
+	}
+
+	for _, row := range event.Rows {
+		if id, ok := rowInt(row, column); ok {
+			target[id] = true
+		}
+	}
+	b.touch(event.Time)
+}
+
+// addQuery handles statements logged as queries. TRUNCATE of a catalog table
+// (products.php and options.php use it) does not produce row events, so it
+// triggers a full reload.
+func (b *binlogBatch) addQuery(event *binlogEvent) {
+	if event.Schema != "" && !strings.EqualFold(event.Schema, b.schema) {
+		return
+	}
+
+	query := strings.ToLower(strings.Join(strings.Fields(event.Query), " "))
+	if !strings.HasPrefix(query, "truncate") {
+		return
+	}
+
+	for _, table := range []string{"products", "skus", "sku_options", "sku_stocks", "option_values", "options"} {
+		if strings.Contains(query, table) {
+			b.fullReload = true
+			b.touch(event.Time)
+			return
+		}
+	}
+}
+
+func keys(m map[int64]bool) []int64 {
+	result := make([]int64, 0, len(m))
+	for id := range m {
+		result = append(result, id)
+	}
+	return result
+}
+
+// flush reindexes everything collected so far
+func (b *binlogBatch) flush() error {
+	if b.fullReload {
+		log.Printf("Binlog sync: catalog table truncated, running full load")
+		if err := runLoad("binlog"); err != nil {
+			return err
+		}
+		b.reset()
+		return nil
+	}
+
+	productIDs := keys(b.productIDs)
+
+	ctx := context.Background()
+
+	skuProducts, err := productIDsBySKUs(ctx, keys(b.skuIDs))
+	if err != nil {
+		return fmt.Errorf("error resolving SKUs: %w", err)
+	}
+	productIDs = append(productIDs, skuProducts...)
+
+	valueProducts, err := productIDsByOptionValues(ctx, db, keys(b.valueIDs))
+	if err != nil {
+		return fmt.Errorf("error resolving option values: %w", err)
+	}
+	productIDs = append(productIDs, valueProducts...)
+
+	optionProducts, err := productIDsByOptions(ctx, keys(b.optionIDs))
+	if err != nil {
+		return fmt.Errorf("error resolving options: %w", err)
+	}
+	productIDs = append(productIDs, optionProducts...)
+
+	// Products that could not be written are dead-lettered and retried from
+	// there, so the checkpoint moves past them instead of replaying the same
+	// events forever; only a failed reindex as a whole holds it back
+	if _, err := reindexProducts(ctx, productIDs); err != nil {
+		return err
+	}
+
+	b.reset()
+	return nil
+}
+
+// currentBinlogPosition returns the position the server is writing to
+func currentBinlogPosition() (binlogCheckpoint, error) {
+	rows, err := db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		return binlogCheckpoint{}, fmt.Errorf("error reading master status: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return binlogCheckpoint{}, err
+	}
+	if !rows.Next() {
+		return binlogCheckpoint{}, errors.New("binary logging is disabled")
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil || len(values) < 2 {
+		return binlogCheckpoint{}, fmt.Errorf("error scanning master status: %w", err)
+	}
+
+	pos, err := strconv.ParseUint(string(values[1]), 10, 32)
+	if err != nil {
+		return binlogCheckpoint{}, fmt.Errorf("invalid binlog position %q", values[1])
+	}
+
+	return binlogCheckpoint{File: string(values[0]), Pos: uint32(pos)}, nil
+}
+
+// runBinlogSync tails the binlog forever, reconnecting on errors
+func runBinlogSync() {
+	for {
+		if err := tailBinlog(); err != nil {
+			log.Printf("Binlog sync stopped: %v (reconnecting in %s)", err, binlogRetryDelay)
+		}
+		time.Sleep(binlogRetryDelay)
+	}
+}
+
+// tailBinlog streams events from the checkpoint and returns on the first error.
+// The checkpoint only moves after the changes before it were indexed or
+// dead-lettered, so after a crash events are replayed rather than lost.
+func tailBinlog() error {
+	cfg, err := mysql.ParseDSN(getEnv("MYSQL_DSN", "root:rootpassword@tcp(localhost:3306)/mydb?parseTime=true"))
+	if err != nil {
+		return fmt.Errorf("error parsing MYSQL_DSN: %w", err)
+	}
+
+	serverID, err := strconv.ParseUint(getEnv("BINLOG_SERVER_ID", "1001"), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid BINLOG_SERVER_ID: %w", err)
+	}
+
+	flushInterval, err := time.ParseDuration(getEnv("CDC_FLUSH_INTERVAL", "1s"))
+	if err != nil {
+		return fmt.Errorf("invalid CDC_FLUSH_INTERVAL: %w", err)
+	}
+
+	var checkpoint binlogCheckpoint
+	found, err := getState(binlogCheckpointKey, &checkpoint)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if checkpoint, err = currentBinlogPosition(); err != nil {
+			return err
+		}
+		log.Printf("Binlog sync: no checkpoint, starting at %s:%d; run a full load to index earlier changes", checkpoint.File, checkpoint.Pos)
+		if err := putState(binlogCheckpointKey, checkpoint); err != nil {
+			return err
+		}
+	}
+
+	batch := newBinlogBatch(cfg.DBName)
+	stream, err := dialBinlog(cfg, uint32(serverID), checkpoint, batch.watches)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	log.Printf("Binlog sync: tailing %s from %s:%d", cfg.Addr, checkpoint.File, checkpoint.Pos)
+
+	committed := checkpoint
+	saved := checkpoint
+	lastFlush := time.Now()
+	inTransaction := false
+
+	// Time of the newest event read; a heartbeat means there is nothing newer
+	var streamTime time.Time
+	namespace := getEnv("REINDEXER_DB", "products_db")
+
+	for {
+		event, err := stream.readEvent()
+		if err != nil {
+			if binlogErrorCode(err) == errBinlogPurged {
+				return restartFromCurrentPosition(err)
+			}
+			return err
+		}
+
+		if !event.Time.IsZero() {
+			streamTime = event.Time
+		}
+
+		switch {
+		case event.isHeartbeat():
+			streamTime = time.Now()
+		case event.Type == replication.ROTATE_EVENT:
+			committed = binlogCheckpoint{File: event.File, Pos: event.LogPos}
+		case event.Type == replication.XID_EVENT:
+			committed = binlogCheckpoint{File: event.File, Pos: event.LogPos}
+			inTransaction = false
+		case event.Type == replication.QUERY_EVENT:
+			if strings.EqualFold(event.Query, "BEGIN") {
+				inTransaction = true
+				break
+			}
+			batch.addQuery(event)
+			committed = binlogCheckpoint{File: event.File, Pos: event.LogPos}
+			inTransaction = false
+		case event.isRows():
+			batch.add(event)
+		}
+
+		if inTransaction || time.Since(lastFlush) < flushInterval && batch.size() < binlogMaxPending {
+			continue
+		}
+
+		if !batch.empty() {
+			if err := batch.flush(); err != nil {
+				return err
+			}
+		}
+		if committed != saved {
+			if err := putState(binlogCheckpointKey, committed); err != nil {
+				return err
+			}
+			saved = committed
+		}
+		if !streamTime.IsZero() {
+			markSynced(namespace, streamTime, false)
+		}
+		lastFlush = time.Now()
+	}
+}
+
+// restartFromCurrentPosition recovers from a checkpoint the server no longer has:
+// the index is rebuilt and tailing resumes from the current position
+func restartFromCurrentPosition(cause error) error {
+	log.Printf("Binlog sync: checkpoint is no longer available (%v), running full load", cause)
+
+	checkpoint, err := currentBinlogPosition()
+	if err != nil {
+		return err
+	}
+	if err := runLoad("binlog"); err != nil {
+		return err
+	}
+	if err := putState(binlogCheckpointKey, checkpoint); err != nil {
+		return err
+	}
+	return cause
+}
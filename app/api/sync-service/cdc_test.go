@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sortedKeys(m map[int64]bool) []int64 {
+	ids := keys(m)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestBinlogBatchAdd(t *testing.T) {
+	tests := []struct {
+		table    string
+		rows     [][]interface{}
+		products []int64
+		skus     []int64
+		values   []int64
+		options  []int64
+	}{
+		{"products", [][]interface{}{{int64(1), "name"}}, []int64{1}, nil, nil, nil},
+		{"SKUS", [][]interface{}{{int64(10), int64(2)}, {int64(10), int64(3)}}, []int64{2, 3}, nil, nil, nil},
+		{"sku_options", [][]interface{}{{int64(100), int64(10), int64(5)}}, nil, []int64{10}, nil, nil},
+		{"sku_stocks", [][]interface{}{{int64(11), int64(1), int64(4)}}, nil, []int64{11}, nil, nil},
+		{"stock_reservations", [][]interface{}{{int64(1), nil, int64(12)}}, nil, []int64{12}, nil, nil},
+		{"option_values", [][]interface{}{{int64(7), int64(3)}}, nil, nil, []int64{7}, nil},
+		{"options", [][]interface{}{{int64(3), "color"}}, nil, nil, nil, []int64{3}},
+		{"audit_log", [][]interface{}{{int64(1)}}, nil, nil, nil, nil},
+		// NULL keys are ignored
+		{"skus", [][]interface{}{{int64(10), nil}}, nil, nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			batch := newBinlogBatch("MyDB")
+			batch.add(&binlogEvent{Table: &binlogTable{Schema: "mydb", Name: tt.table}, Rows: tt.rows})
+			batch.add(&binlogEvent{Table: &binlogTable{Schema: "other", Name: tt.table}, Rows: [][]interface{}{{int64(99), int64(99), int64(99)}}})
+
+			for _, check := range []struct {
+				name string
+				got  map[int64]bool
+				want []int64
+			}{
+				{"products", batch.productIDs, tt.products},
+				{"skus", batch.skuIDs, tt.skus},
+				{"values", batch.valueIDs, tt.values},
+				{"options", batch.optionIDs, tt.options},
+			} {
+				if got := sortedKeys(check.got); len(got)+len(check.want) > 0 && !reflect.DeepEqual(got, check.want) {
+					t.Errorf("%s = %v, want %v", check.name, got, check.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBinlogBatchAddQuery(t *testing.T) {
+	tests := []struct {
+		schema, query string
+		reload        bool
+	}{
+		{"mydb", "TRUNCATE TABLE skus", true},
+		{"", "truncate   `options`", true},
+		{"mydb", "TRUNCATE TABLE sku_stocks", true},
+		{"other", "TRUNCATE TABLE skus", false},
+		{"mydb", "TRUNCATE TABLE audit_log", false},
+		{"mydb", "ALTER TABLE skus ADD COLUMN x INT", false},
+	}
+	for _, tt := range tests {
+		batch := newBinlogBatch("mydb")
+		batch.addQuery(&binlogEvent{Schema: tt.schema, Query: tt.query})
+		if batch.fullReload != tt.reload {
+			t.Errorf("%q in %q: full reload %v, want %v", tt.query, tt.schema, batch.fullReload, tt.reload)
+		}
+	}
+}
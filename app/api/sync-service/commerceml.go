@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CommerceML 2 import from 1C. import.xml carries the classifier (properties
+// with their value dictionaries) and products, offers.xml carries the offers
+// with characteristics and stock. A product maps to products, an offer to a
+// SKU; characteristics become SKU options and product properties are applied
+// as options to every SKU of the product. 1C identifiers are remembered in
+// commerceml_ids (migrations/003_commerceml.sql), so renames in 1C update the
+// same rows. Offers that list quantities per warehouse (Склад) fill sku_stocks;
+// a 1C warehouse is the warehouse whose code is its identifier, created on
+// first use. Files are read as a stream, UTF-8 only.
+
+// cmlEmptyID is what 1C sends for an unset reference value
+const cmlEmptyID = "00000000-0000-0000-0000-000000000000"
+
+type cmlProperty struct {
+	ID     string `xml:"Ид"`
+	Name   string `xml:"Наименование"`
+	Values []struct {
+		ID    string `xml:"ИдЗначения"`
+		Value string `xml:"Значение"`
+	} `xml:"ВариантыЗначений>Справочник"`
+}
+
+type cmlCharacteristic struct {
+	Name  string `xml:"Наименование"`
+	Value string `xml:"Значение"`
+}
+
+type cmlProduct struct {
+	ID           string `xml:"Ид"`
+	Article      string `xml:"Артикул"`
+	Name         string `xml:"Наименование"`
+	Status       string `xml:"Статус"`
+	DeletionMark string `xml:"ПометкаУдаления"`
+	Properties   []struct {
+		ID     string   `xml:"Ид"`
+		Values []string `xml:"Значение"`
+	} `xml:"ЗначенияСвойств>ЗначенияСвойства"`
+	Characteristics []cmlCharacteristic `xml:"ХарактеристикиТовара>ХарактеристикаТовара"`
+}
+
+type cmlOffer struct {
+	ID              string              `xml:"Ид"`
+	Barcode         string              `xml:"Штрихкод"`
+	Characteristics []cmlCharacteristic `xml:"ХарактеристикиТовара>ХарактеристикаТовара"`
+	Quantity        string              `xml:"Количество"`
+	// CommerceML 2.08+
+	Stocks []struct {
+		WarehouseID string `xml:"Ид"`
+		Quantity    string `xml:"Количество"`
+	} `xml:"Остатки>Остаток>Склад"`
+	// CommerceML 2.04
+	Warehouses []struct {
+		WarehouseID string `xml:"ИдСклада,attr"`
+		Quantity    string `xml:"КоличествоНаСкладе,attr"`
+	} `xml:"Склад"`
+}
+
+// cmlWarehouse is an entry of the Склады list of an offers package
+type cmlWarehouse struct {
+	ID   string `xml:"Ид"`
+	Name string `xml:"Наименование"`
+}
+
+// cmlStock is the quantity of an offer in one 1C warehouse
+type cmlStock struct {
+	WarehouseID string
+	Quantity    int
+}
+
+// parseCMLQuantity parses a 1C quantity, which may use a decimal comma
+func parseCMLQuantity(s string) (float64, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return n, nil
+}
+
+// cmlCount rounds a quantity down to a stock count
+func cmlCount(quantity float64) int {
+	return int(math.Max(0, math.Floor(quantity)))
+}
+
+// quantity returns the total stock of the offer, nil when the file has none
+func (o *cmlOffer) quantity() (*int, error) {
+	var sources []string
+	switch {
+	case o.Quantity != "":
+		sources = []string{o.Quantity}
+	case len(o.Stocks) > 0:
+		for _, stock := range o.Stocks {
+			sources = append(sources, stock.Quantity)
+		}
+	case len(o.Warehouses) > 0:
+		for _, warehouse := range o.Warehouses {
+			sources = append(sources, warehouse.Quantity)
+		}
+	default:
+		return nil, nil
+	}
+
+	total := 0.0
+	for _, s := range sources {
+		n, err := parseCMLQuantity(s)
+		if err != nil {
+			return nil, err
+		}
+		total += n
+	}
+
+	count := cmlCount(total)
+	return &count, nil
+}
+
+// stocks returns the quantities of the offer per 1C warehouse in file order,
+// nil when the offer has none or an entry does not name its warehouse
+func (o *cmlOffer) stocks() ([]cmlStock, error) {
+	var ids, sources []string
+	for _, stock := range o.Stocks {
+		ids, sources = append(ids, stock.WarehouseID), append(sources, stock.Quantity)
+	}
+	if len(ids) == 0 {
+		for _, warehouse := range o.Warehouses {
+			ids, sources = append(ids, warehouse.WarehouseID), append(sources, warehouse.Quantity)
+		}
+	}
+
+	var order []string
+	quantities := make(map[string]float64)
+	for i, id := range ids {
+		if id = strings.TrimSpace(id); id == "" {
+			return nil, nil
+		}
+		n, err := parseCMLQuantity(sources[i])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := quantities[id]; !ok {
+			order = append(order, id)
+		}
+		quantities[id] += n
+	}
+
+	var stocks []cmlStock
+	for _, id := range order {
+		stocks = append(stocks, cmlStock{WarehouseID: id, Quantity: cmlCount(quantities[id])})
+	}
+	return stocks, nil
+}
+
+// cmlImporter applies CommerceML items through a catalogTx
+type cmlImporter struct {
+	*catalogTx
+	properties map[string]*cmlProperty
+	// warehouseNames come from the Склады list, warehouses caches local IDs
+	warehouseNames map[string]string
+	warehouses     map[string]int64
+}
+
+// mappedID returns the local row of a 1C identifier, ignoring mappings to
+// rows that no longer exist
+func (c *cmlImporter) mappedID(entity, externalID string) (int64, bool, error) {
+	table := "products"
+	if entity == "sku" {
+		table = "skus"
+	}
+
+	var id int64
+	err := c.tx.QueryRowContext(c.ctx, fmt.Sprintf(`
+		SELECT t.id FROM commerceml_ids m
+		JOIN %s t ON t.id = m.local_id
+		WHERE m.entity = ? AND m.external_id = ?`, table), entity, externalID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error looking up %s %s: %w", entity, externalID, err)
+	}
+	return id, true, nil
+}
+
+func (c *cmlImporter) setMapping(entity, externalID string, localID int64) error {
+	_, err := c.tx.ExecContext(c.ctx, `
+		INSERT INTO commerceml_ids (entity, external_id, local_id) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE local_id = VALUES(local_id)`, entity, externalID, localID)
+	if err != nil {
+		return fmt.Errorf("error saving %s mapping %s: %w", entity, externalID, err)
+	}
+	return nil
+}
+
+// characteristicValueIDs resolves characteristics to option value IDs
+func (c *cmlImporter) characteristicValueIDs(characteristics []cmlCharacteristic) ([]int64, error) {
+	var valueIDs []int64
+	for _, characteristic := range characteristics {
+		name := strings.TrimSpace(characteristic.Name)
+		value := strings.TrimSpace(characteristic.Value)
+		if name == "" || value == "" {
+			continue
+		}
+
+		optionID, err := c.optionID(name, name)
+		if err != nil {
+			return nil, err
+		}
+		valueID, err := c.optionValueID(optionID, value)
+		if err != nil {
+			return nil, err
+		}
+		valueIDs = append(valueIDs, valueID)
+	}
+	return valueIDs, nil
+}
+
+// propertyValueIDs resolves product property values, translating dictionary
+// references through the classifier
+func (c *cmlImporter) propertyValueIDs(product *cmlProduct) ([]int64, error) {
+	var valueIDs []int64
+	for _, property := range product.Properties {
+		definition, ok := c.properties[property.ID]
+		if !ok {
+			continue
+		}
+
+		for _, raw := range property.Values {
+			value := strings.TrimSpace(raw)
+			if value == "" || value == cmlEmptyID {
+				continue
+			}
+			for _, variant := range definition.Values {
+				if variant.ID == value {
+					value = strings.TrimSpace(variant.Value)
+					break
+				}
+			}
+
+			optionID, err := c.optionID(definition.Name, definition.Name)
+			if err != nil {
+				return nil, err
+			}
+			valueID, err := c.optionValueID(optionID, value)
+			if err != nil {
+				return nil, err
+			}
+			valueIDs = append(valueIDs, valueID)
+		}
+	}
+	return valueIDs, nil
+}
+
+// mergeSKUValues sets the given values on a SKU, replacing other values of
+// the same options and leaving options that are not mentioned alone
+func (c *cmlImporter) mergeSKUValues(skuID int64, valueIDs []int64) (bool, error) {
+	valueIDs = uniqueIDs(valueIDs)
+	if len(valueIDs) == 0 {
+		return false, nil
+	}
+
+	placeholders, args := inPlaceholders(valueIDs)
+	deleteArgs := append([]interface{}{skuID}, args...)
+	deleteArgs = append(deleteArgs, args...)
+	result, err := c.tx.ExecContext(c.ctx, fmt.Sprintf(`
+		DELETE so FROM sku_options so
+		JOIN option_values ov ON ov.id = so.option_value_id
+		WHERE so.sku_id = ?
+			AND ov.option_id IN (SELECT option_id FROM option_values WHERE id IN (%s))
+			AND so.option_value_id NOT IN (%s)`, placeholders, placeholders), deleteArgs...)
+	if err != nil {
+		return false, fmt.Errorf("error replacing SKU options: %w", err)
+	}
+	changed, _ := result.RowsAffected()
+
+	for _, valueID := range valueIDs {
+		result, err := c.tx.ExecContext(c.ctx,
+			"INSERT IGNORE INTO sku_options (sku_id, option_value_id) VALUES (?, ?)", skuID, valueID)
+		if err != nil {
+			return false, fmt.Errorf("error adding SKU option: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		changed += n
+	}
+
+	return changed > 0, nil
+}
+
+// productValueIDs returns the stored property values of a product
+func (c *cmlImporter) productValueIDs(productID int64) ([]int64, error) {
+	rows, err := c.tx.QueryContext(c.ctx,
+		"SELECT option_value_id FROM commerceml_product_options WHERE product_id = ?", productID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading product properties: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (c *cmlImporter) importProduct(product *cmlProduct) error {
+	// Some configurations export each characteristic as a separate product
+	if strings.Contains(product.ID, "#") {
+		return c.importOffer(&cmlOffer{ID: product.ID, Characteristics: product.Characteristics})
+	}
+
+	productID, mapped, err := c.mappedID("product", product.ID)
+	if err != nil {
+		return err
+	}
+
+	if product.Status == "Удален" || product.DeletionMark == "true" {
+		if mapped {
+			if _, err := c.tx.ExecContext(c.ctx, "DELETE FROM products WHERE id = ?", productID); err != nil {
+				return fmt.Errorf("error deleting product %s: %w", product.ID, err)
+			}
+			c.report.ProductsDeleted++
+			c.touch(productID)
+		}
+		return nil
+	}
+
+	name := strings.TrimSpace(product.Name)
+	article := strings.TrimSpace(product.Article)
+	if article == "" {
+		article = product.ID
+	}
+
+	if mapped {
+		result, err := c.tx.ExecContext(c.ctx,
+			"UPDATE products SET name = ?, article = ? WHERE id = ?", name, article, productID)
+		if err != nil {
+			return fmt.Errorf("error updating product %s: %w", product.ID, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			c.report.ProductsUpdated++
+			c.touch(productID)
+		}
+	} else {
+		if productID, err = c.upsertProduct(article, name); err != nil {
+			return err
+		}
+		if err := c.setMapping("product", product.ID, productID); err != nil {
+			return err
+		}
+	}
+
+	valueIDs, err := c.propertyValueIDs(product)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.tx.ExecContext(c.ctx, "DELETE FROM commerceml_product_options WHERE product_id = ?", productID); err != nil {
+		return fmt.Errorf("error replacing product properties: %w", err)
+	}
+	for _, valueID := range uniqueIDs(valueIDs) {
+		_, err := c.tx.ExecContext(c.ctx,
+			"INSERT INTO commerceml_product_options (product_id, option_value_id) VALUES (?, ?)", productID, valueID)
+		if err != nil {
+			return fmt.Errorf("error saving product properties: %w", err)
+		}
+	}
+
+	skuIDs, err := queryTxIDs(c.ctx, c.tx, "SELECT id FROM skus WHERE product_id = ?", productID)
+	if err != nil {
+		return err
+	}
+	for _, skuID := range skuIDs {
+		changed, err := c.mergeSKUValues(skuID, valueIDs)
+		if err != nil {
+			return err
+		}
+		if changed {
+			c.touch(productID)
+		}
+	}
+	return nil
+}
+
+// warehouseID returns the warehouse whose code is the 1C identifier, creating
+// it with the name from the Склады list if needed
+func (c *cmlImporter) warehouseID(externalID string) (int64, error) {
+	if id, ok := c.warehouses[externalID]; ok {
+		return id, nil
+	}
+
+	var id int64
+	err := c.tx.QueryRowContext(c.ctx, "SELECT id FROM warehouses WHERE code = ?", externalID).Scan(&id)
+	if err == sql.ErrNoRows {
+		if utf8.RuneCountInString(externalID) > 50 {
+			return 0, &importRowError{Message: fmt.Sprintf("warehouse ID %q is longer than 50 characters", externalID)}
+		}
+		name := c.warehouseNames[externalID]
+		if name == "" {
+			name = externalID
+		}
+		result, err := c.tx.ExecContext(c.ctx, "INSERT INTO warehouses (code, name) VALUES (?, ?)", externalID, name)
+		if err != nil {
+			return 0, fmt.Errorf("error creating warehouse %s: %w", externalID, err)
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("error looking up warehouse %s: %w", externalID, err)
+	}
+
+	c.warehouses[externalID] = id
+	c.undo = append(c.undo, func() { delete(c.warehouses, externalID) })
+	return id, nil
+}
+
+// setStocks replaces the warehouse quantities of a SKU with those of an offer;
+// warehouses the offer no longer lists drop to zero. The sku_stocks triggers
+// keep skus.count as the total.
+func (c *cmlImporter) setStocks(skuID int64, stocks []cmlStock) (bool, error) {
+	rows, err := c.tx.QueryContext(c.ctx, "SELECT warehouse_id, quantity FROM sku_stocks WHERE sku_id = ? FOR UPDATE", skuID)
+	if err != nil {
+		return false, fmt.Errorf("error reading stock of SKU %d: %w", skuID, err)
+	}
+	current := make(map[int64]int)
+	for rows.Next() {
+		var warehouseID int64
+		var quantity int
+		if err := rows.Scan(&warehouseID, &quantity); err != nil {
+			rows.Close()
+			return false, err
+		}
+		current[warehouseID] = quantity
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return false, err
+	}
+
+	wanted := make(map[int64]int, len(current))
+	for warehouseID := range current {
+		wanted[warehouseID] = 0
+	}
+	for _, stock := range stocks {
+		warehouseID, err := c.warehouseID(stock.WarehouseID)
+		if err != nil {
+			return false, err
+		}
+		wanted[warehouseID] = stock.Quantity
+	}
+
+	// In warehouse order, like any other writer of several rows
+	warehouseIDs := make([]int64, 0, len(wanted))
+	for warehouseID := range wanted {
+		warehouseIDs = append(warehouseIDs, warehouseID)
+	}
+	changed := false
+	for _, warehouseID := range uniqueIDs(warehouseIDs) {
+		quantity := wanted[warehouseID]
+		if previous, ok := current[warehouseID]; ok && previous == quantity {
+			continue
+		}
+		_, err := c.tx.ExecContext(c.ctx, `
+			INSERT INTO sku_stocks (sku_id, warehouse_id, quantity) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE quantity = VALUES(quantity)`, skuID, warehouseID, quantity)
+		if err != nil {
+			return false, fmt.Errorf("error updating stock of SKU %d in warehouse %d: %w", skuID, warehouseID, err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func (c *cmlImporter) importOffer(offer *cmlOffer) error {
+	productExternalID, _, _ := strings.Cut(offer.ID, "#")
+	productID, ok, err := c.mappedID("product", productExternalID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &importRowError{Message: fmt.Sprintf("offer %s: unknown product %s", offer.ID, productExternalID)}
+	}
+
+	quantity, err := offer.quantity()
+	if err != nil {
+		return &importRowError{Message: fmt.Sprintf("offer %s: %v", offer.ID, err)}
+	}
+	stocks, err := offer.stocks()
+	if err != nil {
+		return &importRowError{Message: fmt.Sprintf("offer %s: %v", offer.ID, err)}
+	}
+	if stocks != nil {
+		// skus.count follows sku_stocks, the total is not written directly
+		quantity = nil
+	}
+
+	barcode := strings.TrimSpace(offer.Barcode)
+	skuID, mapped, err := c.mappedID("sku", offer.ID)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	switch {
+	case mapped:
+		if quantity != nil {
+			perWarehouse, err := hasWarehouseStock(c.ctx, c.tx, skuID)
+			if err != nil {
+				return fmt.Errorf("error reading warehouse stock of SKU %s: %w", offer.ID, err)
+			}
+			if perWarehouse {
+				return &importRowError{Message: fmt.Sprintf("offer %s: SKU keeps stock per warehouse, the offer has only a total", offer.ID)}
+			}
+		}
+		result, err := c.tx.ExecContext(c.ctx, `
+			UPDATE skus SET
+				count = COALESCE(?, count),
+				barcode = COALESCE(NULLIF(?, ''), barcode)
+			WHERE id = ?`, quantity, barcode, skuID)
+		if err != nil {
+			return fmt.Errorf("error updating SKU %s: %w", offer.ID, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			changed = true
+			c.report.SKUsUpdated++
+		}
+	case barcode != "":
+		created := false
+		if skuID, created, err = c.upsertSKU(productID, barcode, quantity); err != nil {
+			return err
+		}
+		changed = created
+	default:
+		count := 0
+		if quantity != nil {
+			count = *quantity
+		}
+		result, err := c.tx.ExecContext(c.ctx, "INSERT INTO skus (product_id, count) VALUES (?, ?)", productID, count)
+		if err != nil {
+			return fmt.Errorf("error creating SKU %s: %w", offer.ID, err)
+		}
+		if skuID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		c.report.SKUsCreated++
+		changed = true
+	}
+
+	if !mapped {
+		if err := c.setMapping("sku", offer.ID, skuID); err != nil {
+			return err
+		}
+	}
+
+	if stocks != nil {
+		stocksChanged, err := c.setStocks(skuID, stocks)
+		if err != nil {
+			return err
+		}
+		if stocksChanged && !changed {
+			changed = true
+			c.report.SKUsUpdated++
+		}
+	}
+
+	valueIDs, err := c.characteristicValueIDs(offer.Characteristics)
+	if err != nil {
+		return err
+	}
+	productValues, err := c.productValueIDs(productID)
+	if err != nil {
+		return err
+	}
+
+	optionsChanged, err := c.mergeSKUValues(skuID, append(valueIDs, productValues...))
+	if err != nil {
+		return err
+	}
+
+	if changed || optionsChanged {
+		c.touch(productID)
+	}
+	return nil
+}
+
+// queryTxIDs runs a single int64 column query inside a transaction
+func queryTxIDs(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// importCommerceML applies a CommerceML file, committing every batchSize items.
+// On a database error the report lists the products of committed batches.
+func importCommerceML(ctx context.Context, r io.Reader, batchSize int) (*importReport, error) {
+	report := &importReport{Errors: []*importRowError{}}
+	importer := &cmlImporter{
+		catalogTx:      newCatalogTx(ctx, report),
+		properties:     make(map[string]*cmlProperty),
+		warehouseNames: make(map[string]string),
+		warehouses:     make(map[string]int64),
+	}
+	if err := importer.begin(); err != nil {
+		return report, err
+	}
+	defer func() { importer.tx.Rollback() }()
+
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return nil, fmt.Errorf("unsupported encoding %q, export CommerceML in UTF-8", charset)
+	}
+
+	inBatch := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("error parsing XML: %w", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var itemErr error
+		switch start.Name.Local {
+		case "Свойство":
+			property := &cmlProperty{}
+			if err := decoder.DecodeElement(property, &start); err != nil {
+				return report, fmt.Errorf("error parsing property: %w", err)
+			}
+			importer.properties[property.ID] = property
+			continue
+		case "Склад":
+			// Offers decode their own Склад elements, so this is the package list
+			var warehouse cmlWarehouse
+			if err := decoder.DecodeElement(&warehouse, &start); err != nil {
+				return report, fmt.Errorf("error parsing warehouse: %w", err)
+			}
+			importer.warehouseNames[strings.TrimSpace(warehouse.ID)] = strings.TrimSpace(warehouse.Name)
+			continue
+		case "Товар":
+			var product cmlProduct
+			if err := decoder.DecodeElement(&product, &start); err != nil {
+				return report, fmt.Errorf("error parsing product: %w", err)
+			}
+			if itemErr = importer.beginRow(); itemErr == nil {
+				itemErr = importer.importProduct(&product)
+			}
+		case "Предложение":
+			var offer cmlOffer
+			if err := decoder.DecodeElement(&offer, &start); err != nil {
+				return report, fmt.Errorf("error parsing offer: %w", err)
+			}
+			if itemErr = importer.beginRow(); itemErr == nil {
+				itemErr = importer.importOffer(&offer)
+			}
+		default:
+			continue
+		}
+
+		report.Rows++
+		var rowErr *importRowError
+		if errors.As(itemErr, &rowErr) {
+			if err := importer.rollbackRow(); err != nil {
+				return report, err
+			}
+			report.Errors = append(report.Errors, rowErr)
+		} else if itemErr != nil {
+			return report, itemErr
+		}
+
+		inBatch++
+		if inBatch >= batchSize {
+			if err := importer.commit(); err != nil {
+				return report, err
+			}
+			if err := importer.begin(); err != nil {
+				return report, err
+			}
+			inBatch = 0
+		}
+	}
+
+	if err := importer.commit(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// importCommerceMLFile imports a file and reindexes the affected products
+func importCommerceMLFile(ctx context.Context, path string) (*importReport, error) {
+	batchSize, err := strconv.Atoi(getEnv("CML_BATCH_SIZE", "500"))
+	if err != nil || batchSize <= 0 {
+		return nil, fmt.Errorf("invalid CML_BATCH_SIZE: must be a positive number")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	report, err := importCommerceML(ctx, file, batchSize)
+	if err != nil {
+		// Batches committed before the error still have to reach the index
+		if len(report.ProductIDs) > 0 {
+			reindexCommitted(ctx, report.ProductIDs)
+		}
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+
+	log.Printf("CommerceML %s: %d items, products %d created, %d updated, %d deleted, SKUs %d created, %d updated, %d errors",
+		filepath.Base(path), report.Rows, report.ProductsCreated, report.ProductsUpdated, report.ProductsDeleted,
+		report.SKUsCreated, report.SKUsUpdated, len(report.Errors))
+	for _, itemErr := range report.Errors {
+		log.Printf("CommerceML %s: %v", filepath.Base(path), itemErr)
+	}
+
+	if len(report.ProductIDs) > 0 {
+		if err := reindexCommitted(ctx, report.ProductIDs); err != nil {
+			return report, fmt.Errorf("import succeeded but reindex failed: %w", err)
+		}
+	}
+	return report, nil
+}
+
+// runCommerceML implements the commerceml CLI command; import.xml must come
+// before offers.xml
+func runCommerceML(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: commerceml import.xml [offers.xml ...]")
+	}
+
+	for _, path := range args {
+		if _, err := importCommerceMLFile(context.Background(), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 1C HTTP exchange (type=catalog): checkauth, init, file upload in chunks and
+// import of the uploaded files. Enabled when CML_USER and CML_PASSWORD are
+// both set. An import runs
+// as a job under the run lock; 1C repeats the import request while it gets
+// "progress" and receives the outcome once the job finished.
+
+const cmlSessionCookie = "cml_session"
+
+var cmlSessions = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+// cmlImports holds the import job of each uploaded file until 1C picked up
+// its outcome
+var cmlImports = struct {
+	sync.Mutex
+	jobs map[string]*Job
+}{jobs: make(map[string]*Job)}
+
+// cmlExchangeDir is the directory uploads go to. It is a fixed subdirectory of
+// CML_EXCHANGE_DIR, so init only ever wipes files the exchange wrote itself
+func cmlExchangeDir() string {
+	return filepath.Join(getEnv("CML_EXCHANGE_DIR", os.TempDir()), "commerceml")
+}
+
+func cmlEnabled() bool {
+	return getEnv("CML_USER", "") != "" && getEnv("CML_PASSWORD", "") != ""
+}
+
+// cmlFileLimit is the largest chunk 1C may send in one file request
+func cmlFileLimit() (int64, error) {
+	limit, err := strconv.ParseInt(getEnv("CML_FILE_LIMIT", "104857600"), 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid CML_FILE_LIMIT: must be a positive number")
+	}
+	return limit, nil
+}
+
+// cmlImportStatus starts the import of an uploaded file or reports on it:
+// "progress" while it runs, then "success" or "failure" with the error
+func cmlImportStatus(path string) []string {
+	cmlImports.Lock()
+	defer cmlImports.Unlock()
+
+	if job, ok := cmlImports.jobs[path]; ok {
+		info := job.info()
+		switch info.Status {
+		case JobRunning:
+			return []string{"progress", "import job " + info.ID}
+		case JobSucceeded:
+			delete(cmlImports.jobs, path)
+			return []string{"success"}
+		default:
+			delete(cmlImports.jobs, path)
+			return []string{"failure", info.Error}
+		}
+	}
+
+	job := newJob("commerceml", "1c")
+	release, err := acquireRunLock(job.id())
+	if err != nil {
+		// 1C asks again, by then the other run may be done
+		var running *runningJobError
+		if errors.As(err, &running) {
+			return []string{"progress", running.Error()}
+		}
+		return []string{"failure", err.Error()}
+	}
+
+	jobs.add(job)
+	cmlImports.jobs[path] = job
+	job.start(func(ctx context.Context, job *Job) error {
+		defer release()
+		job.phase("import " + filepath.Base(path))
+		report, err := importCommerceMLFile(ctx, path)
+		if report != nil {
+			job.addRows(report.Rows)
+			for _, itemErr := range report.Errors {
+				job.addError(itemErr)
+			}
+		}
+		if err != nil {
+			log.Printf("CommerceML import error: %v", err)
+		}
+		return err
+	})
+	return []string{"progress", "import job " + job.id()}
+}
+
+func cmlReply(w http.ResponseWriter, lines ...string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(lines, "\n"))
+}
+
+func cmlCheckCredentials(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	return ok && cmlEnabled() &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(getEnv("CML_USER", ""))) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(getEnv("CML_PASSWORD", ""))) == 1
+}
+
+func cmlCheckSession(r *http.Request) bool {
+	cookie, err := r.Cookie(cmlSessionCookie)
+	if err != nil {
+		return cmlCheckCredentials(r)
+	}
+
+	cmlSessions.Lock()
+	defer cmlSessions.Unlock()
+	expires, ok := cmlSessions.expires[cookie.Value]
+	return ok && time.Now().Before(expires) || cmlCheckCredentials(r)
+}
+
+// cmlInit starts a new exchange with an empty directory. It is refused while
+// an import still reads the files of the previous one
+func cmlInit() error {
+	cmlImports.Lock()
+	defer cmlImports.Unlock()
+
+	for path, job := range cmlImports.jobs {
+		if job.info().Status == JobRunning {
+			return fmt.Errorf("import of %s is still running", filepath.Base(path))
+		}
+	}
+	// Outcomes of an abandoned exchange are not reported to the next one
+	cmlImports.jobs = make(map[string]*Job)
+
+	dir := cmlExchangeDir()
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0o755)
+}
+
+// cmlFilePath resolves an uploaded file name inside the exchange directory
+func cmlFilePath(name string) (string, error) {
+	cleaned := filepath.Clean("/" + name)
+	if name == "" || cleaned == "/" {
+		return "", errors.New("missing filename")
+	}
+	return filepath.Join(cmlExchangeDir(), cleaned), nil
+}
+
+func commerceMLExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	if !cmlEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("type") != "catalog" {
+		cmlReply(w, "failure", "only type=catalog is supported")
+		return
+	}
+
+	mode := query.Get("mode")
+	if mode == "checkauth" {
+		if !cmlCheckCredentials(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="1C exchange"`)
+			http.Error(w, "failure", http.StatusUnauthorized)
+			return
+		}
+
+		b := make([]byte, 16)
+		rand.Read(b)
+		token := hex.EncodeToString(b)
+
+		cmlSessions.Lock()
+		now := time.Now()
+		for session, expires := range cmlSessions.expires {
+			if now.After(expires) {
+				delete(cmlSessions.expires, session)
+			}
+		}
+		cmlSessions.expires[token] = now.Add(time.Hour)
+		cmlSessions.Unlock()
+
+		cmlReply(w, "success", cmlSessionCookie, token)
+		return
+	}
+
+	if !cmlCheckSession(r) {
+		http.Error(w, "failure\nnot authorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch mode {
+	case "init":
+		limit, err := cmlFileLimit()
+		if err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+
+		if err := cmlInit(); err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+		cmlReply(w, "zip=no", "file_limit="+strconv.FormatInt(limit, 10))
+	case "file":
+		limit, err := cmlFileLimit()
+		if err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+		path, err := cmlFilePath(query.Get("filename"))
+		if err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+
+		// Large files arrive in several requests and are appended
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+		_, err = io.Copy(file, r.Body)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+		cmlReply(w, "success")
+	case "import":
+		path, err := cmlFilePath(query.Get("filename"))
+		if err != nil {
+			cmlReply(w, "failure", err.Error())
+			return
+		}
+
+		// Images and other attachments are accepted but not imported
+		if !strings.EqualFold(filepath.Ext(path), ".xml") {
+			cmlReply(w, "success")
+			return
+		}
+
+		cmlReply(w, cmlImportStatus(path)...)
+	default:
+		cmlReply(w, "failure", fmt.Sprintf("unknown mode %q", mode))
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCMLProductDecode(t *testing.T) {
+	input := `<Товар>
+		<Ид>bd72d8f9-55bc-11d9-848a-00112f43529a</Ид>
+		<Артикул>SH-01</Артикул>
+		<Наименование>Рубашка</Наименование>
+		<ЗначенияСвойств>
+			<ЗначенияСвойства><Ид>color</Ид><Значение>red-id</Значение></ЗначенияСвойства>
+			<ЗначенияСвойства><Ид>tags</Ид><Значение>a</Значение><Значение>b</Значение></ЗначенияСвойства>
+		</ЗначенияСвойств>
+		<ХарактеристикиТовара>
+			<ХарактеристикаТовара><Наименование>Размер</Наименование><Значение>M</Значение></ХарактеристикаТовара>
+		</ХарактеристикиТовара>
+		<Статус>Удален</Статус>
+	</Товар>`
+
+	var product cmlProduct
+	if err := xml.Unmarshal([]byte(input), &product); err != nil {
+		t.Fatal(err)
+	}
+	if product.ID != "bd72d8f9-55bc-11d9-848a-00112f43529a" || product.Article != "SH-01" ||
+		product.Name != "Рубашка" || product.Status != "Удален" {
+		t.Errorf("product = %+v", product)
+	}
+	if len(product.Properties) != 2 || product.Properties[0].ID != "color" ||
+		!reflect.DeepEqual(product.Properties[1].Values, []string{"a", "b"}) {
+		t.Errorf("properties = %+v", product.Properties)
+	}
+	if want := []cmlCharacteristic{{"Размер", "M"}}; !reflect.DeepEqual(product.Characteristics, want) {
+		t.Errorf("characteristics = %+v, want %+v", product.Characteristics, want)
+	}
+}
+
+func TestCMLPropertyDecode(t *testing.T) {
+	input := `<Свойство>
+		<Ид>color</Ид>
+		<Наименование>Цвет</Наименование>
+		<ВариантыЗначений>
+			<Справочник><ИдЗначения>red-id</ИдЗначения><Значение>Красный</Значение></Справочник>
+			<Справочник><ИдЗначения>blue-id</ИдЗначения><Значение>Синий</Значение></Справочник>
+		</ВариантыЗначений>
+	</Свойство>`
+
+	var property cmlProperty
+	if err := xml.Unmarshal([]byte(input), &property); err != nil {
+		t.Fatal(err)
+	}
+	if property.ID != "color" || property.Name != "Цвет" || len(property.Values) != 2 ||
+		property.Values[1].ID != "blue-id" || property.Values[1].Value != "Синий" {
+		t.Errorf("property = %+v", property)
+	}
+}
+
+func TestCMLOfferQuantity(t *testing.T) {
+	tests := []struct {
+		name    string
+		offer   string
+		want    *int
+		wantErr bool
+	}{
+		{"none", `<Предложение><Ид>1</Ид></Предложение>`, nil, false},
+		{"total", `<Предложение><Количество>12</Количество></Предложение>`, intPtr(12), false},
+		{"decimal comma", `<Предложение><Количество>2,7</Количество></Предложение>`, intPtr(2), false},
+		{"negative", `<Предложение><Количество>-3</Количество></Предложение>`, intPtr(0), false},
+		{"invalid", `<Предложение><Количество>many</Количество></Предложение>`, nil, true},
+		{"2.08 stocks", `<Предложение><Остатки>
+			<Остаток><Склад><Ид>w1</Ид><Количество>3</Количество></Склад></Остаток>
+			<Остаток><Склад><Ид>w2</Ид><Количество>4</Количество></Склад></Остаток>
+		</Остатки></Предложение>`, intPtr(7), false},
+		{"2.04 warehouses", `<Предложение>
+			<Склад ИдСклада="w1" КоличествоНаСкладе="5"/>
+			<Склад ИдСклада="w2" КоличествоНаСкладе=""/>
+		</Предложение>`, intPtr(5), false},
+		{"total wins", `<Предложение><Количество>1</Количество><Склад ИдСклада="w1" КоличествоНаСкладе="5"/></Предложение>`,
+			intPtr(1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offer cmlOffer
+			if err := xml.Unmarshal([]byte(tt.offer), &offer); err != nil {
+				t.Fatal(err)
+			}
+			got, err := offer.quantity()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("quantity = %v, want %v", deref(got), deref(tt.want))
+			}
+		})
+	}
+}
+
+func TestCMLOfferStocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		offer   string
+		want    []cmlStock
+		wantErr bool
+	}{
+		{"none", `<Предложение><Ид>1</Ид></Предложение>`, nil, false},
+		{"total only", `<Предложение><Количество>12</Количество></Предложение>`, nil, false},
+		{"2.08 stocks", `<Предложение><Остатки>
+			<Остаток><Склад><Ид>w2</Ид><Количество>3,5</Количество></Склад></Остаток>
+			<Остаток><Склад><Ид>w1</Ид><Количество>4</Количество></Склад></Остаток>
+			<Остаток><Склад><Ид>w2</Ид><Количество>1</Количество></Склад></Остаток>
+		</Остатки></Предложение>`, []cmlStock{{"w2", 4}, {"w1", 4}}, false},
+		{"2.04 warehouses", `<Предложение>
+			<Количество>5</Количество>
+			<Склад ИдСклада="w1" КоличествоНаСкладе="5"/>
+			<Склад ИдСклада="w2" КоличествоНаСкладе=""/>
+			<Склад ИдСклада="w3" КоличествоНаСкладе="-2"/>
+		</Предложение>`, []cmlStock{{"w1", 5}, {"w2", 0}, {"w3", 0}}, false},
+		{"unnamed warehouse", `<Предложение><Остатки>
+			<Остаток><Склад><Количество>3</Количество></Склад></Остаток>
+		</Остатки></Предложение>`, nil, false},
+		{"invalid", `<Предложение><Склад ИдСклада="w1" КоличествоНаСкладе="many"/></Предложение>`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offer cmlOffer
+			if err := xml.Unmarshal([]byte(tt.offer), &offer); err != nil {
+				t.Fatal(err)
+			}
+			got, err := offer.stocks()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stocks = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCMLWarehouseDecode(t *testing.T) {
+	input := `<Склад><Ид>w1</Ид><Наименование>Основной склад</Наименование></Склад>`
+
+	var warehouse cmlWarehouse
+	if err := xml.Unmarshal([]byte(input), &warehouse); err != nil {
+		t.Fatal(err)
+	}
+	if warehouse.ID != "w1" || warehouse.Name != "Основной склад" {
+		t.Errorf("warehouse = %+v", warehouse)
+	}
+}
+
+func deref(n *int) interface{} {
+	if n == nil {
+		return nil
+	}
+	return *n
+}
+
+func TestCMLFilePath(t *testing.T) {
+	base := t.TempDir()
+	t.Setenv("CML_EXCHANGE_DIR", base)
+	dir := filepath.Join(base, "commerceml")
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"import.xml", filepath.Join(dir, "import.xml"), false},
+		{"import_files/ab/photo.jpg", filepath.Join(dir, "import_files/ab/photo.jpg"), false},
+		{"../../etc/passwd", filepath.Join(dir, "etc/passwd"), false},
+		{"/etc/passwd", filepath.Join(dir, "etc/passwd"), false},
+		{"", "", true},
+		{"..", "", true},
+	}
+	for _, tt := range tests {
+		got, err := cmlFilePath(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("cmlFilePath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestCMLFileUploadLimit(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CML_EXCHANGE_DIR", dir)
+	t.Setenv("CML_USER", "1c")
+	t.Setenv("CML_PASSWORD", "secret")
+	t.Setenv("CML_FILE_LIMIT", "10")
+
+	upload := func(body string) string {
+		r := httptest.NewRequest(http.MethodPost, "/1c_exchange?type=catalog&mode=file&filename=import.xml", strings.NewReader(body))
+		r.SetBasicAuth("1c", "secret")
+		w := httptest.NewRecorder()
+		commerceMLExchangeHandler(w, r)
+		return w.Body.String()
+	}
+
+	if got := upload("<a>1</a>"); got != "success" {
+		t.Fatalf("small chunk: %q", got)
+	}
+	if got := upload("<a>123456789</a>"); !strings.HasPrefix(got, "failure") {
+		t.Errorf("oversized chunk: %q, want failure", got)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/1c_exchange?type=catalog&mode=init", nil)
+	r.SetBasicAuth("1c", "secret")
+	w := httptest.NewRecorder()
+	commerceMLExchangeHandler(w, r)
+	if got := w.Body.String(); got != "zip=no\nfile_limit=10" {
+		t.Errorf("init = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "commerceml", "import.xml")); !os.IsNotExist(err) {
+		t.Errorf("init kept the uploaded file: %v", err)
+	}
+}
+
+func TestCMLCredentials(t *testing.T) {
+	t.Setenv("CML_USER", "1c")
+	t.Setenv("CML_PASSWORD", "")
+
+	r := httptest.NewRequest(http.MethodGet, "/1c_exchange?type=catalog&mode=checkauth", nil)
+	r.SetBasicAuth("1c", "")
+	if cmlCheckCredentials(r) {
+		t.Error("an empty password was accepted")
+	}
+	w := httptest.NewRecorder()
+	commerceMLExchangeHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d without CML_PASSWORD, want %d", w.Code, http.StatusNotFound)
+	}
+
+	t.Setenv("CML_PASSWORD", "secret")
+	if cmlCheckCredentials(r) {
+		t.Error("a wrong password was accepted")
+	}
+	r.SetBasicAuth("1c", "secret")
+	if !cmlCheckCredentials(r) {
+		t.Error("the configured credentials were refused")
+	}
+}
+
+func TestCMLInit(t *testing.T) {
+	base := t.TempDir()
+	t.Setenv("CML_EXCHANGE_DIR", base)
+	t.Setenv("CML_USER", "1c")
+	t.Setenv("CML_PASSWORD", "secret")
+
+	// Files next to the exchange directory are not the exchange's to remove
+	other := filepath.Join(base, "other.txt")
+	if err := os.WriteFile(other, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := cmlFilePath("import.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(upload), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(upload, []byte("<a/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	startExchange := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/1c_exchange?type=catalog&mode=init", nil)
+		r.SetBasicAuth("1c", "secret")
+		w := httptest.NewRecorder()
+		commerceMLExchangeHandler(w, r)
+		return w.Body.String()
+	}
+
+	// An import still reading the previous upload blocks init
+	release := make(chan struct{})
+	job := newJob("commerceml", "1c")
+	job.start(func(ctx context.Context, job *Job) error {
+		<-release
+		return nil
+	})
+	cmlImports.Lock()
+	cmlImports.jobs[upload] = job
+	cmlImports.Unlock()
+	t.Cleanup(func() {
+		cmlImports.Lock()
+		cmlImports.jobs = make(map[string]*Job)
+		cmlImports.Unlock()
+	})
+
+	if got := startExchange(); !strings.HasPrefix(got, "failure") {
+		t.Errorf("init during an import = %q, want failure", got)
+	}
+	if _, err := os.Stat(upload); err != nil {
+		t.Errorf("init during an import removed the upload: %v", err)
+	}
+
+	close(release)
+	<-job.done()
+	if got := startExchange(); !strings.HasPrefix(got, "zip=no") {
+		t.Fatalf("init = %q", got)
+	}
+	if _, err := os.Stat(upload); !os.IsNotExist(err) {
+		t.Errorf("init kept the uploaded file: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("init removed a file outside the exchange directory: %v", err)
+	}
+	cmlImports.Lock()
+	defer cmlImports.Unlock()
+	if len(cmlImports.jobs) != 0 {
+		t.Errorf("finished imports kept after init: %v", cmlImports.jobs)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Products whose Reindexer write failed are kept in the sync_dead_letters
+// table (migrations/002_sync_dead_letters.sql) and retried in the background
+// with exponential backoff until they are written or DEAD_LETTER_MAX_ATTEMPTS
+// is reached. Entries past the limit stay listed until retried or purged.
+
+// deadLetterPageSize limits how many entries are read or retried at once
+const deadLetterPageSize = 1000
+
+// DeadLetter is a product that could not be written to Reindexer
+type DeadLetter struct {
+	ProductID     int64     `json:"product_id"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	NextRetryAt   time.Time `json:"next_retry_at"`
+}
+
+// DeadLettersResponse is a page of dead letters ordered by product ID
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+	Total       int          `json:"total"`
+	NextAfterID *int64       `json:"next_after_id,omitempty"`
+}
+
+// deadLetterConfig holds the retry tunables
+type deadLetterConfig struct {
+	Interval    time.Duration
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+}
+
+func getDeadLetterConfig() (deadLetterConfig, error) {
+	interval, err := time.ParseDuration(getEnv("DEAD_LETTER_RETRY_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		return deadLetterConfig{}, fmt.Errorf("invalid DEAD_LETTER_RETRY_INTERVAL: must be a positive duration")
+	}
+
+	backoff, err := time.ParseDuration(getEnv("DEAD_LETTER_BACKOFF", "30s"))
+	if err != nil || backoff < time.Second {
+		return deadLetterConfig{}, fmt.Errorf("invalid DEAD_LETTER_BACKOFF: must be at least 1s")
+	}
+
+	maxBackoff, err := time.ParseDuration(getEnv("DEAD_LETTER_MAX_BACKOFF", "1h"))
+	if err != nil || maxBackoff < backoff {
+		return deadLetterConfig{}, fmt.Errorf("invalid DEAD_LETTER_MAX_BACKOFF: must not be less than DEAD_LETTER_BACKOFF")
+	}
+
+	maxAttempts, err := strconv.Atoi(getEnv("DEAD_LETTER_MAX_ATTEMPTS", "10"))
+	if err != nil || maxAttempts <= 0 {
+		return deadLetterConfig{}, fmt.Errorf("invalid DEAD_LETTER_MAX_ATTEMPTS: must be a positive number")
+	}
+
+	return deadLetterConfig{
+		Interval:    interval,
+		Backoff:     backoff,
+		MaxBackoff:  maxBackoff,
+		MaxAttempts: maxAttempts,
+	}, nil
+}
+
+// logDeadLetterError logs a failed dead-letter write; a missing table only
+// means migrations were not applied and is not worth a log line per batch
+func logDeadLetterError(err error) {
+	if err != nil && !isMissingTable(err) {
+		log.Printf("Error updating dead letters: %v", err)
+	}
+}
+
+// recordDeadLetters stores failed products. The first retry is due after
+// DEAD_LETTER_BACKOFF, every further failure doubles the delay up to
+// DEAD_LETTER_MAX_BACKOFF.
+func recordDeadLetters(ids []int64, cause error) error {
+	cfg, err := getDeadLetterConfig()
+	if err != nil {
+		return err
+	}
+
+	ids = uniqueIDs(ids)
+	backoff := int64(cfg.Backoff / time.Second)
+	maxBackoff := int64(cfg.MaxBackoff / time.Second)
+
+	for start := 0; start < len(ids); start += reindexChunkSize {
+		end := start + reindexChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		values := make([]string, 0, end-start)
+		var args []interface{}
+		for _, id := range ids[start:end] {
+			values = append(values, "(?, ?, NOW(3) + INTERVAL ? SECOND)")
+			args = append(args, id, cause.Error(), backoff)
+		}
+		args = append(args, backoff, maxBackoff)
+
+		// next_retry_at is assigned before attempts, so it sees the old count
+		_, err := db.Exec(fmt.Sprintf(`
+			INSERT INTO sync_dead_letters (product_id, error, next_retry_at)
+			VALUES %s
+			ON DUPLICATE KEY UPDATE
+				next_retry_at = NOW(3) + INTERVAL LEAST(? * POW(2, attempts), ?) SECOND,
+				attempts = attempts + 1,
+				error = VALUES(error),
+				last_failed_at = CURRENT_TIMESTAMP(3)`, strings.Join(values, ",")), args...)
+		if err != nil {
+			return fmt.Errorf("error recording dead letters: %w", err)
+		}
+	}
+
+	log.Printf("Queued %d products for retry: %v", len(ids), cause)
+	return nil
+}
+
+// clearDeadLetters removes products that were written successfully
+func clearDeadLetters(ctx context.Context, ids []int64) (int64, error) {
+	var cleared int64
+
+	for start := 0; start < len(ids); start += reindexChunkSize {
+		end := start + reindexChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		placeholders, args := inPlaceholders(ids[start:end])
+		result, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM sync_dead_letters WHERE product_id IN (%s)", placeholders), args...)
+		if err != nil {
+			return cleared, fmt.Errorf("error clearing dead letters: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		cleared += n
+	}
+
+	return cleared, nil
+}
+
+// purgeAllDeadLetters removes every entry
+func purgeAllDeadLetters() (int64, error) {
+	result, err := db.Exec("DELETE FROM sync_dead_letters")
+	if err != nil {
+		return 0, fmt.Errorf("error purging dead letters: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// listDeadLetters returns up to limit entries with product_id > afterID
+func listDeadLetters(ctx context.Context, afterID int64, limit int) (*DeadLettersResponse, error) {
+	response := &DeadLettersResponse{DeadLetters: []DeadLetter{}}
+
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sync_dead_letters").Scan(&response.Total); err != nil {
+		return nil, fmt.Errorf("error counting dead letters: %w", err)
+	}
+
+	// One extra row tells whether there is a next page
+	rows, err := db.QueryContext(ctx, `
+		SELECT product_id, error, attempts, first_failed_at, last_failed_at, next_retry_at
+		FROM sync_dead_letters
+		WHERE product_id > ?
+		ORDER BY product_id
+		LIMIT ?`, afterID, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry DeadLetter
+		if err := rows.Scan(&entry.ProductID, &entry.Error, &entry.Attempts,
+			&entry.FirstFailedAt, &entry.LastFailedAt, &entry.NextRetryAt); err != nil {
+			return nil, fmt.Errorf("error scanning dead letter: %w", err)
+		}
+		response.DeadLetters = append(response.DeadLetters, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating dead letters: %w", err)
+	}
+
+	if len(response.DeadLetters) > limit {
+		response.DeadLetters = response.DeadLetters[:limit]
+		nextAfterID := response.DeadLetters[limit-1].ProductID
+		response.NextAfterID = &nextAfterID
+	}
+	return response, nil
+}
+
+// dueDeadLetters returns entries whose next retry is due
+func dueDeadLetters(ctx context.Context, maxAttempts int) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT product_id
+		FROM sync_dead_letters
+		WHERE next_retry_at <= NOW(3) AND attempts < ?
+		ORDER BY next_retry_at
+		LIMIT ?`, maxAttempts, deadLetterPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning dead letter: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// runDeadLetterRetry retries due dead letters forever. reindexProducts clears
+// the entries it writes and records the ones that fail again.
+func runDeadLetterRetry() {
+	cfg, err := getDeadLetterConfig()
+	if err != nil {
+		log.Printf("Dead letter retry disabled: %v", err)
+		return
+	}
+
+	for {
+		time.Sleep(cfg.Interval)
+
+		ids, err := dueDeadLetters(context.Background(), cfg.MaxAttempts)
+		if err != nil {
+			logDeadLetterError(err)
+			continue
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		log.Printf("Retrying %d dead-lettered products", len(ids))
+		if _, err := reindexProducts(context.Background(), ids); err != nil {
+			log.Printf("Dead letter retry error: %v", err)
+		}
+	}
+}
+
+// retryDeadLetters reindexes the given products, or every dead letter when
+// ids is empty, regardless of attempts and backoff
+func retryDeadLetters(ctx context.Context, job *Job, ids []int64) error {
+	job.phase("retry")
+
+	if len(ids) > 0 {
+		result, err := reindexProducts(ctx, ids)
+		if err != nil {
+			return err
+		}
+		job.addRows(result.total())
+		job.addDocuments(result.WriteStats)
+		if err := result.failure(); err != nil {
+			job.addError(err)
+		}
+		return nil
+	}
+
+	afterID := int64(0)
+	for {
+		page, err := listDeadLetters(ctx, afterID, deadLetterPageSize)
+		if err != nil {
+			return err
+		}
+		if len(page.DeadLetters) == 0 {
+			return nil
+		}
+
+		pageIDs := make([]int64, len(page.DeadLetters))
+		for i, entry := range page.DeadLetters {
+			pageIDs[i] = entry.ProductID
+		}
+
+		// Failures are recorded again, keep going with the next page
+		result, err := reindexProducts(ctx, pageIDs)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			job.addError(err)
+		} else {
+			job.addRows(result.total())
+			job.addDocuments(result.WriteStats)
+			if err := result.failure(); err != nil {
+				job.addError(err)
+			}
+		}
+
+		if page.NextAfterID == nil {
+			return nil
+		}
+		afterID = *page.NextAfterID
+	}
+}
+
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	afterID := int64(0)
+	limit := 100
+
+	if s := r.URL.Query().Get("after_id"); s != "" {
+		parsed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid after_id parameter", http.StatusBadRequest)
+			return
+		}
+		afterID = parsed
+	}
+
+	if s := r.URL.Query().Get("limit"); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil || parsed <= 0 || parsed > deadLetterPageSize {
+			http.Error(w, fmt.Sprintf("Invalid limit parameter (must be 1-%d)", deadLetterPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	response, err := listDeadLetters(r.Context(), afterID, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error listing dead letters: %v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// DeadLetterRetryRequest selects the entries to retry; empty means all
+type DeadLetterRetryRequest struct {
+	ProductIDs []int64 `json:"product_ids"`
+}
+
+func retryDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeadLetterRetryRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(req.ProductIDs) > maxReindexIDs {
+		http.Error(w, fmt.Sprintf("Provide at most %d product_ids", maxReindexIDs), http.StatusBadRequest)
+		return
+	}
+
+	job := jobs.create("retry", "http")
+	job.start(func(ctx context.Context, job *Job) error {
+		return retryDeadLetters(ctx, job, req.ProductIDs)
+	})
+
+	w.Header().Set("Location", "/jobs/"+job.id())
+	writeJSON(w, http.StatusAccepted, job.info())
+}
+
+func purgeDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	purged, err := purgeAllDeadLetters()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error purging dead letters: %v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"purged": purged})
+}
+
+func purgeDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	purged, err := clearDeadLetters(r.Context(), []int64{id})
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error purging dead letter %d: %v", id, err)
+		return
+	}
+	if purged == 0 {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"purged": purged})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /export streams the whole catalog as NDJSON, one product with its SKUs
+// and options per line, in product ID order. Products are read page by page,
+// so memory use does not grow with the catalog. A complete export ends with
+// {"done": true, "count": N}; a stream without that line was cut short, by
+// the connection or a database error, and is resumed with from_id set to the
+// last received ID + 1.
+
+// exportTrailer is the last line of a complete export
+type exportTrailer struct {
+	Done  bool `json:"done"`
+	Count int  `json:"count"`
+}
+
+// exportPage reads the products of the export; tests replace it
+var exportPage = getProducts
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "ndjson" {
+		http.Error(w, "Unsupported format (supported: ndjson)", http.StatusBadRequest)
+		return
+	}
+
+	fromID := int64(0)
+	if s := r.URL.Query().Get("from_id"); s != "" {
+		parsed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid from_id parameter", http.StatusBadRequest)
+			return
+		}
+		fromID = parsed
+	}
+
+	var updatedSince *time.Time
+	if s := r.URL.Query().Get("updated_since"); s != "" {
+		parsed, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Invalid updated_since parameter (must be RFC 3339)", http.StatusBadRequest)
+			return
+		}
+		updatedSince = &parsed
+	}
+
+	batchSize, err := strconv.Atoi(getEnv("EXPORT_BATCH_SIZE", "500"))
+	if err != nil || batchSize <= 0 {
+		http.Error(w, "Invalid EXPORT_BATCH_SIZE", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	exported := 0
+
+	for {
+		if err := r.Context().Err(); err != nil {
+			log.Printf("Export cancelled after %d products: %v", exported, err)
+			return
+		}
+
+		page, err := exportPage(fromID, batchSize, updatedSince)
+		if err != nil {
+			// Headers are gone once the first line is written; the client sees a
+			// stream without the trailer and resumes from the last ID it got
+			if exported == 0 {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+			}
+			log.Printf("Error exporting products from %d: %v", fromID, err)
+			return
+		}
+
+		for i := range page.Products {
+			if err := encoder.Encode(&page.Products[i]); err != nil {
+				log.Printf("Export aborted after %d products: %v", exported, err)
+				return
+			}
+			exported++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if page.NextProductID == nil {
+			break
+		}
+		fromID = *page.NextProductID
+	}
+
+	if err := encoder.Encode(exportTrailer{Done: true, Count: exported}); err != nil {
+		log.Printf("Export aborted after %d products: %v", exported, err)
+		return
+	}
+	log.Printf("Exported %d products", exported)
+}
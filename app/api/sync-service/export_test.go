@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeExportPages serves products 1-3 in pages of two, failing at failFrom
+func fakeExportPages(t *testing.T, failFrom int64) {
+	t.Helper()
+	previous := exportPage
+	exportPage = func(fromID int64, count int, updatedSince *time.Time) (*ProductsResponse, error) {
+		if fromID == failFrom {
+			return nil, errors.New("connection lost")
+		}
+		page := &ProductsResponse{}
+		for id := max(fromID, 1); id <= 3 && len(page.Products) < count; id++ {
+			page.Products = append(page.Products, Product{ID: id, SKUs: []SKU{}})
+		}
+		if next := fromID + int64(count); next <= 3 {
+			page.NextProductID = &next
+		}
+		page.Count = len(page.Products)
+		return page, nil
+	}
+	t.Cleanup(func() { exportPage = previous })
+}
+
+// exportLines runs an export and returns its status and lines
+func exportLines(t *testing.T) (int, []map[string]interface{}) {
+	t.Helper()
+	t.Setenv("EXPORT_BATCH_SIZE", "2")
+	w := httptest.NewRecorder()
+	exportHandler(w, httptest.NewRequest(http.MethodGet, "/export?format=ndjson&from_id=1", nil))
+
+	var lines []map[string]interface{}
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return w.Code, lines
+}
+
+func TestExportEndsWithTrailer(t *testing.T) {
+	fakeExportPages(t, -1)
+
+	status, lines := exportLines(t)
+	if status != http.StatusOK || len(lines) != 4 {
+		t.Fatalf("status %d, %d lines, want 200 and 3 products with a trailer", status, len(lines))
+	}
+	for i, line := range lines[:3] {
+		if line["id"] != float64(i+1) {
+			t.Errorf("line %d = %v, want product %d", i, line, i+1)
+		}
+	}
+	if trailer := lines[3]; trailer["done"] != true || trailer["count"] != float64(3) {
+		t.Errorf("trailer = %v, want done with count 3", trailer)
+	}
+}
+
+func TestExportErrorAfterFirstPage(t *testing.T) {
+	fakeExportPages(t, 3)
+
+	// The status is already sent, so only the missing trailer tells
+	status, lines := exportLines(t)
+	if status != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("status %d, %d lines, want 200 and 2 products", status, len(lines))
+	}
+	for _, line := range lines {
+		if _, ok := line["done"]; ok {
+			t.Errorf("trailer %v written after an error", line)
+		}
+	}
+}
+
+func TestExportErrorOnFirstPage(t *testing.T) {
+	fakeExportPages(t, 1)
+
+	if status, _ := exportLines(t); status != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", status, http.StatusInternalServerError)
+	}
+}
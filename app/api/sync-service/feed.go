@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Catalog feeds for marketplaces. A feed is rendered from getProducts pages
+// straight into the writer, so neither the command nor the endpoint holds
+// the catalog in memory. The catalog has no price column: the price is read
+// from the SKU option named by FEED_PRICE_OPTION, and SKUs without it are
+// left out, since marketplaces reject offers without a price.
+
+// feedConfig holds the shop settings shared by all feed formats
+type feedConfig struct {
+	ShopName    string
+	Company     string
+	ShopURL     string
+	ProductURL  string
+	Currency    string
+	Category    string
+	PriceOption string
+	BatchSize   int
+
+	GoogleAttributes string
+}
+
+func loadFeedConfig() (*feedConfig, error) {
+	batchSize, err := strconv.Atoi(getEnv("FEED_BATCH_SIZE", "500"))
+	if err != nil || batchSize <= 0 {
+		return nil, errors.New("invalid FEED_BATCH_SIZE: must be a positive number")
+	}
+
+	return &feedConfig{
+		ShopName:    getEnv("FEED_SHOP_NAME", "Shop"),
+		Company:     getEnv("FEED_COMPANY", getEnv("FEED_SHOP_NAME", "Shop")),
+		ShopURL:     getEnv("FEED_SHOP_URL", "https://example.com"),
+		ProductURL:  getEnv("FEED_PRODUCT_URL", "https://example.com/products/{id}"),
+		Currency:    getEnv("FEED_CURRENCY", "RUR"),
+		Category:    getEnv("FEED_CATEGORY", "Catalog"),
+		PriceOption: getEnv("FEED_PRICE_OPTION", "price"),
+		BatchSize:   batchSize,
+
+		GoogleAttributes: getEnv("FEED_GOOGLE_ATTRIBUTES", "color=color,size=size"),
+	}, nil
+}
+
+// productURL expands FEED_PRODUCT_URL for a product
+func (c *feedConfig) productURL(product *Product) string {
+	return expandProductURL(c.ProductURL, product)
+}
+
+// expandProductURL replaces {id} and {article} in a URL template
+func expandProductURL(template string, product *Product) string {
+	return strings.NewReplacer(
+		"{id}", strconv.FormatInt(product.ID, 10),
+		"{article}", url.PathEscape(product.Article),
+	).Replace(template)
+}
+
+// skuPrice returns the price option of a SKU
+func (c *feedConfig) skuPrice(sku *SKU) (string, bool) {
+	for _, option := range sku.Options {
+		if option.OptionName != c.PriceOption {
+			continue
+		}
+		price, err := strconv.ParseFloat(strings.Replace(option.Value, ",", ".", 1), 64)
+		if err != nil || price <= 0 {
+			return "", false
+		}
+		return strconv.FormatFloat(price, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// optionValue renders a SKU option value, ranges as "from-to"
+func optionValue(option *SKUOption) string {
+	if option.IsRange && option.RangeEndValue != nil {
+		return option.Value + "-" + *option.RangeEndValue
+	}
+	return option.Value
+}
+
+// walkProducts calls fn for every product with its SKUs, in ID order
+func walkProducts(ctx context.Context, batchSize int, fn func(product *Product) error) error {
+	fromID := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		page, err := getProducts(fromID, batchSize, nil)
+		if err != nil {
+			return err
+		}
+
+		for i := range page.Products {
+			if err := fn(&page.Products[i]); err != nil {
+				return err
+			}
+		}
+
+		if page.NextProductID == nil {
+			return nil
+		}
+		fromID = *page.NextProductID
+	}
+}
+
+// feedWriter renders a feed and returns the number of offers written
+type feedWriter func(ctx context.Context, w io.Writer, config *feedConfig) (int, error)
+
+var feedFormats = map[string]struct {
+	write       feedWriter
+	contentType string
+}{
+	"yml":        {writeYMLFeed, "application/xml; charset=utf-8"},
+	"google":     {writeGoogleFeed, "application/rss+xml; charset=utf-8"},
+	"google-tsv": {writeGoogleTSV, "text/tab-separated-values; charset=utf-8"},
+}
+
+// atomicFile is written through a temporary file in the target directory
+// and renamed into place on commit, so readers never see a partial file
+type atomicFile struct {
+	*bufio.Writer
+	path string
+	tmp  *os.File
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	return &atomicFile{Writer: bufio.NewWriter(tmp), path: path, tmp: tmp}, nil
+}
+
+// commit replaces the target with everything written so far
+func (f *atomicFile) commit() error {
+	err := f.Flush()
+	if err == nil {
+		err = f.tmp.Chmod(0o644)
+	}
+	if err == nil {
+		err = f.tmp.Sync()
+	}
+	if closeErr := f.tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.tmp.Name())
+		return fmt.Errorf("error writing %s: %w", f.path, err)
+	}
+
+	if err := os.Rename(f.tmp.Name(), f.path); err != nil {
+		os.Remove(f.tmp.Name())
+		return fmt.Errorf("error replacing %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// abort drops the temporary file; it is a no-op after commit
+func (f *atomicFile) abort() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
+
+// writeFileAtomic writes a file through an atomicFile
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	file, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+
+	if err := write(file); err != nil {
+		return err
+	}
+	return file.commit()
+}
+
+// runFeed implements the feed CLI command
+func runFeed(args []string) error {
+	flags := flag.NewFlagSet("feed", flag.ExitOnError)
+	output := flags.String("o", "", "output file, replaced atomically (default: stdout)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: feed [-o FILE] yml|google|google-tsv")
+	}
+	format, ok := feedFormats[flags.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown feed format %q", flags.Arg(0))
+	}
+
+	config, err := loadFeedConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	offers := 0
+	write := func(w io.Writer) error {
+		var err error
+		offers, err = format.write(ctx, w, config)
+		return err
+	}
+
+	if *output == "" {
+		buffered := bufio.NewWriter(os.Stdout)
+		if err := write(buffered); err != nil {
+			return err
+		}
+		return buffered.Flush()
+	}
+
+	if err := writeFileAtomic(*output, write); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s feed with %d offers to %s", flags.Arg(0), offers, *output)
+	return nil
+}
+
+// feedHandler streams a feed; GET /feed/{format}
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("format")
+	format, ok := feedFormats[name]
+	if !ok {
+		http.Error(w, "Unknown feed format", http.StatusNotFound)
+		return
+	}
+
+	config, err := loadFeedConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	offers, err := format.write(r.Context(), w, config)
+	if err != nil {
+		// Once streaming has started the client only sees a truncated document
+		log.Printf("Error writing %s feed after %d offers: %v", name, offers, err)
+		return
+	}
+	log.Printf("Served %s feed with %d offers", name, offers)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+
+func testFeedConfig() *feedConfig {
+	return &feedConfig{
+		ShopName:         "Shop",
+		ShopURL:          "https://example.com",
+		ProductURL:       "https://example.com/p/{article}?id={id}",
+		Currency:         "RUR",
+		Category:         "Catalog",
+		PriceOption:      "price",
+		BatchSize:        100,
+		GoogleAttributes: "color=color,size=size",
+	}
+}
+
+func option(name, display, value string) SKUOption {
+	return SKUOption{OptionName: name, OptionDisplayName: display, Value: value}
+}
+
+// testProduct has a priced SKU in stock, one without a price and one sold out
+func testProduct() *Product {
+	return &Product{
+		ID:      7,
+		Name:    `Shirt "Tom & Jerry" <kids>`,
+		Article: "SH 01/A",
+		SKUs: []SKU{
+			{ID: 70, Available: 3, Barcode: strPtr("4600000000001"), Options: []SKUOption{
+				option("color", "Color", "Red & Blue"),
+				option("price", "Price", "1299,50"),
+				{OptionName: "size", OptionDisplayName: "Size", Value: "40", IsRange: true, RangeEndValue: strPtr("44")},
+			}},
+			{ID: 71, Available: 5, Options: []SKUOption{option("color", "Color", "Green")}},
+			{ID: 72, Available: 0, Options: []SKUOption{option("price", "Price", "990")}},
+		},
+	}
+}
+
+func TestFeedSKUPrice(t *testing.T) {
+	config := testFeedConfig()
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"990", "990", true},
+		{"1299,50", "1299.5", true},
+		{"1299.00", "1299", true},
+		{"0", "", false},
+		{"-5", "", false},
+		{"free", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := config.skuPrice(&SKU{Options: []SKUOption{option("price", "Price", tt.value)}})
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("skuPrice(%q) = %q, %v, want %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if _, ok := config.skuPrice(&SKU{Options: []SKUOption{option("color", "Color", "10")}}); ok {
+		t.Error("a SKU without the price option has no price")
+	}
+}
+
+func TestExpandProductURL(t *testing.T) {
+	got := expandProductURL("https://example.com/p/{article}?id={id}", &Product{ID: 7, Article: "SH 01/A"})
+	if want := "https://example.com/p/SH%2001%2FA?id=7"; got != want {
+		t.Errorf("expandProductURL = %q, want %q", got, want)
+	}
+}
+
+func TestOptionValue(t *testing.T) {
+	if got := optionValue(&SKUOption{Value: "40", IsRange: true, RangeEndValue: strPtr("44")}); got != "40-44" {
+		t.Errorf("range = %q", got)
+	}
+	if got := optionValue(&SKUOption{Value: "40", IsRange: true}); got != "40" {
+		t.Errorf("open range = %q", got)
+	}
+}
+
+func TestYMLOffers(t *testing.T) {
+	offers := ymlOffers(testProduct(), testFeedConfig())
+	if len(offers) != 2 {
+		t.Fatalf("got %d offers, want the 2 priced SKUs", len(offers))
+	}
+
+	first := offers[0]
+	if first.ID != 70 || first.GroupID != 7 || !first.Available || first.Count != 3 || first.Price != "1299.5" ||
+		first.Barcode != "4600000000001" || first.VendorCode != "SH 01/A" || first.CurrencyID != "RUR" {
+		t.Errorf("first offer = %+v", first)
+	}
+	wantParams := []ymlParam{{"Color", "Red & Blue"}, {"Size", "40-44"}}
+	if !reflect.DeepEqual(first.Params, wantParams) {
+		t.Errorf("params = %+v, want %+v", first.Params, wantParams)
+	}
+
+	if second := offers[1]; second.ID != 72 || second.Available || second.Count != 0 || second.Params != nil {
+		t.Errorf("sold out offer = %+v", second)
+	}
+}
+
+func TestYMLOfferEscaping(t *testing.T) {
+	offer := ymlOffers(testProduct(), testFeedConfig())[0]
+
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(&offer); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		`<name>Shirt &#34;Tom &amp; Jerry&#34; &lt;kids&gt;</name>`,
+		`<param name="Color">Red &amp; Blue</param>`,
+		`<url>https://example.com/p/SH%2001%2FA?id=7</url>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("offer XML lacks %s:\n%s", want, out)
+		}
+	}
+
+	var decoded ymlOffer
+	if err := xml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	decoded.XMLName = offer.XMLName
+	if !reflect.DeepEqual(decoded, offer) {
+		t.Errorf("round trip = %+v, want %+v", decoded, offer)
+	}
+}
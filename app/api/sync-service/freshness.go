@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Freshness of the index: the products namespace carries an indexMeta under
+// the sync_freshness meta key, which product-service returns with search
+// results. Lag is measured from the oldest change that has not reached the
+// index yet, looked up in whichever source the sync mode reads.
+
+const indexMetaKey = "sync_freshness"
+
+// indexMeta is stored in the namespace meta. Version grows with every write
+// to the index; SyncedAt is the time up to which all changes are indexed.
+type indexMeta struct {
+	Version    int64      `json:"version"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	SyncedAt   *time.Time `json:"synced_at,omitempty"`
+	FullLoadAt *time.Time `json:"full_load_at,omitempty"`
+}
+
+// freshnessMeta reads the index meta for freshness reports; tests replace it
+var freshnessMeta = readIndexMeta
+
+// indexMetaMu serializes read-modify-write of the meta within the process
+var indexMetaMu sync.Mutex
+
+func readIndexMeta(namespace string) (indexMeta, error) {
+	var meta indexMeta
+
+	data, err := rx.GetMeta(namespace, indexMetaKey)
+	if err != nil {
+		return meta, fmt.Errorf("error reading index meta: %w", err)
+	}
+	if len(data) == 0 {
+		return meta, nil
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("error decoding index meta: %w", err)
+	}
+	return meta, nil
+}
+
+func updateIndexMeta(namespace string, update func(meta *indexMeta)) {
+	indexMetaMu.Lock()
+	defer indexMetaMu.Unlock()
+
+	meta, err := readIndexMeta(namespace)
+	if err != nil {
+		log.Printf("Error updating index meta: %v", err)
+		return
+	}
+
+	update(&meta)
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("Error encoding index meta: %v", err)
+		return
+	}
+	if err := rx.PutMeta(namespace, indexMetaKey, data); err != nil {
+		log.Printf("Error writing index meta: %v", err)
+	}
+}
+
+// bumpIndexVersion records that documents in the namespace changed
+func bumpIndexVersion(namespace string) {
+	now := time.Now()
+	updateIndexMeta(namespace, func(meta *indexMeta) {
+		meta.Version++
+		meta.UpdatedAt = &now
+	})
+}
+
+// markSynced records that every change made before at is indexed
+func markSynced(namespace string, at time.Time, fullLoad bool) {
+	updateIndexMeta(namespace, func(meta *indexMeta) {
+		if meta.SyncedAt == nil || at.After(*meta.SyncedAt) {
+			meta.SyncedAt = &at
+		}
+		if fullLoad {
+			meta.FullLoadAt = &at
+		}
+	})
+}
+
+// binlogPending tracks the oldest binlog change read but not yet indexed
+var binlogPending struct {
+	mu    sync.Mutex
+	since time.Time
+}
+
+func setBinlogPending(since time.Time) {
+	binlogPending.mu.Lock()
+	defer binlogPending.mu.Unlock()
+	binlogPending.since = since
+}
+
+// FreshnessInfo reports how far the index is behind MySQL
+type FreshnessInfo struct {
+	Namespace        string     `json:"namespace"`
+	SyncMode         string     `json:"sync_mode"`
+	IndexVersion     int64      `json:"index_version"`
+	LastUpdateAt     *time.Time `json:"last_update_at"`
+	LastSyncAt       *time.Time `json:"last_sync_at"`
+	LastFullLoadAt   *time.Time `json:"last_full_load_at"`
+	OldestUnsyncedAt *time.Time `json:"oldest_unsynced_at"`
+	OldestSource     string     `json:"oldest_unsynced_source,omitempty"`
+	LagSeconds       float64    `json:"lag_seconds"`
+	MaxLagSeconds    float64    `json:"max_lag_seconds"`
+	Lagging          bool       `json:"lagging"`
+}
+
+// unixTime converts a UNIX_TIMESTAMP() result; comparing in MySQL avoids
+// mixing the session and the driver time zones
+func unixTime(ts sql.NullFloat64) *time.Time {
+	if !ts.Valid {
+		return nil
+	}
+	sec, frac := math.Modf(ts.Float64)
+	t := time.Unix(int64(sec), int64(frac*1e9))
+	return &t
+}
+
+// catalogChangesQuery finds the oldest product or SKU update since the last
+// sync; with indexed set, updates already indexed by the write API are
+// skipped (sync_indexed_products is missing until migration 007 runs)
+func catalogChangesQuery(indexed bool) string {
+	productFilter, skuFilter := "", ""
+	if indexed {
+		productFilter = `AND NOT EXISTS (
+			SELECT 1 FROM sync_indexed_products i WHERE i.product_id = p.id AND i.indexed_at >= p.updated_at)`
+		skuFilter = `AND NOT EXISTS (
+			SELECT 1 FROM sync_indexed_products i WHERE i.product_id = s.product_id AND i.indexed_at >= s.updated_at)`
+	}
+	return fmt.Sprintf(`
+		SELECT UNIX_TIMESTAMP(MIN(updated_at)) FROM (
+			SELECT MIN(p.updated_at) AS updated_at FROM products p WHERE p.updated_at >= FROM_UNIXTIME(?) %s
+			UNION ALL
+			SELECT MIN(s.updated_at) FROM skus s WHERE s.updated_at >= FROM_UNIXTIME(?) %s
+		) changes`, productFilter, skuFilter)
+}
+
+// oldestUnsynced returns the oldest change not yet in the index and its source
+func oldestUnsynced(mode string, meta indexMeta) (*time.Time, string, error) {
+	var oldest *time.Time
+	var source string
+	consider := func(t *time.Time, name string) {
+		if t != nil && (oldest == nil || t.Before(*oldest)) {
+			oldest, source = t, name
+		}
+	}
+
+	var ts sql.NullFloat64
+	err := db.QueryRow("SELECT UNIX_TIMESTAMP(MIN(first_failed_at)) FROM sync_dead_letters").Scan(&ts)
+	if err != nil && !isMissingTable(err) {
+		return nil, "", fmt.Errorf("error reading dead letters: %w", err)
+	}
+	consider(unixTime(ts), "dead_letters")
+
+	switch mode {
+	case "outbox":
+		ts = sql.NullFloat64{}
+		err := db.QueryRow("SELECT UNIX_TIMESTAMP(MIN(created_at)) FROM catalog_outbox WHERE processed_at IS NULL").Scan(&ts)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading outbox: %w", err)
+		}
+		consider(unixTime(ts), "outbox")
+	case "binlog":
+		binlogPending.mu.Lock()
+		since := binlogPending.since
+		binlogPending.mu.Unlock()
+		if !since.IsZero() {
+			consider(&since, "binlog")
+		}
+	default:
+		// Without continuous sync everything updated after the last sync is
+		// pending, unless the write API reindexed the product after the update.
+		// Deletes leave no trace here and only show up after the next load.
+		if meta.SyncedAt == nil {
+			break
+		}
+		ts = sql.NullFloat64{}
+		since := meta.SyncedAt.Unix()
+		err := db.QueryRow(catalogChangesQuery(true), since, since).Scan(&ts)
+		if isMissingTable(err) {
+			err = db.QueryRow(catalogChangesQuery(false), since, since).Scan(&ts)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading catalog changes: %w", err)
+		}
+		consider(unixTime(ts), "catalog")
+	}
+
+	return oldest, source, nil
+}
+
+// getFreshness reports the freshness of the products namespace
+func getFreshness() (*FreshnessInfo, error) {
+	maxLag, err := time.ParseDuration(getEnv("SYNC_MAX_LAG", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SYNC_MAX_LAG: %w", err)
+	}
+
+	namespace := getEnv("REINDEXER_DB", "products_db")
+	mode := getEnv("SYNC_MODE", "")
+
+	meta, err := freshnessMeta(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	oldest, source, err := oldestUnsynced(mode, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &FreshnessInfo{
+		Namespace:        namespace,
+		SyncMode:         mode,
+		IndexVersion:     meta.Version,
+		LastUpdateAt:     meta.UpdatedAt,
+		LastSyncAt:       meta.SyncedAt,
+		LastFullLoadAt:   meta.FullLoadAt,
+		OldestUnsyncedAt: oldest,
+		OldestSource:     source,
+		MaxLagSeconds:    maxLag.Seconds(),
+	}
+	if info.SyncMode == "" {
+		info.SyncMode = "load"
+	}
+
+	// A namespace that was never synced is as stale as it gets
+	switch {
+	case oldest != nil:
+		info.LagSeconds = time.Since(*oldest).Seconds()
+		info.Lagging = info.LagSeconds > info.MaxLagSeconds
+	case meta.SyncedAt == nil:
+		info.Lagging = true
+	}
+
+	return info, nil
+}
+
+// freshnessHandler replies 503 when the lag exceeds SYNC_MAX_LAG, so a plain
+// HTTP probe can alert on it
+func freshnessHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := getFreshness()
+	if err != nil {
+		http.Error(w, "Error reading sync freshness", http.StatusInternalServerError)
+		log.Printf("Error reading sync freshness: %v", err)
+		return
+	}
+
+	status := http.StatusOK
+	if info.Lagging {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, info)
+}
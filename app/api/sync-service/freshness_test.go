@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestCatalogChangesQuery(t *testing.T) {
+	indexed := catalogChangesQuery(true)
+	if strings.Count(indexed, "sync_indexed_products") != 2 || strings.Count(indexed, "?") != 2 {
+		t.Errorf("query with indexed products:\n%s", indexed)
+	}
+	if plain := catalogChangesQuery(false); strings.Contains(plain, "sync_indexed_products") || strings.Count(plain, "?") != 2 {
+		t.Errorf("query without indexed products:\n%s", plain)
+	}
+}
+
+var (
+	deadLettersQuery = regexp.QuoteMeta("SELECT UNIX_TIMESTAMP(MIN(first_failed_at)) FROM sync_dead_letters")
+	outboxQuery      = regexp.QuoteMeta("SELECT UNIX_TIMESTAMP(MIN(created_at)) FROM catalog_outbox WHERE processed_at IS NULL")
+)
+
+// unixRow is a UNIX_TIMESTAMP() result; nil stands for NULL
+func unixRow(ts interface{}) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"ts"}).AddRow(ts)
+}
+
+func TestOldestUnsynced(t *testing.T) {
+	synced := time.Unix(1000, 0)
+	missingTable := &mysql.MySQLError{Number: errNoSuchTable, Message: "Table doesn't exist"}
+
+	tests := []struct {
+		name       string
+		mode       string
+		meta       indexMeta
+		expect     func(mock sqlmock.Sqlmock)
+		wantAt     int64
+		wantSource string
+	}{
+		{
+			"outbox older than dead letters", "outbox", indexMeta{},
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(deadLettersQuery).WillReturnRows(unixRow(1500.0))
+				mock.ExpectQuery(outboxQuery).WillReturnRows(unixRow(1200.5))
+			},
+			1200, "outbox",
+		},
+		{
+			"dead letters older than outbox", "outbox", indexMeta{},
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(deadLettersQuery).WillReturnRows(unixRow(1100.0))
+				mock.ExpectQuery(outboxQuery).WillReturnRows(unixRow(nil))
+			},
+			1100, "dead_letters",
+		},
+		{
+			"binlog", "binlog", indexMeta{},
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(deadLettersQuery).WillReturnError(missingTable)
+				setBinlogPending(time.Unix(1300, 0))
+			},
+			1300, "binlog",
+		},
+		{
+			"load never synced", "", indexMeta{},
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(deadLettersQuery).WillReturnRows(unixRow(nil))
+			},
+			0, "",
+		},
+		{
+			"load before migration 007", "", indexMeta{SyncedAt: &synced},
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(deadLettersQuery).WillReturnRows(unixRow(nil))
+				mock.ExpectQuery(`sync_indexed_products`).WithArgs(1000, 1000).WillReturnError(missingTable)
+				mock.ExpectQuery(`SELECT UNIX_TIMESTAMP\(MIN\(updated_at\)\)`).WithArgs(1000, 1000).WillReturnRows(unixRow(1400.0))
+			},
+			1400, "catalog",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			tt.expect(mock)
+			t.Cleanup(func() { setBinlogPending(time.Time{}) })
+
+			oldest, source, err := oldestUnsynced(tt.mode, tt.meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantSource == "" {
+				if oldest != nil {
+					t.Errorf("oldest = %v from %s, want nothing pending", oldest, source)
+				}
+				return
+			}
+			if oldest == nil || oldest.Unix() != tt.wantAt || source != tt.wantSource {
+				t.Errorf("oldest = %v from %q, want %d from %q", oldest, source, tt.wantAt, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestFreshnessHandler(t *testing.T) {
+	t.Setenv("SYNC_MODE", "outbox")
+	t.Setenv("SYNC_MAX_LAG", "1m")
+
+	synced := time.Now().Add(-time.Hour)
+	previous := freshnessMeta
+	freshnessMeta = func(namespace string) (indexMeta, error) {
+		return indexMeta{Version: 3, SyncedAt: &synced}, nil
+	}
+	t.Cleanup(func() { freshnessMeta = previous })
+
+	for _, tt := range []struct {
+		name    string
+		pending time.Duration
+		want    int
+	}{
+		{"within the threshold", 10 * time.Second, http.StatusOK},
+		{"above the threshold", 10 * time.Minute, http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectQuery(deadLettersQuery).WillReturnRows(unixRow(nil))
+			mock.ExpectQuery(outboxQuery).WillReturnRows(unixRow(float64(time.Now().Add(-tt.pending).Unix())))
+
+			w := httptest.NewRecorder()
+			freshnessHandler(w, httptest.NewRequest(http.MethodGet, "/freshness", nil))
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			var info FreshnessInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+				t.Fatal(err)
+			}
+			if info.OldestSource != "outbox" || info.Lagging != (tt.want != http.StatusOK) || info.MaxLagSeconds != 60 {
+				t.Errorf("unexpected freshness %+v", info)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/restream/reindexer/v5"
+)
+
+// Every document carries a hash of its content. Writes look up the stored
+// hashes first and skip documents that did not change, so repeated syncs do
+// not rewrite the index.
+
+// WriteStats counts what happened to the documents of a sync
+type WriteStats struct {
+	New     int `json:"new"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Removed int `json:"removed"`
+}
+
+func (s *WriteStats) add(other WriteStats) {
+	s.New += other.New
+	s.Updated += other.Updated
+	s.Skipped += other.Skipped
+	s.Removed += other.Removed
+}
+
+// total is the number of documents the sync looked at
+func (s WriteStats) total() int {
+	return s.New + s.Updated + s.Skipped + s.Removed
+}
+
+// documentHash returns a stable hash of the document content. Slices must be
+// sorted, which assembleProductIDs guarantees.
+func documentHash(doc *ReindexerProduct) (string, error) {
+	content := *doc
+	content.ContentHash = ""
+
+	data, err := json.Marshal(&content)
+	if err != nil {
+		return "", fmt.Errorf("error encoding product %d: %w", doc.ProductID, err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// storedHashes returns the content hashes of the given products in the index
+func storedHashes(namespace string, ids []int64) (map[int64]string, error) {
+	hashes := make(map[int64]string, len(ids))
+	if len(ids) == 0 {
+		return hashes, nil
+	}
+
+	iterator := rx.Query(namespace).
+		Select("product_id", "content_hash").
+		WhereInt64("product_id", reindexer.SET, ids...).
+		Exec()
+	defer iterator.Close()
+
+	for iterator.Next() {
+		doc := iterator.Object().(*ReindexerProduct)
+		hashes[doc.ProductID] = doc.ContentHash
+	}
+
+	if err := iterator.Error(); err != nil {
+		return nil, fmt.Errorf("error reading content hashes: %w", err)
+	}
+	return hashes, nil
+}
+
+// writeBatch upserts the products whose content changed in a single
+// transaction, so a batch is either applied completely or not at all
+func writeBatch(namespace string, products []ProductIDs) (WriteStats, error) {
+	var stats WriteStats
+	if len(products) == 0 {
+		return stats, nil
+	}
+
+	ids := make([]int64, len(products))
+	for i, productIDs := range products {
+		ids[i] = productIDs.ProductID
+	}
+
+	stored, err := storedHashes(namespace, ids)
+	if err != nil {
+		return stats, err
+	}
+
+	var changed []*ReindexerProduct
+	for _, productIDs := range products {
+		doc := productIDs.toReindexerProduct()
+		if doc.ContentHash, err = documentHash(doc); err != nil {
+			return stats, err
+		}
+
+		hash, exists := stored[doc.ProductID]
+		switch {
+		case !exists:
+			stats.New++
+		case hash != doc.ContentHash:
+			stats.Updated++
+		default:
+			stats.Skipped++
+			continue
+		}
+		changed = append(changed, doc)
+	}
+
+	if err := upsertBatch(namespace, changed); err != nil {
+		return WriteStats{}, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bulk catalog import. Every row describes a product, matched by article, and
+// optionally one of its SKUs, matched by barcode, with the SKU's option values.
+// Missing options and values are created. Rows are written in MySQL
+// transactions of -batch rows; a dry run writes everything in one transaction
+// and rolls it back, so the report shows exactly what would change.
+//
+// CSV files have a header row: article, name, barcode, count and one
+// "option:<name>" column per option. JSONL rows look like
+// {"article": "A1", "name": "Shirt", "barcode": "460...", "count": 5, "options": {"color": "Red"}}.
+
+// importRow is one input row
+type importRow struct {
+	Line    int               `json:"-"`
+	Article string            `json:"article"`
+	Name    string            `json:"name"`
+	Barcode string            `json:"barcode"`
+	Count   *int              `json:"count"`
+	Options map[string]string `json:"options"`
+}
+
+func (r *importRow) validate() error {
+	r.Article = strings.TrimSpace(r.Article)
+	r.Name = strings.TrimSpace(r.Name)
+	r.Barcode = strings.TrimSpace(r.Barcode)
+
+	if r.Article == "" {
+		return errors.New("article is required")
+	}
+	if r.Count != nil && *r.Count < 0 {
+		return errors.New("count must not be negative")
+	}
+	if r.Barcode == "" && (r.Count != nil || len(r.Options) > 0) {
+		return errors.New("barcode is required for SKU count and options")
+	}
+	return nil
+}
+
+// importRowReader yields rows until io.EOF. Errors of a single row are
+// returned as *importRowError so reading can go on.
+type importRowReader interface {
+	next() (*importRow, error)
+}
+
+type importRowError struct {
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *importRowError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+type csvRowReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	options map[string]int
+	line    int
+}
+
+func newCSVRowReader(r io.Reader) (*csvRowReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+
+	c := &csvRowReader{reader: reader, columns: make(map[string]int), options: make(map[string]int), line: 1}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if option, ok := strings.CutPrefix(name, "option:"); ok {
+			c.options[strings.TrimSpace(option)] = i
+			continue
+		}
+		c.columns[strings.ToLower(name)] = i
+	}
+
+	if _, ok := c.columns["article"]; !ok {
+		return nil, errors.New("CSV header has no article column")
+	}
+	return c, nil
+}
+
+func (c *csvRowReader) next() (*importRow, error) {
+	record, err := c.reader.Read()
+	c.line++
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &importRowError{Line: parseErr.Line, Message: parseErr.Err.Error()}
+		}
+		return nil, err
+	}
+
+	field := func(i int, ok bool) string {
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	column := func(name string) string {
+		i, ok := c.columns[name]
+		return field(i, ok)
+	}
+
+	row := &importRow{
+		Line:    c.line,
+		Article: column("article"),
+		Name:    column("name"),
+		Barcode: column("barcode"),
+	}
+
+	// Without option columns the options of existing SKUs are left alone
+	if len(c.options) > 0 {
+		row.Options = make(map[string]string)
+	}
+
+	if s := column("count"); s != "" {
+		count, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, &importRowError{Line: c.line, Message: fmt.Sprintf("invalid count %q", s)}
+		}
+		row.Count = &count
+	}
+
+	for option, i := range c.options {
+		if value := field(i, true); value != "" {
+			row.Options[option] = value
+		}
+	}
+	return row, nil
+}
+
+type jsonlRowReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func (j *jsonlRowReader) next() (*importRow, error) {
+	for {
+		data, err := j.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(data) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		j.line++
+
+		// Blank lines are allowed
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		row := &importRow{Line: j.line}
+		if err := json.Unmarshal(data, row); err != nil {
+			return nil, &importRowError{Line: j.line, Message: err.Error()}
+		}
+		return row, nil
+	}
+}
+
+// importReport summarizes an import
+type importReport struct {
+	DryRun          bool              `json:"dry_run"`
+	Rows            int               `json:"rows"`
+	ProductsCreated int               `json:"products_created"`
+	ProductsUpdated int               `json:"products_updated"`
+	ProductsDeleted int               `json:"products_deleted,omitempty"`
+	SKUsCreated     int               `json:"skus_created"`
+	SKUsUpdated     int               `json:"skus_updated"`
+	OptionsCreated  int               `json:"options_created"`
+	ValuesCreated   int               `json:"values_created"`
+	Errors          []*importRowError `json:"errors"`
+	ProductIDs      []int64           `json:"-"`
+}
+
+// catalogTx writes catalog rows inside a MySQL transaction. Option and value
+// IDs are cached for the lifetime of the writer, so it must not outlive a
+// rolled back transaction that created them. Every row runs under a
+// savepoint; a failed row is rolled back to it together with what it added
+// to the caches and the report.
+type catalogTx struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	report  *importReport
+	options map[string]int64
+	values  map[int64]map[string]int64
+	// touched holds the products changed in the open transaction
+	touched map[int64]bool
+
+	// saved and undo restore the state from before the current row
+	saved importReport
+	undo  []func()
+}
+
+func newCatalogTx(ctx context.Context, report *importReport) *catalogTx {
+	return &catalogTx{
+		ctx:     ctx,
+		report:  report,
+		options: make(map[string]int64),
+		values:  make(map[int64]map[string]int64),
+		touched: make(map[int64]bool),
+	}
+}
+
+func (c *catalogTx) begin() error {
+	tx, err := db.BeginTx(c.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	c.tx = tx
+	return nil
+}
+
+// commit commits the transaction; its products are added to the report
+// for reindexing
+func (c *catalogTx) commit() error {
+	if err := c.tx.Commit(); err != nil {
+		return fmt.Errorf("error committing batch: %w", err)
+	}
+	for id := range c.touched {
+		c.report.ProductIDs = append(c.report.ProductIDs, id)
+	}
+	c.touched = make(map[int64]bool)
+	return nil
+}
+
+// beginRow sets the savepoint of the next row
+func (c *catalogTx) beginRow() error {
+	if _, err := c.tx.ExecContext(c.ctx, "SAVEPOINT catalog_row"); err != nil {
+		return fmt.Errorf("error setting savepoint: %w", err)
+	}
+	c.saved = *c.report
+	c.undo = c.undo[:0]
+	return nil
+}
+
+// rollbackRow undoes the writes of the current row
+func (c *catalogTx) rollbackRow() error {
+	if _, err := c.tx.ExecContext(c.ctx, "ROLLBACK TO SAVEPOINT catalog_row"); err != nil {
+		return fmt.Errorf("error rolling back to savepoint: %w", err)
+	}
+	for i := len(c.undo) - 1; i >= 0; i-- {
+		c.undo[i]()
+	}
+	c.undo = c.undo[:0]
+
+	// Rows, errors and committed products are tracked outside the row
+	rows, errs, ids := c.report.Rows, c.report.Errors, c.report.ProductIDs
+	*c.report = c.saved
+	c.report.Rows, c.report.Errors, c.report.ProductIDs = rows, errs, ids
+	return nil
+}
+
+// touch marks a product for reindexing
+func (c *catalogTx) touch(productID int64) {
+	if c.touched[productID] {
+		return
+	}
+	c.touched[productID] = true
+	c.undo = append(c.undo, func() { delete(c.touched, productID) })
+}
+
+// upsertProduct finds the product by article, creating it or updating its name
+func (c *catalogTx) upsertProduct(article, name string) (int64, error) {
+	var id int64
+	var current string
+	err := c.tx.QueryRowContext(c.ctx,
+		"SELECT id, name FROM products WHERE article = ? ORDER BY id LIMIT 1 FOR UPDATE", article).Scan(&id, &current)
+
+	switch {
+	case err == sql.ErrNoRows:
+		if name == "" {
+			return 0, &importRowError{Message: fmt.Sprintf("name is required for new product %q", article)}
+		}
+		result, err := c.tx.ExecContext(c.ctx, "INSERT INTO products (name, article) VALUES (?, ?)", name, article)
+		if err != nil {
+			return 0, fmt.Errorf("error creating product %q: %w", article, err)
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return 0, err
+		}
+		c.report.ProductsCreated++
+		c.touch(id)
+	case err != nil:
+		return 0, fmt.Errorf("error looking up product %q: %w", article, err)
+	case name != "" && name != current:
+		if _, err := c.tx.ExecContext(c.ctx, "UPDATE products SET name = ? WHERE id = ?", name, id); err != nil {
+			return 0, fmt.Errorf("error updating product %q: %w", article, err)
+		}
+		c.report.ProductsUpdated++
+		c.touch(id)
+	}
+
+	return id, nil
+}
+
+// upsertSKU finds the SKU by barcode, creating it or updating its count.
+// A nil count leaves the stock of an existing SKU alone; a SKU with warehouse
+// quantities refuses a different count.
+func (c *catalogTx) upsertSKU(productID int64, barcode string, count *int) (int64, bool, error) {
+	var id, owner int64
+	var current int
+	err := c.tx.QueryRowContext(c.ctx,
+		"SELECT id, product_id, count FROM skus WHERE barcode = ? ORDER BY id LIMIT 1 FOR UPDATE", barcode).Scan(&id, &owner, &current)
+
+	switch {
+	case err == sql.ErrNoRows:
+		initial := 0
+		if count != nil {
+			initial = *count
+		}
+		result, err := c.tx.ExecContext(c.ctx,
+			"INSERT INTO skus (product_id, count, barcode) VALUES (?, ?, ?)", productID, initial, barcode)
+		if err != nil {
+			return 0, false, fmt.Errorf("error creating SKU %q: %w", barcode, err)
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return 0, false, err
+		}
+		c.report.SKUsCreated++
+		c.touch(productID)
+		return id, true, nil
+	case err != nil:
+		return 0, false, fmt.Errorf("error looking up SKU %q: %w", barcode, err)
+	case owner != productID:
+		return 0, false, &importRowError{Message: fmt.Sprintf("barcode %q belongs to product %d", barcode, owner)}
+	}
+
+	changed := false
+	if count != nil && *count != current {
+		// skus.count is derived once the SKU has warehouse quantities
+		perWarehouse, err := hasWarehouseStock(c.ctx, c.tx, id)
+		if err != nil {
+			return 0, false, fmt.Errorf("error reading warehouse stock of SKU %q: %w", barcode, err)
+		}
+		if perWarehouse {
+			return 0, false, &importRowError{Message: fmt.Sprintf("SKU %q keeps stock per warehouse, count cannot be imported", barcode)}
+		}
+		if _, err := c.tx.ExecContext(c.ctx, "UPDATE skus SET count = ? WHERE id = ?", *count, id); err != nil {
+			return 0, false, fmt.Errorf("error updating SKU %q: %w", barcode, err)
+		}
+		changed = true
+	}
+	return id, changed, nil
+}
+
+// optionID returns the ID of the option, creating it if needed
+func (c *catalogTx) optionID(name, displayName string) (int64, error) {
+	if id, ok := c.options[name]; ok {
+		return id, nil
+	}
+
+	var id int64
+	err := c.tx.QueryRowContext(c.ctx, "SELECT id FROM options WHERE name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		if displayName == "" {
+			displayName = name
+		}
+		result, err := c.tx.ExecContext(c.ctx, "INSERT INTO options (name, display_name) VALUES (?, ?)", name, displayName)
+		if err != nil {
+			return 0, fmt.Errorf("error creating option %q: %w", name, err)
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return 0, err
+		}
+		c.report.OptionsCreated++
+	} else if err != nil {
+		return 0, fmt.Errorf("error looking up option %q: %w", name, err)
+	}
+
+	c.options[name] = id
+	c.undo = append(c.undo, func() { delete(c.options, name) })
+	return id, nil
+}
+
+// optionValueID returns the ID of the option value, creating it if needed.
+// Numeric values also get numeric_value for range filters.
+func (c *catalogTx) optionValueID(optionID int64, value string) (int64, error) {
+	if id, ok := c.values[optionID][value]; ok {
+		return id, nil
+	}
+
+	var id int64
+	err := c.tx.QueryRowContext(c.ctx,
+		"SELECT id FROM option_values WHERE option_id = ? AND value = ? ORDER BY id LIMIT 1", optionID, value).Scan(&id)
+	if err == sql.ErrNoRows {
+		var numeric interface{}
+		if n, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64); err == nil {
+			numeric = n
+		}
+		result, err := c.tx.ExecContext(c.ctx,
+			"INSERT INTO option_values (option_id, value, numeric_value) VALUES (?, ?, ?)", optionID, value, numeric)
+		if err != nil {
+			return 0, fmt.Errorf("error creating value %q: %w", value, err)
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return 0, err
+		}
+		c.report.ValuesCreated++
+	} else if err != nil {
+		return 0, fmt.Errorf("error looking up value %q: %w", value, err)
+	}
+
+	if c.values[optionID] == nil {
+		c.values[optionID] = make(map[string]int64)
+	}
+	c.values[optionID][value] = id
+	c.undo = append(c.undo, func() { delete(c.values[optionID], value) })
+	return id, nil
+}
+
+// setSKUOptions replaces the option values of a SKU and reports whether
+// anything changed
+func (c *catalogTx) setSKUOptions(skuID int64, options map[string]string) (bool, error) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var valueIDs []int64
+	for _, name := range names {
+		optionID, err := c.optionID(name, "")
+		if err != nil {
+			return false, err
+		}
+		valueID, err := c.optionValueID(optionID, options[name])
+		if err != nil {
+			return false, err
+		}
+		valueIDs = append(valueIDs, valueID)
+	}
+
+	query := "DELETE FROM sku_options WHERE sku_id = ?"
+	args := []interface{}{skuID}
+	if len(valueIDs) > 0 {
+		placeholders, valueArgs := inPlaceholders(valueIDs)
+		query += fmt.Sprintf(" AND option_value_id NOT IN (%s)", placeholders)
+		args = append(args, valueArgs...)
+	}
+	result, err := c.tx.ExecContext(c.ctx, query, args...)
+	if err != nil {
+		return false, fmt.Errorf("error removing SKU options: %w", err)
+	}
+	removed, _ := result.RowsAffected()
+
+	var added int64
+	for _, valueID := range valueIDs {
+		result, err := c.tx.ExecContext(c.ctx,
+			"INSERT IGNORE INTO sku_options (sku_id, option_value_id) VALUES (?, ?)", skuID, valueID)
+		if err != nil {
+			return false, fmt.Errorf("error adding SKU option: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		added += n
+	}
+
+	return removed+added > 0, nil
+}
+
+// writeRow applies one row. Row-level problems are returned as *importRowError.
+func (c *catalogTx) writeRow(row *importRow) error {
+	productID, err := c.upsertProduct(row.Article, row.Name)
+	if err != nil {
+		return err
+	}
+	if row.Barcode == "" {
+		return nil
+	}
+
+	skuID, created, err := c.upsertSKU(productID, row.Barcode, row.Count)
+	if err != nil {
+		return err
+	}
+
+	changed := created
+	if row.Options != nil {
+		optionsChanged, err := c.setSKUOptions(skuID, row.Options)
+		if err != nil {
+			return err
+		}
+		changed = changed || optionsChanged
+	}
+
+	if changed {
+		c.touch(productID)
+		if !created {
+			c.report.SKUsUpdated++
+		}
+	}
+	return nil
+}
+
+// importCatalog reads all rows and writes them in batches. Only database
+// errors abort the import; committed batches stay committed and the report
+// returned with the error lists their products.
+func importCatalog(ctx context.Context, reader importRowReader, batchSize int, dryRun bool) (*importReport, error) {
+	report := &importReport{DryRun: dryRun, Errors: []*importRowError{}}
+	writer := newCatalogTx(ctx, report)
+	if err := writer.begin(); err != nil {
+		return report, err
+	}
+	defer func() { writer.tx.Rollback() }()
+
+	inBatch := 0
+	for {
+		row, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+
+		var rowErr *importRowError
+		if errors.As(err, &rowErr) {
+			report.Errors = append(report.Errors, rowErr)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		report.Rows++
+		if err := row.validate(); err != nil {
+			report.Errors = append(report.Errors, &importRowError{Line: row.Line, Message: err.Error()})
+			continue
+		}
+
+		if err := writer.beginRow(); err != nil {
+			return report, err
+		}
+		if err := writer.writeRow(row); err != nil {
+			if !errors.As(err, &rowErr) {
+				return report, fmt.Errorf("line %d: %w", row.Line, err)
+			}
+			if err := writer.rollbackRow(); err != nil {
+				return report, err
+			}
+			rowErr.Line = row.Line
+			report.Errors = append(report.Errors, rowErr)
+			continue
+		}
+
+		inBatch++
+		if !dryRun && inBatch >= batchSize {
+			if err := writer.commit(); err != nil {
+				return report, err
+			}
+			if err := writer.begin(); err != nil {
+				return report, err
+			}
+			inBatch = 0
+		}
+	}
+
+	if dryRun {
+		// Nothing is reindexed, but the report still lists what would be
+		for id := range writer.touched {
+			report.ProductIDs = append(report.ProductIDs, id)
+		}
+		return report, nil
+	}
+	if err := writer.commit(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// runImport implements the import CLI command
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "input format: csv or jsonl (default: from the file extension)")
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing")
+	batchSize := flags.Int("batch", 500, "rows per transaction")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [-format csv|jsonl] [-dry-run] [-batch N] FILE (- for stdin)")
+	}
+	if *batchSize <= 0 {
+		return errors.New("-batch must be positive")
+	}
+
+	path := flags.Arg(0)
+	input := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	var reader importRowReader
+	switch *format {
+	case "csv":
+		csvReader, err := newCSVRowReader(input)
+		if err != nil {
+			return err
+		}
+		reader = csvReader
+	case "jsonl", "ndjson":
+		reader = &jsonlRowReader{reader: bufio.NewReader(input)}
+	default:
+		return fmt.Errorf("unknown format %q, use -format csv or -format jsonl", *format)
+	}
+
+	ctx := context.Background()
+	report, err := importCatalog(ctx, reader, *batchSize, *dryRun)
+	if err != nil {
+		// Batches committed before the error still have to reach the index
+		if !*dryRun && len(report.ProductIDs) > 0 {
+			log.Printf("Reindexing %d products of committed batches", len(report.ProductIDs))
+			reindexCommitted(ctx, report.ProductIDs)
+		}
+		return err
+	}
+
+	if *dryRun {
+		fmt.Println("Dry run, nothing was written")
+	}
+	fmt.Printf("Rows: %d\n", report.Rows)
+	fmt.Printf("Products: %d created, %d updated\n", report.ProductsCreated, report.ProductsUpdated)
+	fmt.Printf("SKUs: %d created, %d updated\n", report.SKUsCreated, report.SKUsUpdated)
+	fmt.Printf("Options: %d created, values: %d created\n", report.OptionsCreated, report.ValuesCreated)
+	fmt.Printf("Errors: %d\n", len(report.Errors))
+	for _, rowErr := range report.Errors {
+		fmt.Printf("  %v\n", rowErr)
+	}
+
+	if *dryRun || len(report.ProductIDs) == 0 {
+		return nil
+	}
+
+	log.Printf("Reindexing %d imported products", len(report.ProductIDs))
+	if err := reindexCommitted(ctx, report.ProductIDs); err != nil {
+		return fmt.Errorf("import succeeded but reindex failed: %w", err)
+	}
+	return nil
+}
+
+// reindexCommitted reindexes products written by an import. Products that
+// fail to be written are dead-lettered by reindexProducts; when the reindex
+// fails as a whole, all of them are, so the retry picks them up. Either way
+// the failure is reported.
+func reindexCommitted(ctx context.Context, ids []int64) error {
+	result, err := reindexProducts(ctx, ids)
+	if err != nil {
+		logDeadLetterError(recordDeadLetters(ids, err))
+		return err
+	}
+	return result.failure()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readRows drains a reader, collecting rows and row errors
+func readRows(t *testing.T, reader importRowReader) ([]*importRow, []*importRowError) {
+	t.Helper()
+	var rows []*importRow
+	var rowErrs []*importRowError
+	for {
+		row, err := reader.next()
+		if err == io.EOF {
+			return rows, rowErrs
+		}
+		var rowErr *importRowError
+		if errors.As(err, &rowErr) {
+			rowErrs = append(rowErrs, rowErr)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func intPtr(n int) *int { return &n }
+
+func TestCSVRowReader(t *testing.T) {
+	input := "\ufeffArticle, Name ,barcode,count,option:color,option: size\n" +
+		"A1,Shirt,4600000000001,5,Red,M\n" +
+		"A1,,4600000000002,,Blue,\n" +
+		"A2,\"Trousers, blue\"\n" +
+		"A3,Hat,4600000000003,many,,\n"
+
+	reader, err := newCSVRowReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, rowErrs := readRows(t, reader)
+
+	want := []*importRow{
+		{Line: 2, Article: "A1", Name: "Shirt", Barcode: "4600000000001", Count: intPtr(5),
+			Options: map[string]string{"color": "Red", "size": "M"}},
+		{Line: 3, Article: "A1", Barcode: "4600000000002", Options: map[string]string{"color": "Blue"}},
+		{Line: 4, Article: "A2", Name: "Trousers, blue", Options: map[string]string{}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		for i, row := range rows {
+			t.Logf("row %d: %+v", i, *row)
+		}
+		t.Errorf("rows do not match")
+	}
+
+	if len(rowErrs) != 1 || rowErrs[0].Line != 5 || !strings.Contains(rowErrs[0].Message, `invalid count "many"`) {
+		t.Errorf("row errors = %v, want invalid count on line 5", rowErrs)
+	}
+}
+
+func TestCSVRowReaderWithoutOptionColumns(t *testing.T) {
+	reader, err := newCSVRowReader(strings.NewReader("article,barcode\nA1,4600000000001\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := readRows(t, reader)
+	// nil options leave the options of an existing SKU alone
+	if len(rows) != 1 || rows[0].Options != nil {
+		t.Errorf("rows = %+v, want one row without options", rows)
+	}
+}
+
+func TestCSVRowReaderErrors(t *testing.T) {
+	if _, err := newCSVRowReader(strings.NewReader("name,barcode\n")); err == nil {
+		t.Error("expected an error for a header without article")
+	}
+	if _, err := newCSVRowReader(strings.NewReader("")); err == nil {
+		t.Error("expected an error for an empty file")
+	}
+
+	reader, err := newCSVRowReader(strings.NewReader("article,name\nA1,\"broken\nA2,Fine\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rowErrs := readRows(t, reader)
+	if len(rowErrs) == 0 {
+		t.Error("expected a parse error for the unterminated quote")
+	}
+}
+
+func TestJSONLRowReader(t *testing.T) {
+	input := `{"article": "A1", "name": "Shirt", "barcode": "4600000000001", "count": 5, "options": {"color": "Red"}}
+
+{"article": "A2", "count": "five"}
+  {"article": "A3"}  `
+
+	rows, rowErrs := readRows(t, &jsonlRowReader{reader: bufio.NewReader(strings.NewReader(input))})
+
+	want := []*importRow{
+		{Line: 1, Article: "A1", Name: "Shirt", Barcode: "4600000000001", Count: intPtr(5),
+			Options: map[string]string{"color": "Red"}},
+		{Line: 4, Article: "A3"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		for i, row := range rows {
+			t.Logf("row %d: %+v", i, *row)
+		}
+		t.Errorf("rows do not match")
+	}
+	if len(rowErrs) != 1 || rowErrs[0].Line != 3 {
+		t.Errorf("row errors = %v, want one on line 3", rowErrs)
+	}
+}
+
+func TestImportRowValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		row     importRow
+		wantErr string
+	}{
+		{"product only", importRow{Article: " A1 ", Name: "Shirt"}, ""},
+		{"SKU", importRow{Article: "A1", Barcode: "1", Count: intPtr(0)}, ""},
+		{"missing article", importRow{Article: "  ", Name: "Shirt"}, "article is required"},
+		{"negative count", importRow{Article: "A1", Barcode: "1", Count: intPtr(-1)}, "count must not be negative"},
+		{"count without barcode", importRow{Article: "A1", Count: intPtr(1)}, "barcode is required"},
+		{"options without barcode", importRow{Article: "A1", Options: map[string]string{"color": "Red"}}, "barcode is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.row.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	row := importRow{Article: " A1 ", Name: " Shirt ", Barcode: " 1 "}
+	if err := row.validate(); err != nil || row.Article != "A1" || row.Name != "Shirt" || row.Barcode != "1" {
+		t.Errorf("validate did not trim: %+v, %v", row, err)
+	}
+}
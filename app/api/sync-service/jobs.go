@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// maxJobErrors limits how many error messages a job keeps; ErrorCount keeps counting
+const maxJobErrors = 100
+
+// JobPhase is one step of a job, e.g. preparing the namespace or loading products
+type JobPhase struct {
+	Name       string     `json:"name"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobInfo is a point-in-time copy of a job, safe to encode
+type JobInfo struct {
+	ID            string     `json:"id"`
+	Kind          string     `json:"kind"`
+	Trigger       string     `json:"trigger"`
+	Status        JobStatus  `json:"status"`
+	Phases        []JobPhase `json:"phases"`
+	RowsProcessed int64      `json:"rows_processed"`
+	Documents     WriteStats `json:"documents"`
+	ErrorCount    int        `json:"error_count"`
+	Errors        []string   `json:"errors"`
+	Error         string     `json:"error,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	DurationMs    int64      `json:"duration_ms"`
+}
+
+// Job is a tracked background operation such as a full load
+type Job struct {
+	mu         sync.Mutex
+	state      JobInfo
+	cancelFunc context.CancelFunc
+	// cancelled records a cancel that arrived before the job got its context
+	cancelled bool
+	finished  chan struct{}
+}
+
+// jobRegistry keeps running jobs and the history of finished ones
+type jobRegistry struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string
+	limit int
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*Job)}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newJob creates a job that is not registered yet; trigger says who started
+// it (http, cli, binlog, ...)
+func newJob(kind, trigger string) *Job {
+	return &Job{
+		state: JobInfo{
+			ID:        newJobID(),
+			Kind:      kind,
+			Trigger:   trigger,
+			Status:    JobRunning,
+			Phases:    []JobPhase{},
+			Errors:    []string{},
+			StartedAt: time.Now(),
+		},
+		finished: make(chan struct{}),
+	}
+}
+
+// create registers a new job
+func (r *jobRegistry) create(kind, trigger string) *Job {
+	job := newJob(kind, trigger)
+	r.add(job)
+	return job
+}
+
+// add registers a job created by newJob
+func (r *jobRegistry) add(job *Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.limit == 0 {
+		r.limit, _ = strconv.Atoi(getEnv("JOB_HISTORY", "50"))
+		if r.limit <= 0 {
+			r.limit = 50
+		}
+	}
+
+	r.jobs[job.state.ID] = job
+	r.order = append(r.order, job.state.ID)
+
+	// Forget the oldest finished jobs
+	for len(r.order) > r.limit {
+		oldest := r.jobs[r.order[0]]
+		if oldest.info().Status == JobRunning {
+			break
+		}
+		delete(r.jobs, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+func (r *jobRegistry) get(id string) (*Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+// list returns all known jobs, newest first
+func (r *jobRegistry) list() []JobInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]JobInfo, 0, len(r.order))
+	for i := len(r.order) - 1; i >= 0; i-- {
+		result = append(result, r.jobs[r.order[i]].info())
+	}
+	return result
+}
+
+// run executes fn and records the outcome. The context passed to fn is
+// cancelled by cancel, also when cancel was called before run.
+func (j *Job) run(ctx context.Context, fn func(ctx context.Context, job *Job) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	j.mu.Lock()
+	j.cancelFunc = cancel
+	if j.cancelled {
+		cancel()
+	}
+	j.mu.Unlock()
+
+	err := fn(ctx, j)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer close(j.finished)
+
+	now := time.Now()
+	j.finishPhase(now)
+	j.state.FinishedAt = &now
+	j.state.DurationMs = now.Sub(j.state.StartedAt).Milliseconds()
+
+	switch {
+	case err == nil:
+		j.state.Status = JobSucceeded
+	case errors.Is(err, context.Canceled):
+		j.state.Status = JobCancelled
+		j.state.Error = err.Error()
+	default:
+		j.state.Status = JobFailed
+		j.state.Error = err.Error()
+	}
+
+	log.Printf("Job %s (%s) %s after %s", j.state.ID, j.state.Kind, j.state.Status, now.Sub(j.state.StartedAt).Round(time.Millisecond))
+	return err
+}
+
+// start runs the job in the background. The context exists before the
+// goroutine does, so a cancel right after start is not lost.
+func (j *Job) start(fn func(ctx context.Context, job *Job) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.mu.Lock()
+	j.cancelFunc = cancel
+	j.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		j.run(ctx, fn)
+	}()
+}
+
+// cancel asks a running job to stop
+func (j *Job) cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancelled = true
+	if j.cancelFunc != nil {
+		j.cancelFunc()
+	}
+}
+
+// done is closed when the job finishes
+func (j *Job) done() <-chan struct{} {
+	return j.finished
+}
+
+func (j *Job) id() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state.ID
+}
+
+// info returns a copy of the job state
+func (j *Job) info() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info := j.state
+	info.Phases = append([]JobPhase{}, j.state.Phases...)
+	info.Errors = append([]string{}, j.state.Errors...)
+	if info.FinishedAt == nil {
+		info.DurationMs = time.Since(info.StartedAt).Milliseconds()
+	}
+	return info
+}
+
+func (j *Job) finishPhase(now time.Time) {
+	if n := len(j.state.Phases); n > 0 && j.state.Phases[n-1].FinishedAt == nil {
+		j.state.Phases[n-1].FinishedAt = &now
+	}
+}
+
+// phase closes the current phase and starts a new one
+func (j *Job) phase(name string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	j.finishPhase(now)
+	j.state.Phases = append(j.state.Phases, JobPhase{Name: name, StartedAt: now})
+}
+
+// addRows counts processed rows
+func (j *Job) addRows(n int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state.RowsProcessed += int64(n)
+}
+
+// addDocuments counts new, updated, skipped and removed documents
+func (j *Job) addDocuments(stats WriteStats) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state.Documents.add(stats)
+}
+
+// addError records a non-fatal error
+func (j *Job) addError(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.state.ErrorCount++
+	if len(j.state.Errors) < maxJobErrors {
+		j.state.Errors = append(j.state.Errors, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+func loadJobsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jobs.list())
+}
+
+func loadJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.info())
+}
+
+func cancelLoadJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	job.cancel()
+	writeJSON(w, http.StatusAccepted, job.info())
+}
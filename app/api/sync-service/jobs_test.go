@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForCancel is a job body that only ends when its context is cancelled
+func waitForCancel(ctx context.Context, job *Job) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		return errors.New("not cancelled")
+	}
+}
+
+func TestJobCancelRightAfterStart(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		job := newJob("load", "test")
+		job.start(waitForCancel)
+		job.cancel()
+		<-job.done()
+		if status := job.info().Status; status != JobCancelled {
+			t.Fatalf("run %d: status %s, want %s", i, status, JobCancelled)
+		}
+	}
+}
+
+func TestJobCancelBeforeRun(t *testing.T) {
+	job := newJob("load", "test")
+	job.cancel()
+	if err := job.run(context.Background(), waitForCancel); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if status := job.info().Status; status != JobCancelled {
+		t.Errorf("status %s, want %s", status, JobCancelled)
+	}
+}
+
+func TestJobOutcome(t *testing.T) {
+	tests := []struct {
+		err    error
+		status JobStatus
+	}{
+		{nil, JobSucceeded},
+		{errors.New("boom"), JobFailed},
+		{context.Canceled, JobCancelled},
+	}
+	for _, tt := range tests {
+		job := newJob("load", "test")
+		job.run(context.Background(), func(ctx context.Context, job *Job) error {
+			job.phase("load")
+			job.addRows(3)
+			job.addError(errors.New("row failed"))
+			return tt.err
+		})
+
+		info := job.info()
+		if info.Status != tt.status {
+			t.Errorf("err %v: status %s, want %s", tt.err, info.Status, tt.status)
+		}
+		if info.RowsProcessed != 3 || info.ErrorCount != 1 || info.FinishedAt == nil || info.Phases[0].FinishedAt == nil {
+			t.Errorf("err %v: unexpected state %+v", tt.err, info)
+		}
+	}
+}
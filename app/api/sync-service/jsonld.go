@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// GET /products/{id}/jsonld renders schema.org structured data for the
+// product page: a Product for a single SKU, a ProductGroup with hasVariant
+// otherwise. URLs and prices follow the feed settings (FEED_PRODUCT_URL,
+// FEED_PRICE_OPTION, FEED_CURRENCY); options mapped by FEED_GOOGLE_ATTRIBUTES
+// become schema.org variant properties and name what the group varies by.
+
+const schemaOrg = "https://schema.org"
+
+// ldProperties maps Merchant attributes to schema.org Product properties;
+// age_group has no text property and stays an additionalProperty
+var ldProperties = map[string]string{
+	"color":    "color",
+	"size":     "size",
+	"material": "material",
+	"pattern":  "pattern",
+	"gender":   "suggestedGender",
+}
+
+type ldPropertyValue struct {
+	Type  string `json:"@type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type ldOffer struct {
+	Type          string `json:"@type"`
+	URL           string `json:"url,omitempty"`
+	Availability  string `json:"availability"`
+	Price         string `json:"price,omitempty"`
+	PriceCurrency string `json:"priceCurrency,omitempty"`
+}
+
+type ldProduct struct {
+	Context            string            `json:"@context,omitempty"`
+	Type               string            `json:"@type"`
+	Name               string            `json:"name"`
+	URL                string            `json:"url,omitempty"`
+	SKU                string            `json:"sku,omitempty"`
+	MPN                string            `json:"mpn,omitempty"`
+	GTIN               string            `json:"gtin,omitempty"`
+	Color              string            `json:"color,omitempty"`
+	Size               string            `json:"size,omitempty"`
+	Material           string            `json:"material,omitempty"`
+	Pattern            string            `json:"pattern,omitempty"`
+	SuggestedGender    string            `json:"suggestedGender,omitempty"`
+	ProductGroupID     string            `json:"productGroupID,omitempty"`
+	VariesBy           []string          `json:"variesBy,omitempty"`
+	AdditionalProperty []ldPropertyValue `json:"additionalProperty,omitempty"`
+	Offers             *ldOffer          `json:"offers,omitempty"`
+	HasVariant         []ldProduct       `json:"hasVariant,omitempty"`
+}
+
+// ldProperty returns the schema.org property an option maps to
+func ldProperty(mapping map[string]string, optionName string) (string, bool) {
+	property, ok := ldProperties[mapping[optionName]]
+	return property, ok
+}
+
+// setProperty sets a schema.org variant property
+func (p *ldProduct) setProperty(property, value string) {
+	switch property {
+	case "color":
+		p.Color = value
+	case "size":
+		p.Size = value
+	case "material":
+		p.Material = value
+	case "pattern":
+		p.Pattern = value
+	case "suggestedGender":
+		p.SuggestedGender = value
+	}
+}
+
+// ldVariant describes one SKU as a schema.org Product. A SKU without a price
+// gets no offer, since an Offer without a price is invalid structured data.
+func ldVariant(product *Product, sku *SKU, config *feedConfig, mapping map[string]string) ldProduct {
+	variant := ldProduct{
+		Type: "Product",
+		Name: product.Name,
+		SKU:  strconv.FormatInt(sku.ID, 10),
+		MPN:  product.Article,
+	}
+	if sku.Barcode != nil {
+		variant.GTIN = *sku.Barcode
+	}
+	if price, ok := config.skuPrice(sku); ok {
+		variant.Offers = &ldOffer{
+			Type:          "Offer",
+			URL:           config.productURL(product),
+			Availability:  schemaOrg + "/OutOfStock",
+			Price:         price,
+			PriceCurrency: config.Currency,
+		}
+		if sku.Available > 0 {
+			variant.Offers.Availability = schemaOrg + "/InStock"
+		}
+		if iso, ok := googleCurrencies[config.Currency]; ok {
+			variant.Offers.PriceCurrency = iso
+		}
+	}
+
+	for i := range sku.Options {
+		option := &sku.Options[i]
+		if option.OptionName == config.PriceOption {
+			continue
+		}
+		if property, ok := ldProperty(mapping, option.OptionName); ok {
+			variant.setProperty(property, optionValue(option))
+			continue
+		}
+		variant.AdditionalProperty = append(variant.AdditionalProperty, ldPropertyValue{
+			Type:  "PropertyValue",
+			Name:  option.OptionDisplayName,
+			Value: optionValue(option),
+		})
+	}
+	return variant
+}
+
+// productJSONLD builds the structured data of a product
+func productJSONLD(product *Product, config *feedConfig) (ldProduct, error) {
+	mapping, err := parseGoogleAttributes(config.GoogleAttributes)
+	if err != nil {
+		return ldProduct{}, err
+	}
+
+	switch len(product.SKUs) {
+	case 0:
+		return ldProduct{
+			Context: schemaOrg,
+			Type:    "Product",
+			Name:    product.Name,
+			URL:     config.productURL(product),
+			MPN:     product.Article,
+		}, nil
+	case 1:
+		single := ldVariant(product, &product.SKUs[0], config, mapping)
+		single.Context = schemaOrg
+		single.URL = config.productURL(product)
+		return single, nil
+	}
+
+	group := ldProduct{
+		Context:        schemaOrg,
+		Type:           "ProductGroup",
+		Name:           product.Name,
+		URL:            config.productURL(product),
+		MPN:            product.Article,
+		ProductGroupID: strconv.FormatInt(product.ID, 10),
+	}
+
+	// Mapped properties whose values differ between SKUs are what the
+	// variants vary by
+	values := make(map[string]map[string]bool)
+	for i := range product.SKUs {
+		sku := &product.SKUs[i]
+		group.HasVariant = append(group.HasVariant, ldVariant(product, sku, config, mapping))
+		for j := range sku.Options {
+			option := &sku.Options[j]
+			property, ok := ldProperty(mapping, option.OptionName)
+			if !ok {
+				continue
+			}
+			if values[property] == nil {
+				values[property] = make(map[string]bool)
+			}
+			values[property][optionValue(option)] = true
+		}
+	}
+	for property, distinct := range values {
+		if len(distinct) > 1 {
+			group.VariesBy = append(group.VariesBy, schemaOrg+"/"+property)
+		}
+	}
+	sort.Strings(group.VariesBy)
+
+	return group, nil
+}
+
+func productJSONLDHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	config, err := loadFeedConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page, err := getProducts(id, 1, nil)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error reading product %d: %v", id, err)
+		return
+	}
+	if len(page.Products) == 0 || page.Products[0].ID != id {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := productJSONLD(&page.Products[0], config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ld+json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProductJSONLDGroup(t *testing.T) {
+	product := testProduct()
+	product.SKUs[1].Options = append(product.SKUs[1].Options, option("fabric", "Fabric", "Cotton"))
+
+	data, err := productJSONLD(product, testFeedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Type != "ProductGroup" || data.ProductGroupID != "7" || len(data.HasVariant) != 3 {
+		t.Fatalf("group = %+v", data)
+	}
+
+	// size is only set on one SKU, so only color varies
+	if want := []string{"https://schema.org/color"}; !reflect.DeepEqual(data.VariesBy, want) {
+		t.Errorf("variesBy = %v, want %v", data.VariesBy, want)
+	}
+
+	first := data.HasVariant[0]
+	if first.Color != "Red & Blue" || first.Size != "40-44" || first.AdditionalProperty != nil {
+		t.Errorf("first variant = %+v", first)
+	}
+	if first.Offers == nil || first.Offers.Price != "1299.5" || first.Offers.PriceCurrency != "RUB" ||
+		first.Offers.Availability != "https://schema.org/InStock" {
+		t.Errorf("first offer = %+v", first.Offers)
+	}
+
+	// No price: no offer, unmapped options stay additional properties
+	second := data.HasVariant[1]
+	if second.Offers != nil {
+		t.Errorf("a SKU without a price must have no offer, got %+v", second.Offers)
+	}
+	want := []ldPropertyValue{{Type: "PropertyValue", Name: "Fabric", Value: "Cotton"}}
+	if second.Color != "Green" || !reflect.DeepEqual(second.AdditionalProperty, want) {
+		t.Errorf("second variant = %+v", second)
+	}
+
+	if third := data.HasVariant[2]; third.Offers == nil || third.Offers.Availability != "https://schema.org/OutOfStock" {
+		t.Errorf("third offer = %+v", third.Offers)
+	}
+
+	out, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), `"price":""`) || !strings.Contains(string(out), `"@context":"https://schema.org"`) {
+		t.Errorf("JSON = %s", out)
+	}
+}
+
+func TestProductJSONLDSingle(t *testing.T) {
+	product := testProduct()
+	product.SKUs = product.SKUs[:1]
+
+	config := testFeedConfig()
+	config.GoogleAttributes = "color=color,fabric=material"
+	data, err := productJSONLD(product, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Type != "Product" || data.Context != "https://schema.org" || data.GTIN != "4600000000001" ||
+		data.URL != "https://example.com/p/SH%2001%2FA?id=7" || data.VariesBy != nil {
+		t.Errorf("product = %+v", data)
+	}
+	// size is not mapped here
+	want := []ldPropertyValue{{Type: "PropertyValue", Name: "Size", Value: "40-44"}}
+	if data.Color != "Red & Blue" || data.Size != "" || !reflect.DeepEqual(data.AdditionalProperty, want) {
+		t.Errorf("properties = %+v", data)
+	}
+}
+
+func TestProductJSONLDInvalidMapping(t *testing.T) {
+	config := testFeedConfig()
+	config.GoogleAttributes = "color"
+	if _, err := productJSONLD(testProduct(), config); err == nil {
+		t.Error("expected an error for an invalid FEED_GOOGLE_ATTRIBUTES")
+	}
+}
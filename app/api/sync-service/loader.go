@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/restream/reindexer/v5"
+)
+
+// A full load is a three-stage pipeline connected by bounded channels:
+// one reader pages product IDs from MySQL, workers assemble the documents
+// and writers upsert them in transactional batches. The stages overlap and
+// a slow stage blocks the ones before it. Unchanged documents are skipped and
+// products deleted from MySQL are removed afterwards; LOAD_REBUILD=true drops
+// the namespace first instead.
+
+// loadConfig holds the tunables of a full load
+type loadConfig struct {
+	BatchSize    int
+	MaxErrorRate float64
+	// MinProcessed is how many products must be processed before the error
+	// rate is enforced mid-load; the final rate is always checked
+	MinProcessed int
+	Workers      int
+	QueueSize    int
+	Rebuild      bool
+}
+
+func getLoadConfig() (loadConfig, error) {
+	batchSize, err := strconv.Atoi(getEnv("LOAD_BATCH_SIZE", "1000"))
+	if err != nil || batchSize <= 0 {
+		return loadConfig{}, fmt.Errorf("invalid LOAD_BATCH_SIZE: must be a positive number")
+	}
+
+	maxErrorRate, err := strconv.ParseFloat(getEnv("LOAD_MAX_ERROR_RATE", "0.01"), 64)
+	if err != nil || maxErrorRate < 0 || maxErrorRate > 1 {
+		return loadConfig{}, fmt.Errorf("invalid LOAD_MAX_ERROR_RATE: must be between 0 and 1")
+	}
+
+	minProcessed, err := strconv.Atoi(getEnv("LOAD_ERROR_RATE_MIN", "10000"))
+	if err != nil || minProcessed < 0 {
+		return loadConfig{}, fmt.Errorf("invalid LOAD_ERROR_RATE_MIN: must not be negative")
+	}
+
+	workers, err := strconv.Atoi(getEnv("LOAD_WORKERS", "4"))
+	if err != nil || workers <= 0 {
+		return loadConfig{}, fmt.Errorf("invalid LOAD_WORKERS: must be a positive number")
+	}
+
+	queueSize, err := strconv.Atoi(getEnv("LOAD_QUEUE_SIZE", strconv.Itoa(workers*2)))
+	if err != nil || queueSize <= 0 {
+		return loadConfig{}, fmt.Errorf("invalid LOAD_QUEUE_SIZE: must be a positive number")
+	}
+
+	return loadConfig{
+		BatchSize:    batchSize,
+		MaxErrorRate: maxErrorRate,
+		MinProcessed: minProcessed,
+		Workers:      workers,
+		QueueSize:    queueSize,
+		Rebuild:      getEnv("LOAD_REBUILD", "false") == "true",
+	}, nil
+}
+
+// loadToReindexer rebuilds the whole products namespace from MySQL
+func loadToReindexer(ctx context.Context, job *Job) error {
+	cfg, err := getLoadConfig()
+	if err != nil {
+		return err
+	}
+
+	dbName := getEnv("REINDEXER_DB", "products_db")
+
+	// Outbox rows committed before the load are covered by it
+	started := time.Now()
+	outboxID, outboxErr := outboxHighWater()
+	if outboxErr != nil && !isMissingTable(outboxErr) {
+		log.Printf("Error reading outbox position: %v", outboxErr)
+	}
+
+	job.phase("prepare namespace")
+
+	if cfg.Rebuild {
+		if err := rx.DropNamespace(dbName); err != nil {
+			log.Printf("Error deleting namespace: %s: %v", dbName, err)
+		}
+	}
+
+	if err := rx.OpenNamespace(dbName, reindexer.DefaultNamespaceOptions(), ReindexerProduct{}); err != nil {
+		log.Printf("Creating new namespace: %s", dbName)
+	}
+
+	log.Printf("Starting data load to Reindexer (batch size %d, %d workers)...", cfg.BatchSize, cfg.Workers)
+	job.phase("load products")
+
+	loaded, failed, err := runLoadPipeline(ctx, job, cfg, dbName)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.Rebuild {
+		job.phase("remove deleted products")
+		removed, err := removeDeletedProducts(ctx, dbName, cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+		job.addDocuments(WriteStats{Removed: removed})
+	}
+
+	docs := job.info().Documents
+	log.Printf("Completed loading %d products to Reindexer (%d new, %d updated, %d skipped, %d removed, %d failed)",
+		loaded, docs.New, docs.Updated, docs.Skipped, docs.Removed, failed)
+
+	if cfg.Rebuild || docs.New+docs.Updated+docs.Removed > 0 {
+		bumpIndexVersion(dbName)
+	}
+	markSynced(dbName, started, true)
+
+	if outboxErr == nil {
+		if err := ackOutboxUpTo(outboxID); err != nil {
+			log.Printf("Error acking outbox: %v", err)
+		}
+	}
+	return nil
+}
+
+// productIDPage returns up to count product IDs starting at fromID
+func productIDPage(ctx context.Context, fromID int64, count int) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM products WHERE id >= ? ORDER BY id LIMIT ?", fromID, count)
+	if err != nil {
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning product ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating products: %w", err)
+	}
+	return ids, nil
+}
+
+func runLoadPipeline(parent context.Context, job *Job, cfg loadConfig, dbName string) (int, int, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	idBatches := make(chan []int64, cfg.QueueSize)
+	docBatches := make(chan []ProductIDs, cfg.QueueSize)
+
+	// Reader: page product IDs from MySQL
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(idBatches)
+
+		fromID := int64(0)
+		for {
+			ids, err := productIDPage(ctx, fromID, cfg.BatchSize)
+			if err != nil {
+				fail(fmt.Errorf("error getting product IDs: %w", err))
+				return
+			}
+			if len(ids) == 0 {
+				return
+			}
+
+			select {
+			case idBatches <- ids:
+			case <-ctx.Done():
+				return
+			}
+
+			if len(ids) < cfg.BatchSize {
+				return
+			}
+			fromID = ids[len(ids)-1] + 1
+		}
+	}()
+
+	// Assemblers: collect option and option value IDs
+	var assemblers sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		assemblers.Add(1)
+		go func() {
+			defer wg.Done()
+			defer assemblers.Done()
+
+			for ids := range idBatches {
+				if ctx.Err() != nil {
+					return
+				}
+
+				products, err := assembleProductIDs(ids)
+				if err != nil {
+					fail(fmt.Errorf("error getting product IDs: %w", err))
+					return
+				}
+
+				select {
+				case docBatches <- products:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		assemblers.Wait()
+		close(docBatches)
+	}()
+
+	// Writers: upsert batches to Reindexer
+	var (
+		mu     sync.Mutex
+		loaded int
+		failed int
+	)
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for products := range docBatches {
+				if ctx.Err() != nil {
+					return
+				}
+
+				job.addRows(len(products))
+				stats, err := writeBatch(dbName, products)
+				job.addDocuments(stats)
+
+				mu.Lock()
+				if err != nil {
+					err = batchError(products, err)
+					log.Printf("Error loading to Reindexer: %v", err)
+					job.addError(err)
+					failed += len(products)
+
+					ids := make([]int64, len(products))
+					for i, productIDs := range products {
+						ids[i] = productIDs.ProductID
+					}
+					logDeadLetterError(recordDeadLetters(ids, err))
+				} else {
+					loaded += len(products)
+					log.Printf("Loaded %d products to Reindexer (total: %d)", len(products), loaded)
+				}
+				rateErr := checkErrorRate(cfg, failed, loaded+failed, false)
+				mu.Unlock()
+
+				if rateErr != nil {
+					fail(rateErr)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return loaded, failed, firstErr
+	}
+	if err := parent.Err(); err != nil {
+		return loaded, failed, err
+	}
+	return loaded, failed, checkErrorRate(cfg, failed, loaded+failed, true)
+}
+
+// upsertBatch writes the documents in a single Reindexer transaction
+func upsertBatch(namespace string, docs []*ReindexerProduct) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	tx, err := rx.NewTx(namespace)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	for _, doc := range docs {
+		if err := tx.Upsert(doc); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error upserting product %d: %w", doc.ProductID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// removeDeletedProducts walks the index and deletes products that no longer
+// exist in MySQL
+func removeDeletedProducts(ctx context.Context, namespace string, batchSize int) (int, error) {
+	removed := 0
+	afterID := int64(-1)
+
+	for {
+		iterator := rx.Query(namespace).
+			Select("product_id").
+			WhereInt64("product_id", reindexer.GT, afterID).
+			Sort("product_id", false).
+			Limit(batchSize).
+			ExecCtx(ctx)
+
+		var ids []int64
+		for iterator.Next() {
+			ids = append(ids, iterator.Object().(*ReindexerProduct).ProductID)
+		}
+		err := iterator.Error()
+		iterator.Close()
+		if err != nil {
+			return removed, fmt.Errorf("error querying Reindexer: %w", err)
+		}
+		if len(ids) == 0 {
+			return removed, nil
+		}
+
+		existing, err := existingProductIDs(ctx, ids)
+		if err != nil {
+			return removed, fmt.Errorf("error checking products: %w", err)
+		}
+		exists := make(map[int64]bool, len(existing))
+		for _, id := range existing {
+			exists[id] = true
+		}
+
+		for _, id := range ids {
+			if exists[id] {
+				continue
+			}
+			if err := rx.Delete(namespace, &ReindexerProduct{ProductID: id}); err != nil {
+				return removed, fmt.Errorf("error deleting product %d from Reindexer: %w", id, err)
+			}
+			removed++
+		}
+
+		if len(ids) < batchSize {
+			return removed, nil
+		}
+		afterID = ids[len(ids)-1]
+	}
+}
+
+// batchError describes a batch that could not be written
+func batchError(products []ProductIDs, err error) error {
+	return fmt.Errorf("batch of %d products (%d-%d): %w",
+		len(products), products[0].ProductID, products[len(products)-1].ProductID, err)
+}
+
+// checkErrorRate fails the load once too many rows could not be written.
+// Until MinProcessed products are done a few early failures would dominate
+// the rate, so only the final check enforces it.
+func checkErrorRate(cfg loadConfig, failed, processed int, final bool) error {
+	if processed == 0 || !final && processed < cfg.MinProcessed {
+		return nil
+	}
+	rate := float64(failed) / float64(processed)
+	if rate > cfg.MaxErrorRate {
+		return fmt.Errorf("error rate %.2f%% (%d of %d products) exceeds LOAD_MAX_ERROR_RATE %.2f%%",
+			rate*100, failed, processed, cfg.MaxErrorRate*100)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestCheckErrorRate(t *testing.T) {
+	cfg := loadConfig{MaxErrorRate: 0.01, MinProcessed: 1000}
+	tests := []struct {
+		name              string
+		failed, processed int
+		final             bool
+		wantErr           bool
+	}{
+		{"nothing processed", 0, 0, true, false},
+		{"first batch failed", 100, 100, false, false},
+		{"below minimum but final", 100, 100, true, true},
+		{"within rate", 10, 1000, false, false},
+		{"above rate after minimum", 11, 1000, false, true},
+		{"within rate at the end", 5, 500, true, false},
+		{"no limit", 0, 10, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkErrorRate(cfg, tt.failed, tt.processed, tt.final)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reindex runs that rebuild the namespace must not overlap. The run lock is
+// taken in-process first and then cluster-wide with MySQL GET_LOCK, which is
+// held by a dedicated connection for the whole run.
+
+const runLockStateKey = "run_lock"
+
+// runLockHolder describes who holds the cluster-wide lock
+type runLockHolder struct {
+	JobID     string    `json:"job_id"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// runningJobError is returned when another reindex already holds the run lock
+type runningJobError struct {
+	JobID string
+}
+
+func (e *runningJobError) Error() string {
+	if e.JobID == "" {
+		return "another reindex is already running"
+	}
+	return fmt.Sprintf("reindex job %s is already running", e.JobID)
+}
+
+var localRunLock struct {
+	mu    sync.Mutex
+	jobID string
+}
+
+func runLockName() string {
+	return getEnv("RUN_LOCK_NAME", "sync-service:reindex")
+}
+
+// acquireRunLock takes the run lock for jobID. The returned function releases it.
+func acquireRunLock(jobID string) (func(), error) {
+	localRunLock.mu.Lock()
+	if localRunLock.jobID != "" {
+		holder := localRunLock.jobID
+		localRunLock.mu.Unlock()
+		return nil, &runningJobError{JobID: holder}
+	}
+	localRunLock.jobID = jobID
+	localRunLock.mu.Unlock()
+
+	releaseLocal := func() {
+		localRunLock.mu.Lock()
+		localRunLock.jobID = ""
+		localRunLock.mu.Unlock()
+	}
+
+	conn, err := acquireMySQLLock()
+	if err != nil {
+		releaseLocal()
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	if err := putState(runLockStateKey, runLockHolder{JobID: jobID, Host: host, StartedAt: time.Now()}); err != nil {
+		log.Printf("Error recording run lock holder: %v", err)
+	}
+
+	release := func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", runLockName()); err != nil {
+			log.Printf("Error releasing run lock: %v", err)
+		}
+		conn.Close()
+		releaseLocal()
+	}
+
+	return release, nil
+}
+
+// acquireMySQLLock takes GET_LOCK without waiting and returns the connection holding it
+func acquireMySQLLock() (*sql.Conn, error) {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting connection for run lock: %w", err)
+	}
+
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", runLockName()).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error acquiring run lock: %w", err)
+	}
+
+	if !acquired.Valid || acquired.Int64 != 1 {
+		conn.Close()
+
+		var holder runLockHolder
+		if _, err := getState(runLockStateKey, &holder); err != nil {
+			log.Printf("Error reading run lock holder: %v", err)
+		}
+		return nil, &runningJobError{JobID: holder.JobID}
+	}
+
+	return conn, nil
+}
+
+// startLoad takes the run lock and registers a full load job. The job still
+// has to be run; the lock is released when it finishes.
+func startLoad(trigger string) (*Job, func(ctx context.Context, job *Job) error, error) {
+	job := newJob("load", trigger)
+
+	release, err := acquireRunLock(job.id())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jobs.add(job)
+
+	return job, func(ctx context.Context, job *Job) error {
+		defer release()
+		return loadToReindexer(ctx, job)
+	}, nil
+}
+
+// writeLockError replies 409 with the running job's ID when the lock is busy
+func writeLockError(w http.ResponseWriter, err error) {
+	var running *runningJobError
+	if errors.As(err, &running) {
+		writeJSON(w, http.StatusConflict, map[string]string{
+			"error":  running.Error(),
+			"job_id": running.JobID,
+		})
+		return
+	}
+
+	http.Error(w, "Error acquiring run lock", http.StatusInternalServerError)
+	log.Printf("Error acquiring run lock: %v", err)
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/restream/reindexer/v5"
@@ -35,14 +38,26 @@ type Product struct {
 	SKUs      []SKU  `json:"skus,omitempty"`
 }
 
+// SKU.Available is Count minus the quantity Reserved by active checkout
+// reservations
 type SKU struct {
 	ID        int64       `json:"id"`
 	ProductID int64       `json:"product_id"`
 	Count     int         `json:"count"`
+	Reserved  int         `json:"reserved"`
+	Available int         `json:"available"`
 	Barcode   *string     `json:"barcode"`
 	CreatedAt string      `json:"created_at"`
 	UpdatedAt string      `json:"updated_at"`
 	Options   []SKUOption `json:"options,omitempty"`
+	// Warehouses is the per-warehouse breakdown of Count, if the SKU has one
+	Warehouses []SKUStock `json:"warehouses,omitempty"`
+}
+
+type SKUStock struct {
+	WarehouseID   int64  `json:"warehouse_id"`
+	WarehouseCode string `json:"warehouse_code"`
+	Quantity      int    `json:"quantity"`
 }
 
 type SKUOption struct {
@@ -87,6 +102,10 @@ func initReindexer() error {
 		log.Printf("Creating new namespace: %s", dbName)
 	}
 
+	if err := initSyncState(); err != nil {
+		return err
+	}
+
 	log.Printf("Successfully connected to Reindexer (DSN: %s, DB: %s)", reindexerDSN, dbName)
 	return nil
 }
@@ -111,9 +130,12 @@ type ProductsResponse struct {
 }
 
 type ProductIDs struct {
-	ProductID      int64   `json:"product_id"`
-	OptionIDs      []int64 `json:"option_ids"`
-	OptionValueIDs []int64 `json:"option_value_ids"`
+	ProductID             int64   `json:"product_id"`
+	OptionIDs             []int64 `json:"option_ids"`
+	OptionValueIDs        []int64 `json:"option_value_ids"`
+	InStock               bool    `json:"in_stock"`
+	InStockOptionValueIDs []int64 `json:"in_stock_option_value_ids"`
+	InStockWarehouseIDs   []int64 `json:"in_stock_warehouse_ids"`
 }
 
 type ProductIDsResponse struct {
@@ -123,24 +145,53 @@ type ProductIDsResponse struct {
 }
 
 // ReindexerProduct is the struct stored in Reindexer
+// InStock and InStockOptionValueIDs only count SKUs with stock, so filters
+// can ask for products available in a given option value.
+// InStockWarehouseIDs lists the warehouses holding stock of any SKU.
 type ReindexerProduct struct {
-	ProductID      int64   `reindex:"product_id,hash,pk" json:"product_id"`
-	OptionIDs      []int64 `reindex:"option_ids" json:"option_ids"`
-	OptionValueIDs []int64 `reindex:"option_value_ids" json:"option_value_ids"`
+	ProductID             int64   `reindex:"product_id,hash,pk" json:"product_id"`
+	OptionIDs             []int64 `reindex:"option_ids" json:"option_ids"`
+	OptionValueIDs        []int64 `reindex:"option_value_ids" json:"option_value_ids"`
+	InStock               bool    `reindex:"in_stock" json:"in_stock"`
+	InStockOptionValueIDs []int64 `reindex:"in_stock_option_value_ids" json:"in_stock_option_value_ids"`
+	InStockWarehouseIDs   []int64 `reindex:"in_stock_warehouse_ids" json:"in_stock_warehouse_ids"`
+	ContentHash           string  `json:"content_hash"`
 }
 
 // toReindexerProduct converts ProductIDs to ReindexerProduct
 func (p *ProductIDs) toReindexerProduct() *ReindexerProduct {
 	return &ReindexerProduct{
-		ProductID:      p.ProductID,
-		OptionIDs:      p.OptionIDs,
-		OptionValueIDs: p.OptionValueIDs,
+		ProductID:             p.ProductID,
+		OptionIDs:             p.OptionIDs,
+		OptionValueIDs:        p.OptionValueIDs,
+		InStock:               p.InStock,
+		InStockOptionValueIDs: p.InStockOptionValueIDs,
+		InStockWarehouseIDs:   p.InStockWarehouseIDs,
 	}
 }
 
-func getProducts(fromID int64, count int) (*ProductsResponse, error) {
-	// First query: Get products with their options grouped
-	productsQuery := `
+// getProducts returns a page of products with their SKUs. With updatedSince
+// set only products changed since then, directly, through a SKU or through an
+// option added to a SKU, are returned. option_values has no update time, so
+// renamed values do not select their products.
+func getProducts(fromID int64, count int, updatedSince *time.Time) (*ProductsResponse, error) {
+	// First query: Get products
+	filter := ""
+	args := []interface{}{fromID}
+	if updatedSince != nil {
+		// FROM_UNIXTIME compares in the session time zone, like the columns
+		filter = `AND (p.updated_at >= FROM_UNIXTIME(?)
+			OR EXISTS (SELECT 1 FROM skus s WHERE s.product_id = p.id AND s.updated_at >= FROM_UNIXTIME(?))
+			OR EXISTS (
+				SELECT 1 FROM skus s
+				JOIN sku_options so ON so.sku_id = s.id
+				WHERE s.product_id = p.id AND so.created_at >= FROM_UNIXTIME(?)))`
+		since := float64(updatedSince.UnixMicro()) / 1e6
+		args = append(args, since, since, since)
+	}
+	args = append(args, count+1)
+
+	productsQuery := fmt.Sprintf(`
 		SELECT 
 			p.id, 
 			p.name, 
@@ -148,18 +199,18 @@ func getProducts(fromID int64, count int) (*ProductsResponse, error) {
 			p.created_at, 
 			p.updated_at
 		FROM products p
-		WHERE p.id >= ?
+		WHERE p.id >= ? %s
 		ORDER BY p.id
-		LIMIT ?`
+		LIMIT ?`, filter)
 
-	rows, err := db.Query(productsQuery, fromID, count+1)
+	rows, err := db.Query(productsQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("database query error: %w", err)
 	}
 	defer rows.Close()
 
-	var products []Product
-	var productIDs []int64
+	products := []Product{}
+	var nextProductID *int64
 
 	for rows.Next() {
 		var p Product
@@ -168,45 +219,45 @@ func getProducts(fromID int64, count int) (*ProductsResponse, error) {
 			return nil, fmt.Errorf("error scanning product: %w", err)
 		}
 
-		if len(products) < count {
-			products = append(products, p)
-			productIDs = append(productIDs, p.ID)
+		// The extra row only tells where the next page starts
+		if len(products) == count {
+			nextProductID = &p.ID
+			break
 		}
+		products = append(products, p)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating products: %w", err)
 	}
 
-	// Determine next product ID
-	var nextProductID *int64
-	if len(products) > 0 {
-		// Check if there are more products
-		var nextID sql.NullInt64
-		err = db.QueryRow("SELECT id FROM products WHERE id > ? ORDER BY id LIMIT 1", products[len(products)-1].ID).Scan(&nextID)
-		if err == nil && nextID.Valid {
-			nextProductID = &nextID.Int64
-		}
+	if err := attachSKUs(products); err != nil {
+		return nil, err
 	}
 
-	// If no products found, return empty response
-	if len(productIDs) == 0 {
-		return &ProductsResponse{
-			Products:      []Product{},
-			NextProductID: nil,
-			Count:         0,
-		}, nil
+	response := &ProductsResponse{
+		Products:      products,
+		NextProductID: nextProductID,
+		Count:         len(products),
 	}
 
-	// Second query: Get SKUs with their options for the retrieved products
-	// Build placeholders for IN clause
-	placeholders := make([]string, len(productIDs))
-	args := make([]interface{}, len(productIDs))
-	for i, id := range productIDs {
-		placeholders[i] = "?"
-		args[i] = id
+	return response, nil
+}
+
+// attachSKUs loads the SKUs of the products together with their options.
+// Options are read one row each and grouped in Go, so values containing
+// separators or shared between options never get mixed up.
+func attachSKUs(products []Product) error {
+	if len(products) == 0 {
+		return nil
 	}
 
+	productIDs := make([]int64, len(products))
+	for i, p := range products {
+		productIDs[i] = p.ID
+	}
+	placeholders, args := inPlaceholders(productIDs)
+
 	skusQuery := fmt.Sprintf(`
 		SELECT 
 			s.id,
@@ -214,38 +265,29 @@ func getProducts(fromID int64, count int) (*ProductsResponse, error) {
 			s.count,
 			s.barcode,
 			s.created_at,
-			s.updated_at,
-			GROUP_CONCAT(DISTINCT o.id ORDER BY o.name SEPARATOR '|') as option_ids,
-			GROUP_CONCAT(DISTINCT o.name ORDER BY o.name SEPARATOR '|') as option_names,
-			GROUP_CONCAT(DISTINCT o.display_name ORDER BY o.name SEPARATOR '|') as option_display_names,
-			GROUP_CONCAT(DISTINCT ov.id ORDER BY o.name SEPARATOR '|') as option_values_ids,
-			GROUP_CONCAT(DISTINCT ov.value ORDER BY o.name SEPARATOR '|') as option_values,
-			GROUP_CONCAT(DISTINCT so.is_range ORDER BY o.name SEPARATOR '|') as is_ranges,
-			GROUP_CONCAT(DISTINCT ov_end.value ORDER BY o.name SEPARATOR '|') as range_end_values
+			s.updated_at
 		FROM skus s
-		LEFT JOIN sku_options so ON s.id = so.sku_id
-		LEFT JOIN option_values ov ON so.option_value_id = ov.id
-		LEFT JOIN options o ON ov.option_id = o.id
-		LEFT JOIN option_values ov_end ON so.range_end_value_id = ov_end.id
 		WHERE s.product_id IN (%s)
-		GROUP BY s.id
-		ORDER BY s.product_id, s.id`, strings.Join(placeholders, ","))
+		ORDER BY s.product_id, s.id`, placeholders)
 
 	skuRows, err := db.Query(skusQuery, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error querying SKUs: %w", err)
+		return fmt.Errorf("error querying SKUs: %w", err)
 	}
 	defer skuRows.Close()
 
-	// Map to store SKUs by product_id
+	// SKUs are kept in query order; skuIndex points into productSKUs
 	productSKUs := make(map[int64][]SKU)
+	type skuPosition struct {
+		productID int64
+		index     int
+	}
+	skuIndex := make(map[int64]skuPosition)
 
 	for skuRows.Next() {
 		var (
-			sku                                                                       SKU
-			barcode                                                                   sql.NullString
-			optionIds, optionNames, optionDisplayNames, optionValuesIds, optionValues sql.NullString
-			isRanges, rangeEndValues                                                  sql.NullString
+			sku     SKU
+			barcode sql.NullString
 		)
 
 		err := skuRows.Scan(
@@ -255,146 +297,202 @@ func getProducts(fromID int64, count int) (*ProductsResponse, error) {
 			&barcode,
 			&sku.CreatedAt,
 			&sku.UpdatedAt,
-			&optionIds,
-			&optionNames,
-			&optionDisplayNames,
-			&optionValuesIds,
-			&optionValues,
-			&isRanges,
-			&rangeEndValues,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("error scanning SKU: %w", err)
+			return fmt.Errorf("error scanning SKU: %w", err)
 		}
 
 		if barcode.Valid {
 			sku.Barcode = &barcode.String
 		}
+		sku.Available = sku.Count
 
-		// Parse grouped options
-		if optionNames.Valid && optionValues.Valid {
-			ids := strings.Split(optionIds.String, "|")
-			names := strings.Split(optionNames.String, "|")
-			displayNames := strings.Split(optionDisplayNames.String, "|")
-			valuesIds := strings.Split(optionValuesIds.String, "|")
-			values := strings.Split(optionValues.String, "|")
-			ranges := strings.Split(isRanges.String, "|")
-			endValues := []string{}
-			if rangeEndValues.Valid {
-				endValues = strings.Split(rangeEndValues.String, "|")
-			}
-
-			sku.Options = []SKUOption{}
-			for i := 0; i < len(names) && i < len(values); i++ {
-				option := SKUOption{
-					OptionId:          ids[i],
-					OptionName:        names[i],
-					OptionDisplayName: displayNames[i],
-					ValueId:           valuesIds[i],
-					Value:             values[i],
-					IsRange:           len(ranges) > i && ranges[i] == "1",
-				}
-				if len(endValues) > i && endValues[i] != "" {
-					option.RangeEndValue = &endValues[i]
-				}
-				sku.Options = append(sku.Options, option)
-			}
-		}
-
+		skuIndex[sku.ID] = skuPosition{sku.ProductID, len(productSKUs[sku.ProductID])}
 		productSKUs[sku.ProductID] = append(productSKUs[sku.ProductID], sku)
 	}
 
 	if err = skuRows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating SKUs: %w", err)
+		return fmt.Errorf("error iterating SKUs: %w", err)
 	}
 
-	// Attach SKUs to products
-	for i := range products {
-		if skus, exists := productSKUs[products[i].ID]; exists {
-			products[i].SKUs = skus
-		} else {
-			products[i].SKUs = []SKU{}
-		}
-	}
+	// One row per SKU option; options.position is missing until migration 004 runs
+	optionsQuery := `
+		SELECT 
+			so.sku_id,
+			o.id,
+			o.name,
+			o.display_name,
+			ov.id,
+			ov.value,
+			so.is_range,
+			ov_end.value
+		FROM skus s
+		JOIN sku_options so ON so.sku_id = s.id
+		JOIN option_values ov ON ov.id = so.option_value_id
+		JOIN options o ON o.id = ov.option_id
+		LEFT JOIN option_values ov_end ON ov_end.id = so.range_end_value_id
+		WHERE s.product_id IN (%s)
+		ORDER BY so.sku_id, %s o.name, so.id`
 
-	response := &ProductsResponse{
-		Products:      products,
-		NextProductID: nextProductID,
-		Count:         len(products),
+	optionRows, err := db.Query(fmt.Sprintf(optionsQuery, placeholders, "o.position,"), args...)
+	if isMissingColumn(err) {
+		optionRows, err = db.Query(fmt.Sprintf(optionsQuery, placeholders, ""), args...)
 	}
+	if err != nil {
+		return fmt.Errorf("error querying SKU options: %w", err)
+	}
+	defer optionRows.Close()
 
-	return response, nil
-}
+	for optionRows.Next() {
+		var (
+			skuID, optionID, valueID int64
+			option                   SKUOption
+			displayName, endValue    sql.NullString
+		)
 
-func loadToReindexer() error {
-	fromID := int64(0)
-	batchSize := 1000
-	totalLoaded := 0
-	dbName := getEnv("REINDEXER_DB", "products_db")
+		err := optionRows.Scan(
+			&skuID,
+			&optionID,
+			&option.OptionName,
+			&displayName,
+			&valueID,
+			&option.Value,
+			&option.IsRange,
+			&endValue,
+		)
+		if err != nil {
+			return fmt.Errorf("error scanning SKU option: %w", err)
+		}
 
-	if err := rx.DropNamespace(dbName); err != nil {
-		log.Printf("Error deleting namespace: %s: %v", dbName, err)
+		option.OptionId = strconv.FormatInt(optionID, 10)
+		option.OptionDisplayName = displayName.String
+		option.ValueId = strconv.FormatInt(valueID, 10)
+		if endValue.Valid {
+			option.RangeEndValue = &endValue.String
+		}
+
+		// SKUs added after the first query are skipped until the next read
+		position, ok := skuIndex[skuID]
+		if !ok {
+			continue
+		}
+		sku := &productSKUs[position.productID][position.index]
+		sku.Options = append(sku.Options, option)
 	}
 
-	if err := rx.OpenNamespace(dbName, reindexer.DefaultNamespaceOptions(), ReindexerProduct{}); err != nil {
-		log.Printf("Creating new namespace: %s", dbName)
+	if err = optionRows.Err(); err != nil {
+		return fmt.Errorf("error iterating SKU options: %w", err)
 	}
 
-	log.Printf("Starting data load to Reindexer...")
+	// Per-warehouse quantities; the table is missing until migration 005 runs
+	stocksQuery := fmt.Sprintf(`
+		SELECT ss.sku_id, w.id, w.code, ss.quantity
+		FROM skus s
+		JOIN sku_stocks ss ON ss.sku_id = s.id
+		JOIN warehouses w ON w.id = ss.warehouse_id
+		WHERE s.product_id IN (%s)
+		ORDER BY ss.sku_id, w.id`, placeholders)
 
-	for {
-		// Get product IDs batch
-		response, err := productsIds(fromID, batchSize)
-		if err != nil {
-			return fmt.Errorf("error getting product IDs: %w", err)
+	stockRows, err := db.Query(stocksQuery, args...)
+	if err != nil && !isMissingTable(err) {
+		return fmt.Errorf("error querying SKU stocks: %w", err)
+	}
+	if err == nil {
+		defer stockRows.Close()
+
+		for stockRows.Next() {
+			var (
+				skuID int64
+				stock SKUStock
+			)
+			if err := stockRows.Scan(&skuID, &stock.WarehouseID, &stock.WarehouseCode, &stock.Quantity); err != nil {
+				return fmt.Errorf("error scanning SKU stock: %w", err)
+			}
+			if position, ok := skuIndex[skuID]; ok {
+				sku := &productSKUs[position.productID][position.index]
+				sku.Warehouses = append(sku.Warehouses, stock)
+			}
 		}
 
-		// If no products returned, we're done
-		if len(response.ProductIDs) == 0 {
-			break
+		if err = stockRows.Err(); err != nil {
+			return fmt.Errorf("error iterating SKU stocks: %w", err)
 		}
+	}
 
-		// Upsert each product's IDs to Reindexer
-		for _, productIDs := range response.ProductIDs {
-			// Transform to ReindexerProduct
-			reindexerProduct := productIDs.toReindexerProduct()
+	// Active reservations; the table is missing until migration 006 runs
+	reservedQuery := fmt.Sprintf(`
+		SELECT r.sku_id, SUM(r.quantity)
+		FROM skus s
+		JOIN stock_reservations r ON r.sku_id = s.id
+		WHERE s.product_id IN (%s) AND r.expires_at > NOW(3)
+		GROUP BY r.sku_id`, placeholders)
 
-			err := rx.Upsert(dbName, reindexerProduct)
-			if err != nil {
-				log.Printf("Error upserting product %d to Reindexer: %v", productIDs.ProductID, err)
-				continue
+	reservedRows, err := db.Query(reservedQuery, args...)
+	if err != nil && !isMissingTable(err) {
+		return fmt.Errorf("error querying SKU reservations: %w", err)
+	}
+	if err == nil {
+		defer reservedRows.Close()
+
+		for reservedRows.Next() {
+			var skuID int64
+			var reserved int
+			if err := reservedRows.Scan(&skuID, &reserved); err != nil {
+				return fmt.Errorf("error scanning SKU reservations: %w", err)
+			}
+			if position, ok := skuIndex[skuID]; ok {
+				sku := &productSKUs[position.productID][position.index]
+				sku.Reserved = reserved
+				sku.Available = max(sku.Count-reserved, 0)
 			}
 		}
 
-		totalLoaded += len(response.ProductIDs)
-		log.Printf("Loaded %d products to Reindexer (total: %d)", len(response.ProductIDs), totalLoaded)
-
-		// If there's no next page, we're done
-		if response.NextProductID == nil {
-			break
+		if err = reservedRows.Err(); err != nil {
+			return fmt.Errorf("error iterating SKU reservations: %w", err)
 		}
+	}
 
-		// Move to next batch
-		fromID = *response.NextProductID
+	// Attach SKUs to products
+	for i := range products {
+		if skus, exists := productSKUs[products[i].ID]; exists {
+			products[i].SKUs = skus
+		} else {
+			products[i].SKUs = []SKU{}
+		}
 	}
 
-	log.Printf("Completed loading %d products to Reindexer", totalLoaded)
 	return nil
 }
 
+// runLoad runs a full load as a tracked job and waits for it
+func runLoad(trigger string) error {
+	job, load, err := startLoad(trigger)
+	if err != nil {
+		return err
+	}
+	return job.run(context.Background(), load)
+}
+
 func loadToReindexerHandler(w http.ResponseWriter, r *http.Request) {
-	// Run in background
-	go func() {
-		if err := loadToReindexer(); err != nil {
-			log.Printf("Error loading to Reindexer: %v", err)
-		}
-	}()
+	job, load, err := startLoad("http")
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "started",
-		"message": "Loading to Reindexer started in background. Check logs for progress.",
-	})
+	// Run in background, progress is available at /load/{id}
+	job.start(load)
+
+	w.Header().Set("Location", "/load/"+job.id())
+	writeJSON(w, http.StatusAccepted, job.info())
+}
+
+// deprecatedLoadHandler keeps GET /load starting a load, as it did before
+// loads became jobs; the job list is at GET /jobs
+func deprecatedLoadHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /load is deprecated, use POST /load to start a load (from %s)", r.RemoteAddr)
+	w.Header().Set("Warning", `299 - "GET /load is deprecated, use POST /load; jobs are listed at GET /jobs"`)
+	loadToReindexerHandler(w, r)
 }
 
 func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
@@ -413,6 +511,8 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 	defer rows.Close()
 
 	var productIDs []int64
+	// The extra row fetched by LIMIT count+1 is the next page's first product
+	var nextProductID *int64
 
 	for rows.Next() {
 		var pid int64
@@ -423,6 +523,8 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 
 		if len(productIDs) < count {
 			productIDs = append(productIDs, pid)
+		} else {
+			nextProductID = &pid
 		}
 	}
 
@@ -430,16 +532,6 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 		return nil, fmt.Errorf("error iterating products: %w", err)
 	}
 
-	// Determine next product ID
-	var nextProductID *int64
-	if len(productIDs) > 0 {
-		var nextID sql.NullInt64
-		err = db.QueryRow("SELECT id FROM products WHERE id > ? ORDER BY id LIMIT 1", productIDs[len(productIDs)-1]).Scan(&nextID)
-		if err == nil && nextID.Valid {
-			nextProductID = &nextID.Int64
-		}
-	}
-
 	// If no products found, return empty response
 	if len(productIDs) == 0 {
 		return &ProductIDsResponse{
@@ -449,6 +541,23 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 		}, nil
 	}
 
+	result, err := assembleProductIDs(productIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ProductIDsResponse{
+		ProductIDs:    result,
+		NextProductID: nextProductID,
+		Count:         len(result),
+	}
+
+	return response, nil
+}
+
+// assembleProductIDs collects option and option value IDs for the given products,
+// keeping the order of productIDs
+func assembleProductIDs(productIDs []int64) ([]ProductIDs, error) {
 	// Build placeholders for IN clause
 	placeholders := make([]string, len(productIDs))
 	args := make([]interface{}, len(productIDs))
@@ -457,19 +566,34 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 		args[i] = id
 	}
 
-	// Second query: Get Option IDs and Option Value IDs for these products
-	idsQuery := fmt.Sprintf(`
+	// Second query: Get Option IDs and Option Value IDs for these products.
+	// A SKU is in stock when its count exceeds the active reservations.
+	idsQuery := `
 		SELECT 
 			s.product_id,
 			ov.option_id,
-			ov.id as option_value_id
+			ov.id as option_value_id,
+			s.count - COALESCE(r.reserved, 0) > 0 as in_stock
 		FROM skus s
+		%s
 		LEFT JOIN sku_options so ON s.id = so.sku_id
 		LEFT JOIN option_values ov ON so.option_value_id = ov.id
 		WHERE s.product_id IN (%s)
-		ORDER BY s.product_id`, strings.Join(placeholders, ","))
-
-	idRows, err := db.Query(idsQuery, args...)
+		ORDER BY s.product_id`
+	reservedJoin := `
+		LEFT JOIN (
+			SELECT sku_id, SUM(quantity) AS reserved
+			FROM stock_reservations
+			WHERE expires_at > NOW(3)
+			GROUP BY sku_id
+		) r ON r.sku_id = s.id`
+
+	idRows, err := db.Query(fmt.Sprintf(idsQuery, reservedJoin, strings.Join(placeholders, ",")), args...)
+	if isMissingTable(err) {
+		// stock_reservations is missing until migration 006 runs
+		reservedJoin = "LEFT JOIN (SELECT 0 AS sku_id, 0 AS reserved) r ON FALSE"
+		idRows, err = db.Query(fmt.Sprintf(idsQuery, reservedJoin, strings.Join(placeholders, ",")), args...)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error querying IDs: %w", err)
 	}
@@ -481,21 +605,25 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 	// Initialize map with product IDs
 	for _, pid := range productIDs {
 		productsMap[pid] = &ProductIDs{
-			ProductID:      pid,
-			OptionIDs:      []int64{},
-			OptionValueIDs: []int64{},
+			ProductID:             pid,
+			OptionIDs:             []int64{},
+			OptionValueIDs:        []int64{},
+			InStockOptionValueIDs: []int64{},
+			InStockWarehouseIDs:   []int64{},
 		}
 	}
 
 	// Track unique IDs per product
 	optionIDsMap := make(map[int64]map[int64]bool)
 	optionValueIDsMap := make(map[int64]map[int64]bool)
+	inStockValueIDsMap := make(map[int64]map[int64]bool)
 
 	for idRows.Next() {
 		var productID sql.NullInt64
 		var optionID, optionValueID sql.NullInt64
+		var inStock bool
 
-		err := idRows.Scan(&productID, &optionID, &optionValueID)
+		err := idRows.Scan(&productID, &optionID, &optionValueID, &inStock)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning IDs: %w", err)
 		}
@@ -510,6 +638,7 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 		if optionIDsMap[pid] == nil {
 			optionIDsMap[pid] = make(map[int64]bool)
 			optionValueIDsMap[pid] = make(map[int64]bool)
+			inStockValueIDsMap[pid] = make(map[int64]bool)
 		}
 
 		// Add Option ID
@@ -521,13 +650,21 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 		if optionValueID.Valid && !optionValueIDsMap[pid][optionValueID.Int64] {
 			optionValueIDsMap[pid][optionValueID.Int64] = true
 		}
+
+		// Stock is per SKU, so a product is in stock in a value if any SKU with it is
+		if inStock {
+			productsMap[pid].InStock = true
+			if optionValueID.Valid {
+				inStockValueIDsMap[pid][optionValueID.Int64] = true
+			}
+		}
 	}
 
 	if err = idRows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating IDs: %w", err)
 	}
 
-	// Convert maps to slices
+	// Convert maps to sorted slices, so documents and their hashes are stable
 	for pid, pids := range productsMap {
 		for optionID := range optionIDsMap[pid] {
 			pids.OptionIDs = append(pids.OptionIDs, optionID)
@@ -535,6 +672,18 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 		for optionValueID := range optionValueIDsMap[pid] {
 			pids.OptionValueIDs = append(pids.OptionValueIDs, optionValueID)
 		}
+		for optionValueID := range inStockValueIDsMap[pid] {
+			pids.InStockOptionValueIDs = append(pids.InStockOptionValueIDs, optionValueID)
+		}
+		sort.Slice(pids.OptionIDs, func(i, j int) bool { return pids.OptionIDs[i] < pids.OptionIDs[j] })
+		sort.Slice(pids.OptionValueIDs, func(i, j int) bool { return pids.OptionValueIDs[i] < pids.OptionValueIDs[j] })
+		sort.Slice(pids.InStockOptionValueIDs, func(i, j int) bool {
+			return pids.InStockOptionValueIDs[i] < pids.InStockOptionValueIDs[j]
+		})
+	}
+
+	if err := attachInStockWarehouses(productsMap, placeholders, args, reservedJoin); err != nil {
+		return nil, err
 	}
 
 	// Build response maintaining order
@@ -543,13 +692,41 @@ func productsIds(fromID int64, count int) (*ProductIDsResponse, error) {
 		result = append(result, *productsMap[pid])
 	}
 
-	response := &ProductIDsResponse{
-		ProductIDs:    result,
-		NextProductID: nextProductID,
-		Count:         len(result),
+	return result, nil
+}
+
+// attachInStockWarehouses sets the warehouses holding stock of each product,
+// sorted by ID. Holds are not tied to a warehouse until they are confirmed, so
+// a warehouse counts while it has a quantity of a SKU with unreserved stock.
+func attachInStockWarehouses(productsMap map[int64]*ProductIDs, placeholders []string, args []interface{}, reservedJoin string) error {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT DISTINCT s.product_id, ss.warehouse_id
+		FROM skus s
+		JOIN sku_stocks ss ON ss.sku_id = s.id
+		%s
+		WHERE s.product_id IN (%s) AND ss.quantity > 0 AND s.count - COALESCE(r.reserved, 0) > 0
+		ORDER BY s.product_id, ss.warehouse_id`, reservedJoin, strings.Join(placeholders, ",")), args...)
+	if isMissingTable(err) {
+		return nil
 	}
+	if err != nil {
+		return fmt.Errorf("error querying warehouse stock: %w", err)
+	}
+	defer rows.Close()
 
-	return response, nil
+	for rows.Next() {
+		var productID, warehouseID int64
+		if err := rows.Scan(&productID, &warehouseID); err != nil {
+			return fmt.Errorf("error scanning warehouse stock: %w", err)
+		}
+		if pids, ok := productsMap[productID]; ok {
+			pids.InStockWarehouseIDs = append(pids.InStockWarehouseIDs, warehouseID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating warehouse stock: %w", err)
+	}
+	return nil
 }
 
 func productsIdsHandler(w http.ResponseWriter, r *http.Request) {
@@ -630,7 +807,7 @@ func productsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get products
-	response, err := getProducts(fromID, count)
+	response, err := getProducts(fromID, count, nil)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		log.Printf("Error getting products: %v", err)
@@ -673,15 +850,110 @@ func main() {
 			defer rx.Close()
 
 			// Run load function
-			if err := loadToReindexer(); err != nil {
+			if err := runLoad("cli"); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "verify":
+			// Initialize connections
+			if err := initDB(); err != nil {
+				log.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := initReindexer(); err != nil {
+				log.Fatal(err)
+			}
+			defer rx.Close()
+
+			// Compare MySQL with Reindexer
+			if err := runVerify(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "import":
+			// Initialize connections
+			if err := initDB(); err != nil {
+				log.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := initReindexer(); err != nil {
+				log.Fatal(err)
+			}
+			defer rx.Close()
+
+			// Write CSV/JSONL rows to MySQL and reindex the touched products
+			if err := runImport(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "commerceml":
+			// Initialize connections
+			if err := initDB(); err != nil {
+				log.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := initReindexer(); err != nil {
+				log.Fatal(err)
+			}
+			defer rx.Close()
+
+			// Apply 1C import.xml/offers.xml files in the given order
+			if err := runCommerceML(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "feed":
+			if err := initDB(); err != nil {
+				log.Fatal(err)
+			}
+			defer db.Close()
+
+			// Render a marketplace feed to stdout or atomically to -o FILE
+			if err := runFeed(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "sitemap":
+			if err := initDB(); err != nil {
+				log.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := initReindexer(); err != nil {
+				log.Fatal(err)
+			}
+			defer rx.Close()
+
+			// Write sitemap.xml and its shards for products and filter pages
+			if err := runSitemap(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "migrate":
+			if err := initDB(); err != nil {
+				log.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := runMigrations(); err != nil {
 				log.Fatal(err)
 			}
 			return
 		case "help":
 			fmt.Println("Available commands:")
-			fmt.Println("  load    - Load products from MySQL to Reindexer")
-			fmt.Println("  help    - Show this help message")
+			fmt.Println("  load       - Load products from MySQL to Reindexer")
+			fmt.Println("  verify     - Compare MySQL with Reindexer (-repair to fix differences)")
+			fmt.Println("  import     - Import products, SKUs and options from CSV or JSONL (-dry-run to preview)")
+			fmt.Println("  commerceml - Import CommerceML files from 1C (import.xml before offers.xml)")
+			fmt.Println("  feed       - Write a marketplace feed (feed [-o FILE] yml|google|google-tsv)")
+			fmt.Println("  sitemap    - Write sitemap.xml with product and filter page shards")
+			fmt.Println("  migrate    - Apply sync-service database migrations")
+			fmt.Println("  help       - Show this help message")
 			fmt.Println("\nRun without arguments to start HTTP server")
+			fmt.Println("Set SYNC_MODE=binlog or SYNC_MODE=outbox to reindex changed products continuously")
 			return
 		default:
 			fmt.Printf("Unknown command: %s\n", os.Args[1])
@@ -696,6 +968,12 @@ func main() {
 	}
 	defer db.Close()
 
+	if getEnv("MIGRATE_ON_START", "true") == "true" {
+		if err := runMigrations(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Initialize Reindexer
 	if err := initReindexer(); err != nil {
 		log.Fatal(err)
@@ -705,9 +983,72 @@ func main() {
 	http.HandleFunc("/", handler)
 	http.HandleFunc("/products", productsHandler)
 	http.HandleFunc("/products/ids", productsIdsHandler)
-	http.HandleFunc("/load", loadToReindexerHandler)
+	http.HandleFunc("GET /export", exportHandler)
+	http.HandleFunc("POST /load", loadToReindexerHandler)
+	http.HandleFunc("GET /load", deprecatedLoadHandler)
+	http.HandleFunc("GET /load/{id}", loadJobHandler)
+	http.HandleFunc("DELETE /load/{id}", cancelLoadJobHandler)
+	http.HandleFunc("GET /jobs", loadJobsHandler)
+	http.HandleFunc("GET /jobs/{id}", loadJobHandler)
+	http.HandleFunc("DELETE /jobs/{id}", cancelLoadJobHandler)
+	http.HandleFunc("POST /reindex", reindexHandler)
+	http.HandleFunc("GET /dead-letters", deadLettersHandler)
+	http.HandleFunc("POST /dead-letters/retry", retryDeadLettersHandler)
+	http.HandleFunc("DELETE /dead-letters", purgeDeadLettersHandler)
+	http.HandleFunc("DELETE /dead-letters/{id}", purgeDeadLetterHandler)
+	http.HandleFunc("GET /freshness", freshnessHandler)
+	http.HandleFunc("GET /feed/{format}", feedHandler)
+	http.HandleFunc("GET /products/{id}/jsonld", productJSONLDHandler)
+	http.HandleFunc("POST /products", createProductHandler)
+	http.HandleFunc("/products/{id}", productHandler)
+	http.HandleFunc("POST /products/{id}/skus", createSKUHandler)
+	http.HandleFunc("GET /skus/{id}", getSKUHandler)
+	http.HandleFunc("PATCH /skus/{id}", updateSKUHandler)
+	http.HandleFunc("DELETE /skus/{id}", deleteSKUHandler)
+	http.HandleFunc("PUT /skus/{id}/options", replaceSKUOptionsHandler)
+	http.HandleFunc("PATCH /skus/{id}/stock", updateStockHandler)
+	http.HandleFunc("PATCH /stock", bulkStockHandler)
+	http.HandleFunc("GET /warehouses", listWarehousesHandler)
+	http.HandleFunc("POST /warehouses", createWarehouseHandler)
+	http.HandleFunc("PATCH /warehouses/{id}", updateWarehouseHandler)
+	http.HandleFunc("DELETE /warehouses/{id}", deleteWarehouseHandler)
+	http.HandleFunc("GET /carts/{cart}/reservations", getReservationsHandler)
+	http.HandleFunc("POST /carts/{cart}/reservations", reserveHandler)
+	http.HandleFunc("POST /carts/{cart}/reservations/confirm", confirmReservationsHandler)
+	http.HandleFunc("DELETE /carts/{cart}/reservations", releaseReservationsHandler)
+	http.HandleFunc("GET /options", listOptionsHandler)
+	http.HandleFunc("POST /options", createOptionHandler)
+	http.HandleFunc("PUT /options/order", reorderOptionsHandler)
+	http.HandleFunc("PATCH /options/{id}", updateOptionHandler)
+	http.HandleFunc("DELETE /options/{id}", deleteOptionHandler)
+	http.HandleFunc("GET /options/{id}/impact", optionImpactHandler)
+	http.HandleFunc("POST /options/{id}/merge", mergeOptionHandler)
+	http.HandleFunc("POST /options/{id}/values", createValueHandler)
+	http.HandleFunc("PUT /options/{id}/values/order", reorderValuesHandler)
+	http.HandleFunc("PATCH /option-values/{id}", updateValueHandler)
+	http.HandleFunc("DELETE /option-values/{id}", deleteValueHandler)
+	http.HandleFunc("GET /option-values/{id}/impact", valueImpactHandler)
+	http.HandleFunc("POST /option-values/{id}/merge", mergeValueHandler)
+	http.HandleFunc("/1c_exchange", commerceMLExchangeHandler)
 	http.HandleFunc("/health", healthHandler)
 
+	// Optionally keep the index up to date from the binlog or the outbox
+	syncMode := getEnv("SYNC_MODE", "")
+	switch syncMode {
+	case "binlog":
+		go runBinlogSync()
+	case "outbox":
+		go runOutboxSync()
+	}
+	go runOutboxPruner(syncMode == "outbox")
+	go runDeadLetterRetry()
+	go runReservationSweeper()
+
+	// Optionally run full loads on a cron schedule
+	if schedule := getEnv("LOAD_SCHEDULE", ""); schedule != "" {
+		go runScheduledLoads(schedule)
+	}
+
 	port := ":8085"
 	log.Printf("Starting server on port %s", port)
 
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAttachSKUsGroupsOptions(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery(`SELECT\s+s.id,\s+s.product_id,\s+s.count`).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "count", "barcode", "created_at", "updated_at"}).
+			AddRow(10, 1, 5, "4600", "2025-01-01", "2025-01-02").
+			AddRow(11, 1, 5, nil, "2025-01-01", "2025-01-02").
+			AddRow(20, 2, 0, nil, "2025-01-01", "2025-01-02"))
+	// "S|M" is a value of both options; a separator-joined aggregate would
+	// split it and pair the range end with the wrong value
+	mock.ExpectQuery(`SELECT\s+so.sku_id,\s+o.id`).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"sku_id", "option_id", "name", "display_name", "value_id", "value", "is_range", "end_value"}).
+			AddRow(10, 1, "size", "Size", 5, "S|M", true, "L|XL").
+			AddRow(10, 2, "label", nil, 7, "S|M", false, nil).
+			AddRow(11, 1, "size", "Size", 6, "M", false, nil).
+			AddRow(20, 2, "label", nil, 7, "S|M", false, nil).
+			// Added after the SKUs were read
+			AddRow(21, 2, "label", nil, 7, "S|M", false, nil))
+	mock.ExpectQuery(`SELECT ss.sku_id, w.id, w.code, ss.quantity`).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"sku_id", "warehouse_id", "code", "quantity"}))
+	mock.ExpectQuery(`SELECT r.sku_id, SUM\(r.quantity\)`).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"sku_id", "reserved"}).AddRow(11, 2))
+
+	products := []Product{{ID: 1}, {ID: 2}}
+	if err := attachSKUs(products); err != nil {
+		t.Fatal(err)
+	}
+
+	barcode, rangeEnd := "4600", "L|XL"
+	size := func(valueID, value string, end *string) SKUOption {
+		return SKUOption{OptionId: "1", OptionName: "size", OptionDisplayName: "Size", ValueId: valueID, Value: value,
+			IsRange: end != nil, RangeEndValue: end}
+	}
+	label := SKUOption{OptionId: "2", OptionName: "label", ValueId: "7", Value: "S|M"}
+	want := [][]SKU{
+		{
+			{ID: 10, ProductID: 1, Count: 5, Available: 5, Barcode: &barcode, CreatedAt: "2025-01-01", UpdatedAt: "2025-01-02",
+				Options: []SKUOption{size("5", "S|M", &rangeEnd), label}},
+			{ID: 11, ProductID: 1, Count: 5, Reserved: 2, Available: 3, CreatedAt: "2025-01-01", UpdatedAt: "2025-01-02",
+				Options: []SKUOption{size("6", "M", nil)}},
+		},
+		{
+			{ID: 20, ProductID: 2, CreatedAt: "2025-01-01", UpdatedAt: "2025-01-02", Options: []SKUOption{label}},
+		},
+	}
+	for i := range products {
+		if !reflect.DeepEqual(products[i].SKUs, want[i]) {
+			t.Errorf("product %d SKUs = %+v, want %+v", products[i].ID, products[i].SKUs, want[i])
+		}
+	}
+}
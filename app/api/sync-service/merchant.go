@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Google Merchant Center feed, as RSS 2.0 with the g: namespace or as TSV.
+// Every SKU is an item; SKUs of a product are grouped with item_group_id set
+// to the product ID. Options become Merchant attributes through
+// FEED_GOOGLE_ATTRIBUTES, a comma separated list of option=attribute pairs.
+
+const googleNamespace = "http://base.google.com/ns/1.0"
+
+// googleAttributes are the variant attributes Merchant Center accepts
+var googleAttributes = map[string]bool{
+	"color":     true,
+	"size":      true,
+	"material":  true,
+	"pattern":   true,
+	"gender":    true,
+	"age_group": true,
+}
+
+// googleCurrencies maps the YML currency codes that differ from ISO 4217
+var googleCurrencies = map[string]string{
+	"RUR": "RUB",
+}
+
+// parseGoogleAttributes parses FEED_GOOGLE_ATTRIBUTES into option name ->
+// Merchant attribute
+func parseGoogleAttributes(spec string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		option, attribute, ok := strings.Cut(pair, "=")
+		option, attribute = strings.TrimSpace(option), strings.TrimSpace(attribute)
+		if !ok || option == "" {
+			return nil, fmt.Errorf("invalid FEED_GOOGLE_ATTRIBUTES entry %q, expected option=attribute", pair)
+		}
+		if !googleAttributes[attribute] {
+			return nil, fmt.Errorf("unsupported Merchant attribute %q in FEED_GOOGLE_ATTRIBUTES", attribute)
+		}
+		mapping[option] = attribute
+	}
+	return mapping, nil
+}
+
+type googleItem struct {
+	ID               string
+	ItemGroupID      string
+	Title            string
+	Link             string
+	Price            string
+	Availability     string
+	GTIN             string
+	MPN              string
+	IdentifierExists string
+	Attributes       map[string]string
+}
+
+// googleItems builds the items of a product, skipping SKUs without a price
+func googleItems(product *Product, config *feedConfig, mapping map[string]string) []googleItem {
+	currency := config.Currency
+	if iso, ok := googleCurrencies[currency]; ok {
+		currency = iso
+	}
+
+	var items []googleItem
+	for i := range product.SKUs {
+		sku := &product.SKUs[i]
+		price, ok := config.skuPrice(sku)
+		if !ok {
+			continue
+		}
+
+		item := googleItem{
+			ID:           strconv.FormatInt(sku.ID, 10),
+			ItemGroupID:  strconv.FormatInt(product.ID, 10),
+			Title:        product.Name,
+			Link:         config.productURL(product),
+			Price:        price + " " + currency,
+			Availability: "out_of_stock",
+			MPN:          product.Article,
+			Attributes:   make(map[string]string),
+		}
+		if sku.Available > 0 {
+			item.Availability = "in_stock"
+		}
+		if sku.Barcode != nil && *sku.Barcode != "" {
+			item.GTIN = *sku.Barcode
+		} else if item.MPN == "" {
+			item.IdentifierExists = "no"
+		}
+
+		for j := range sku.Options {
+			option := &sku.Options[j]
+			if attribute, ok := mapping[option.OptionName]; ok {
+				item.Attributes[attribute] = optionValue(option)
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// sortedAttributes returns the attribute names of the mapping in stable order
+func sortedAttributes(mapping map[string]string) []string {
+	seen := make(map[string]bool)
+	var attributes []string
+	for _, attribute := range mapping {
+		if !seen[attribute] {
+			seen[attribute] = true
+			attributes = append(attributes, attribute)
+		}
+	}
+	sort.Strings(attributes)
+	return attributes
+}
+
+// encodeGoogleItem writes one RSS item, leaving out empty fields
+func encodeGoogleItem(encoder *xml.Encoder, item *googleItem, attributes []string) error {
+	start := xml.StartElement{Name: xml.Name{Local: "item"}}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	fields := [][2]string{
+		{"g:id", item.ID},
+		{"g:item_group_id", item.ItemGroupID},
+		{"title", item.Title},
+		{"description", item.Title},
+		{"link", item.Link},
+		{"g:price", item.Price},
+		{"g:availability", item.Availability},
+		{"g:condition", "new"},
+		{"g:gtin", item.GTIN},
+		{"g:mpn", item.MPN},
+		{"g:identifier_exists", item.IdentifierExists},
+	}
+	for _, attribute := range attributes {
+		fields = append(fields, [2]string{"g:" + attribute, item.Attributes[attribute]})
+	}
+
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		if err := encoder.EncodeElement(field[1], xml.StartElement{Name: xml.Name{Local: field[0]}}); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+// writeGoogleFeed renders the catalog as a Merchant Center RSS 2.0 feed
+func writeGoogleFeed(ctx context.Context, w io.Writer, config *feedConfig) (int, error) {
+	mapping, err := parseGoogleAttributes(config.GoogleAttributes)
+	if err != nil {
+		return 0, err
+	}
+	attributes := sortedAttributes(mapping)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return 0, err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	// encoding/xml does not emit prefixed names, so g: is spelled out
+	rss := xml.StartElement{
+		Name: xml.Name{Local: "rss"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "version"}, Value: "2.0"},
+			{Name: xml.Name{Local: "xmlns:g"}, Value: googleNamespace},
+		},
+	}
+	channel := xml.StartElement{Name: xml.Name{Local: "channel"}}
+	if err := encoder.EncodeToken(rss); err != nil {
+		return 0, err
+	}
+	if err := encoder.EncodeToken(channel); err != nil {
+		return 0, err
+	}
+	header := [][2]string{
+		{"title", config.ShopName},
+		{"link", config.ShopURL},
+		{"description", config.ShopName + " catalog"},
+	}
+	for _, field := range header {
+		if err := encoder.EncodeElement(field[1], xml.StartElement{Name: xml.Name{Local: field[0]}}); err != nil {
+			return 0, err
+		}
+	}
+
+	offers := 0
+	err = walkProducts(ctx, config.BatchSize, func(product *Product) error {
+		for _, item := range googleItems(product, config, mapping) {
+			if err := encodeGoogleItem(encoder, &item, attributes); err != nil {
+				return err
+			}
+			offers++
+		}
+		return encoder.Flush()
+	})
+	if err != nil {
+		return offers, err
+	}
+
+	for _, end := range []xml.EndElement{channel.End(), rss.End()} {
+		if err := encoder.EncodeToken(end); err != nil {
+			return offers, err
+		}
+	}
+	return offers, encoder.Flush()
+}
+
+// tsvField replaces the characters a TSV cell cannot hold; Merchant Center
+// TSV has no quoting
+var tsvField = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+// writeTSVRecord writes one TSV line
+func writeTSVRecord(w io.Writer, record []string) error {
+	cells := make([]string, len(record))
+	for i, cell := range record {
+		cells[i] = tsvField.Replace(cell)
+	}
+	_, err := io.WriteString(w, strings.Join(cells, "\t")+"\n")
+	return err
+}
+
+// writeGoogleTSV renders the catalog as a Merchant Center TSV feed
+func writeGoogleTSV(ctx context.Context, w io.Writer, config *feedConfig) (int, error) {
+	mapping, err := parseGoogleAttributes(config.GoogleAttributes)
+	if err != nil {
+		return 0, err
+	}
+	attributes := sortedAttributes(mapping)
+
+	header := []string{"id", "item_group_id", "title", "description", "link", "price", "availability",
+		"condition", "gtin", "mpn", "identifier_exists"}
+	header = append(header, attributes...)
+	if err := writeTSVRecord(w, header); err != nil {
+		return 0, err
+	}
+
+	offers := 0
+	err = walkProducts(ctx, config.BatchSize, func(product *Product) error {
+		for _, item := range googleItems(product, config, mapping) {
+			record := []string{item.ID, item.ItemGroupID, item.Title, item.Title, item.Link, item.Price,
+				item.Availability, "new", item.GTIN, item.MPN, item.IdentifierExists}
+			for _, attribute := range attributes {
+				record = append(record, item.Attributes[attribute])
+			}
+			if err := writeTSVRecord(w, record); err != nil {
+				return err
+			}
+			offers++
+		}
+		return nil
+	})
+	return offers, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGoogleAttributes(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"color=color,size=size", map[string]string{"color": "color", "size": "size"}, false},
+		{" colour = color , , fabric=material ", map[string]string{"colour": "color", "fabric": "material"}, false},
+		{"color=color,tint=color", map[string]string{"color": "color", "tint": "color"}, false},
+		{"color", nil, true},
+		{"=color", nil, true},
+		{"color=colour", nil, true},
+		{"brand=brand", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseGoogleAttributes(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGoogleAttributes(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseGoogleAttributes(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestSortedAttributes(t *testing.T) {
+	got := sortedAttributes(map[string]string{"tint": "color", "size": "size", "color": "color"})
+	if want := []string{"color", "size"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortedAttributes = %v, want %v", got, want)
+	}
+}
+
+func TestGoogleItems(t *testing.T) {
+	product := testProduct()
+	product.SKUs[2].Options = append(product.SKUs[2].Options, option("color", "Color", "Black"))
+	product.Article = ""
+
+	items := googleItems(product, testFeedConfig(), map[string]string{"color": "color", "size": "size"})
+	if len(items) != 2 {
+		t.Fatalf("got %d items, want the 2 priced SKUs", len(items))
+	}
+
+	first := items[0]
+	if first.ID != "70" || first.ItemGroupID != "7" || first.Price != "1299.5 RUB" ||
+		first.Availability != "in_stock" || first.GTIN != "4600000000001" || first.IdentifierExists != "" {
+		t.Errorf("first item = %+v", first)
+	}
+	if want := map[string]string{"color": "Red & Blue", "size": "40-44"}; !reflect.DeepEqual(first.Attributes, want) {
+		t.Errorf("attributes = %v, want %v", first.Attributes, want)
+	}
+
+	// Neither barcode nor article
+	second := items[1]
+	if second.Availability != "out_of_stock" || second.GTIN != "" || second.IdentifierExists != "no" {
+		t.Errorf("second item = %+v", second)
+	}
+}
+
+func TestEncodeGoogleItem(t *testing.T) {
+	items := googleItems(testProduct(), testFeedConfig(), map[string]string{"color": "color", "size": "size"})
+
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+	if err := encodeGoogleItem(encoder, &items[0], []string{"color", "size"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		`<g:id>70</g:id>`,
+		`<title>Shirt &#34;Tom &amp; Jerry&#34; &lt;kids&gt;</title>`,
+		`<g:color>Red &amp; Blue</g:color>`,
+		`<g:size>40-44</g:size>`,
+		`<g:condition>new</g:condition>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("item XML lacks %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "identifier_exists") {
+		t.Errorf("empty fields must be left out:\n%s", out)
+	}
+}
+
+func TestWriteTSVRecord(t *testing.T) {
+	var buf bytes.Buffer
+	record := []string{"70", "Shirt\twith\ttabs", "line\r\nbreak", `"quoted", & <kept>`, ""}
+	if err := writeTSVRecord(&buf, record); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "70\tShirt with tabs\tline  break\t\"quoted\", & <kept>\t\n"
+	if got := buf.String(); got != want {
+		t.Errorf("record = %q, want %q", got, want)
+	}
+	if record[1] != "Shirt\twith\ttabs" {
+		t.Error("writeTSVRecord must not modify the record")
+	}
+}
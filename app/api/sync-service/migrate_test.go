@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- comment
+CREATE TABLE t (
+    id INT -- trailing comments stay
+);
+
+DROP TRIGGER IF EXISTS t_insert;
+CREATE TRIGGER t_insert BEFORE INSERT ON t FOR EACH ROW
+    SET NEW.id = IF(NEW.id < 0,
+        0, NEW.id);
+SELECT 1`
+
+	got := splitStatements(script)
+	want := []string{
+		"CREATE TABLE t (\n    id INT -- trailing comments stay\n)",
+		"DROP TRIGGER IF EXISTS t_insert",
+		"CREATE TRIGGER t_insert BEFORE INSERT ON t FOR EACH ROW\n    SET NEW.id = IF(NEW.id < 0,\n        0, NEW.id)",
+		"SELECT 1",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("splitStatements() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// Triggers are created with one statement each, there is no DELIMITER support
+func TestMigrationTriggersAreSingleStatements(t *testing.T) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		script, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, statement := range splitStatements(string(script)) {
+			upper := strings.ToUpper(statement)
+			if strings.HasPrefix(upper, "CREATE TRIGGER") && strings.Contains(upper, "BEGIN") {
+				t.Errorf("%s: trigger with a BEGIN block: %s", entry.Name(), statement)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+-- Outbox of catalog changes, filled by triggers and consumed by sync-service.
+-- Rows are acked by setting processed_at and pruned after OUTBOX_RETENTION.
+-- Triggers do not fire for foreign key cascades or TRUNCATE: deleting a product
+-- or SKU is still recorded by its own trigger, cascaded sku_options are not.
+CREATE TABLE IF NOT EXISTS catalog_outbox (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    entity VARCHAR(32) NOT NULL,
+    entity_id BIGINT NOT NULL,
+    product_id BIGINT DEFAULT NULL,
+    operation ENUM('insert', 'update', 'delete') NOT NULL,
+    created_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    processed_at TIMESTAMP(3) NULL DEFAULT NULL,
+    INDEX idx_processed_at (processed_at, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- products
+DROP TRIGGER IF EXISTS products_outbox_insert;
+CREATE TRIGGER products_outbox_insert AFTER INSERT ON products FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('products', NEW.id, NEW.id, 'insert');
+
+DROP TRIGGER IF EXISTS products_outbox_update;
+CREATE TRIGGER products_outbox_update AFTER UPDATE ON products FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('products', NEW.id, NEW.id, 'update');
+
+DROP TRIGGER IF EXISTS products_outbox_delete;
+CREATE TRIGGER products_outbox_delete AFTER DELETE ON products FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('products', OLD.id, OLD.id, 'delete');
+
+-- skus: an update may move the SKU to another product, so both are recorded
+DROP TRIGGER IF EXISTS skus_outbox_insert;
+CREATE TRIGGER skus_outbox_insert AFTER INSERT ON skus FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('skus', NEW.id, NEW.product_id, 'insert');
+
+DROP TRIGGER IF EXISTS skus_outbox_update;
+CREATE TRIGGER skus_outbox_update AFTER UPDATE ON skus FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('skus', NEW.id, NEW.product_id, 'update'), ('skus', OLD.id, OLD.product_id, 'update');
+
+DROP TRIGGER IF EXISTS skus_outbox_delete;
+CREATE TRIGGER skus_outbox_delete AFTER DELETE ON skus FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('skus', OLD.id, OLD.product_id, 'delete');
+
+-- sku_options: entity_id is the SKU
+DROP TRIGGER IF EXISTS sku_options_outbox_insert;
+CREATE TRIGGER sku_options_outbox_insert AFTER INSERT ON sku_options FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('sku_options', NEW.sku_id, (SELECT product_id FROM skus WHERE id = NEW.sku_id), 'insert');
+
+DROP TRIGGER IF EXISTS sku_options_outbox_update;
+CREATE TRIGGER sku_options_outbox_update AFTER UPDATE ON sku_options FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('sku_options', NEW.sku_id, (SELECT product_id FROM skus WHERE id = NEW.sku_id), 'update'),
+           ('sku_options', OLD.sku_id, (SELECT product_id FROM skus WHERE id = OLD.sku_id), 'update');
+
+DROP TRIGGER IF EXISTS sku_options_outbox_delete;
+CREATE TRIGGER sku_options_outbox_delete AFTER DELETE ON sku_options FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, product_id, operation)
+    VALUES ('sku_options', OLD.sku_id, (SELECT product_id FROM skus WHERE id = OLD.sku_id), 'delete');
+
+-- option_values: products are resolved by the consumer
+DROP TRIGGER IF EXISTS option_values_outbox_update;
+CREATE TRIGGER option_values_outbox_update AFTER UPDATE ON option_values FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, operation)
+    VALUES ('option_values', NEW.id, 'update');
+
+DROP TRIGGER IF EXISTS option_values_outbox_delete;
+CREATE TRIGGER option_values_outbox_delete AFTER DELETE ON option_values FOR EACH ROW
+    INSERT INTO catalog_outbox (entity, entity_id, operation)
+    VALUES ('option_values', OLD.id, 'delete');
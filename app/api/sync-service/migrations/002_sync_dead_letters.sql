@@ -0,0 +1,11 @@
+-- Products whose Reindexer write failed, retried with exponential backoff.
+-- A row is deleted as soon as the product is written successfully.
+CREATE TABLE IF NOT EXISTS sync_dead_letters (
+    product_id BIGINT PRIMARY KEY,
+    error TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 1,
+    first_failed_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    last_failed_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    next_retry_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    INDEX idx_next_retry_at (next_retry_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,18 @@
+-- CommerceML (1C) exchange: maps 1C identifiers to local rows and keeps the
+-- product-level property values that are applied to every SKU of a product.
+CREATE TABLE IF NOT EXISTS commerceml_ids (
+    entity ENUM('product', 'sku') NOT NULL,
+    external_id VARCHAR(100) NOT NULL,
+    local_id BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (entity, external_id),
+    INDEX idx_local_id (entity, local_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS commerceml_product_options (
+    product_id BIGINT NOT NULL,
+    option_value_id BIGINT NOT NULL,
+    PRIMARY KEY (product_id, option_value_id),
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+    FOREIGN KEY (option_value_id) REFERENCES option_values(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
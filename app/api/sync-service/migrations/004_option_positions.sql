@@ -0,0 +1,21 @@
+-- Display order of options and their values, set through the option
+-- management API. Ties fall back to the ID. MySQL has no ADD COLUMN IF NOT
+-- EXISTS, so each column is only added when information_schema lacks it and
+-- the migration can be re-run after a partial failure.
+SET @sql = IF(
+    (SELECT COUNT(*) FROM information_schema.COLUMNS
+     WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'options' AND COLUMN_NAME = 'position') = 0,
+    'ALTER TABLE options ADD COLUMN position INT NOT NULL DEFAULT 0',
+    'DO 0');
+PREPARE add_position FROM @sql;
+EXECUTE add_position;
+DEALLOCATE PREPARE add_position;
+
+SET @sql = IF(
+    (SELECT COUNT(*) FROM information_schema.COLUMNS
+     WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'option_values' AND COLUMN_NAME = 'position') = 0,
+    'ALTER TABLE option_values ADD COLUMN position INT NOT NULL DEFAULT 0',
+    'DO 0');
+PREPARE add_position FROM @sql;
+EXECUTE add_position;
+DEALLOCATE PREPARE add_position;
@@ -0,0 +1,40 @@
+-- Warehouses and per-warehouse SKU quantities. Once a SKU has rows in
+-- sku_stocks, skus.count is their total, kept by the triggers below; SKUs
+-- without rows keep a plain count. The skus update fired by the triggers also
+-- records the change in catalog_outbox. Foreign key cascades do not fire
+-- triggers, so warehouses are deleted through the API, which clears
+-- sku_stocks first.
+CREATE TABLE IF NOT EXISTS warehouses (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    code VARCHAR(50) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_code (code)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS sku_stocks (
+    sku_id BIGINT NOT NULL,
+    warehouse_id BIGINT NOT NULL,
+    quantity INT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (sku_id, warehouse_id),
+    INDEX idx_warehouse_id (warehouse_id),
+    FOREIGN KEY (sku_id) REFERENCES skus(id) ON DELETE CASCADE,
+    FOREIGN KEY (warehouse_id) REFERENCES warehouses(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+DROP TRIGGER IF EXISTS sku_stocks_total_insert;
+CREATE TRIGGER sku_stocks_total_insert AFTER INSERT ON sku_stocks FOR EACH ROW
+    UPDATE skus SET count = (SELECT COALESCE(SUM(quantity), 0) FROM sku_stocks WHERE sku_id = NEW.sku_id)
+    WHERE id = NEW.sku_id;
+
+DROP TRIGGER IF EXISTS sku_stocks_total_update;
+CREATE TRIGGER sku_stocks_total_update AFTER UPDATE ON sku_stocks FOR EACH ROW
+    UPDATE skus SET count = (SELECT COALESCE(SUM(ss.quantity), 0) FROM sku_stocks ss WHERE ss.sku_id = skus.id)
+    WHERE id IN (NEW.sku_id, OLD.sku_id);
+
+DROP TRIGGER IF EXISTS sku_stocks_total_delete;
+CREATE TRIGGER sku_stocks_total_delete AFTER DELETE ON sku_stocks FOR EACH ROW
+    UPDATE skus SET count = (SELECT COALESCE(SUM(quantity), 0) FROM sku_stocks WHERE sku_id = OLD.sku_id)
+    WHERE id = OLD.sku_id;
@@ -0,0 +1,17 @@
+-- Checkout holds on SKU stock. A hold is active until expires_at; confirming
+-- it subtracts the quantity from the stock and releasing it drops the row.
+-- Expired rows are swept by sync-service. Available stock is skus.count minus
+-- the active holds.
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    cart_id VARCHAR(100) NOT NULL,
+    sku_id BIGINT NOT NULL,
+    quantity INT NOT NULL,
+    expires_at TIMESTAMP(3) NOT NULL,
+    created_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    updated_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3) ON UPDATE CURRENT_TIMESTAMP(3),
+    UNIQUE KEY uniq_cart_sku (cart_id, sku_id),
+    INDEX idx_sku_expires_at (sku_id, expires_at),
+    INDEX idx_expires_at (expires_at),
+    FOREIGN KEY (sku_id) REFERENCES skus(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
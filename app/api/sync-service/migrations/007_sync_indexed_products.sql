@@ -0,0 +1,9 @@
+-- Products reindexed right after a write through the sync-service API, with
+-- the time the reindex read them. Without continuous sync, /freshness counts
+-- catalog rows updated since the last load as pending unless their product
+-- was indexed after the update. One row per product, so the table stays
+-- bounded by the catalog size.
+CREATE TABLE IF NOT EXISTS sync_indexed_products (
+    product_id BIGINT PRIMARY KEY,
+    indexed_at TIMESTAMP(3) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,10 @@
+-- Keeps skus.count derived for SKUs with per-warehouse quantities. Writers
+-- that set the count directly (the admin, scripts, older importers) are
+-- overridden with the sku_stocks total instead of drifting from it; SKUs
+-- without sku_stocks rows keep whatever count is written. The sku_stocks
+-- triggers of migration 005 update skus with the same total, so this only
+-- reads sku_stocks and never writes it.
+DROP TRIGGER IF EXISTS skus_count_derived;
+CREATE TRIGGER skus_count_derived BEFORE UPDATE ON skus FOR EACH ROW
+    SET NEW.count = IF(EXISTS(SELECT 1 FROM sku_stocks WHERE sku_id = NEW.id),
+        (SELECT COALESCE(SUM(quantity), 0) FROM sku_stocks WHERE sku_id = NEW.id), NEW.count);
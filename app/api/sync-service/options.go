@@ -0,0 +1,890 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Option and option value management. Deleting an option or value cascades
+// through sku_options, so a delete that would touch SKUs is refused with the
+// impact counts unless it is repeated with ?confirm=true; the same counts are
+// available beforehand from .../impact. A merge repoints sku_options (range
+// ends included) from one value to another and removes the merged value.
+// Every change reindexes the products using the values involved.
+//
+//	GET    /options
+//	POST   /options                     {"name", "display_name"?}
+//	PATCH  /options/{id}                {"name"?, "display_name"?}
+//	PUT    /options/order               {"ids": [...]}
+//	GET    /options/{id}/impact
+//	DELETE /options/{id}[?confirm=true]
+//	POST   /options/{id}/merge          {"into": id}
+//	POST   /options/{id}/values         {"value", "numeric_value"?, "step"?}
+//	PUT    /options/{id}/values/order   {"ids": [...]}
+//	PATCH  /option-values/{id}          {"value"?, "numeric_value"?, "step"?}
+//	GET    /option-values/{id}/impact
+//	DELETE /option-values/{id}[?confirm=true]
+//	POST   /option-values/{id}/merge    {"into": id}
+
+type optionValueInfo struct {
+	ID           int64    `json:"id"`
+	Value        string   `json:"value"`
+	NumericValue *float64 `json:"numeric_value"`
+	Step         *float64 `json:"step"`
+	Position     int      `json:"position"`
+}
+
+type optionInfo struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	DisplayName string            `json:"display_name"`
+	Position    int               `json:"position"`
+	Values      []optionValueInfo `json:"values"`
+}
+
+// optionImpact counts what a delete or merge touches
+type optionImpact struct {
+	Values     int `json:"values"`
+	SKUOptions int `json:"sku_options"`
+	SKUs       int `json:"skus"`
+	Products   int `json:"products"`
+	Params     int `json:"params"`
+}
+
+func (i *optionImpact) empty() bool {
+	return i.SKUOptions == 0 && i.Params == 0
+}
+
+// readOptions returns options with their values in display order
+func readOptions(ctx context.Context, optionID int64) ([]optionInfo, error) {
+	filter, args := "", []interface{}{}
+	if optionID > 0 {
+		filter, args = "WHERE o.id = ?", append(args, optionID)
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT o.id, o.name, o.display_name, o.position,
+			ov.id, ov.value, ov.numeric_value, ov.step, ov.position
+		FROM options o
+		LEFT JOIN option_values ov ON ov.option_id = o.id
+		%s
+		ORDER BY o.position, o.id, ov.position, ov.id`, filter), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying options: %w", err)
+	}
+	defer rows.Close()
+
+	options := []optionInfo{}
+	for rows.Next() {
+		var option optionInfo
+		var valueID sql.NullInt64
+		var value sql.NullString
+		var numeric, step sql.NullFloat64
+		var position sql.NullInt64
+		err := rows.Scan(&option.ID, &option.Name, &option.DisplayName, &option.Position,
+			&valueID, &value, &numeric, &step, &position)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning option: %w", err)
+		}
+
+		if len(options) == 0 || options[len(options)-1].ID != option.ID {
+			option.Values = []optionValueInfo{}
+			options = append(options, option)
+		}
+		if !valueID.Valid {
+			continue
+		}
+
+		info := optionValueInfo{ID: valueID.Int64, Value: value.String, Position: int(position.Int64)}
+		if numeric.Valid {
+			info.NumericValue = &numeric.Float64
+		}
+		if step.Valid {
+			info.Step = &step.Float64
+		}
+		last := &options[len(options)-1]
+		last.Values = append(last.Values, info)
+	}
+	return options, rows.Err()
+}
+
+func readOption(ctx context.Context, id int64) (*optionInfo, error) {
+	options, err := readOptions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(options) == 0 {
+		return nil, notFound("option %d not found", id)
+	}
+	return &options[0], nil
+}
+
+// optionValueIDs returns the values of an option
+func optionValueIDs(ctx context.Context, q queryer, optionID int64) ([]int64, error) {
+	return queryIDs(ctx, q, `SELECT id FROM option_values WHERE option_id IN (%s)`, 1, []int64{optionID})
+}
+
+// valueOption returns the option of a value
+func valueOption(ctx context.Context, q queryer, valueID int64) (int64, error) {
+	var optionID int64
+	err := q.QueryRowContext(ctx, "SELECT option_id FROM option_values WHERE id = ?", valueID).Scan(&optionID)
+	if err == sql.ErrNoRows {
+		return 0, notFound("option value %d not found", valueID)
+	}
+	return optionID, err
+}
+
+// lockOption locks an option and its values against concurrent SKU writes and
+// returns the value IDs. New sku_options rows wait on the locked values, so an
+// impact counted afterwards holds until the transaction ends.
+func lockOption(ctx context.Context, tx *sql.Tx, optionID int64) ([]int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM options WHERE id = ? FOR UPDATE", optionID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, notFound("option %d not found", optionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return queryTxIDs(ctx, tx, "SELECT id FROM option_values WHERE option_id = ? ORDER BY id FOR UPDATE", optionID)
+}
+
+// lockValue locks an option value like lockOption and returns its option
+func lockValue(ctx context.Context, tx *sql.Tx, valueID int64) (int64, error) {
+	var optionID int64
+	err := tx.QueryRowContext(ctx, "SELECT option_id FROM option_values WHERE id = ? FOR UPDATE", valueID).Scan(&optionID)
+	if err == sql.ErrNoRows {
+		return 0, notFound("option value %d not found", valueID)
+	}
+	return optionID, err
+}
+
+// valuesImpact counts the SKU options, SKUs, products and params of values
+func valuesImpact(ctx context.Context, q queryer, valueIDs []int64) (*optionImpact, error) {
+	impact := &optionImpact{Values: len(valueIDs)}
+	if len(valueIDs) == 0 {
+		return impact, nil
+	}
+
+	placeholders, args := inPlaceholders(valueIDs)
+	err := q.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT COUNT(*), COUNT(DISTINCT so.sku_id), COUNT(DISTINCT s.product_id)
+		FROM sku_options so
+		JOIN skus s ON s.id = so.sku_id
+		WHERE so.option_value_id IN (%s) OR so.range_end_value_id IN (%s)`, placeholders, placeholders),
+		append(append([]interface{}{}, args...), args...)...).Scan(&impact.SKUOptions, &impact.SKUs, &impact.Products)
+	if err != nil {
+		return nil, fmt.Errorf("error counting SKU options: %w", err)
+	}
+
+	err = q.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT COUNT(*) FROM option_params WHERE option_value_id IN (%s)", placeholders), args...).Scan(&impact.Params)
+	if err != nil {
+		return nil, fmt.Errorf("error counting option params: %w", err)
+	}
+	return impact, nil
+}
+
+// confirmed reports whether a destructive request carries ?confirm=true
+func confirmed(r *http.Request) bool {
+	confirm, _ := strconv.ParseBool(r.URL.Query().Get("confirm"))
+	return confirm
+}
+
+// impactConflict refuses an unconfirmed delete that touches SKUs
+type impactConflict struct {
+	impact *optionImpact
+}
+
+func (e *impactConflict) Error() string {
+	return "delete affects existing SKUs, repeat with ?confirm=true"
+}
+
+// writeOptionError replies with the impact of a refused delete, like
+// writeAPIError otherwise
+func writeOptionError(w http.ResponseWriter, err error) {
+	var refused *impactConflict
+	if errors.As(err, &refused) {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": refused.Error(), "impact": refused.impact})
+		return
+	}
+	writeAPIError(w, err)
+}
+
+// mergeValue repoints everything referencing from to into and deletes from
+func mergeValue(ctx context.Context, tx *sql.Tx, from, into int64) error {
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		// SKUs that already have the target keep their row
+		{`DELETE a FROM sku_options a
+			JOIN sku_options b ON b.sku_id = a.sku_id AND b.option_value_id = ?
+			WHERE a.option_value_id = ?`, []interface{}{into, from}},
+		{`UPDATE sku_options SET option_value_id = ? WHERE option_value_id = ?`, []interface{}{into, from}},
+		{`UPDATE sku_options SET range_end_value_id = ? WHERE range_end_value_id = ?`, []interface{}{into, from}},
+		{`INSERT IGNORE INTO commerceml_product_options (product_id, option_value_id)
+			SELECT product_id, ? FROM commerceml_product_options WHERE option_value_id = ?`, []interface{}{into, from}},
+		// Params the target already has win
+		{`UPDATE option_params SET option_value_id = ?
+			WHERE option_value_id = ? AND param_id NOT IN (
+				SELECT param_id FROM (SELECT param_id FROM option_params WHERE option_value_id = ?) target)`,
+			[]interface{}{into, from, into}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement.query, statement.args...); err != nil {
+			return fmt.Errorf("error merging value %d into %d: %w", from, into, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM option_values WHERE id = ?", from); err != nil {
+		return fmt.Errorf("error deleting merged value %d: %w", from, err)
+	}
+	return nil
+}
+
+// moveValues moves values to another option. Values the target option already
+// has are merged into its value, the rest move over and go last.
+func moveValues(ctx context.Context, tx *sql.Tx, valueIDs []int64, into int64) error {
+	for _, valueID := range valueIDs {
+		var match int64
+		err := tx.QueryRowContext(ctx, `
+			SELECT t.id FROM option_values t
+			JOIN option_values v ON v.value = t.value
+			WHERE v.id = ? AND t.option_id = ?
+			ORDER BY t.id LIMIT 1`, valueID, into).Scan(&match)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err := tx.ExecContext(ctx, `
+				UPDATE option_values SET option_id = ?,
+					position = (SELECT next FROM (SELECT COALESCE(MAX(position), 0) + 1 AS next FROM option_values WHERE option_id = ?) target)
+				WHERE id = ?`, into, into, valueID)
+			if err != nil {
+				return fmt.Errorf("error moving value %d: %w", valueID, err)
+			}
+		case err != nil:
+			return err
+		default:
+			if err := mergeValue(ctx, tx, valueID, match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateValue writes the fields given in a validated input. numeric_value is
+// set before value, which MySQL assigns left to right: a renamed value that is
+// not a number loses the old number, so range filters do not keep matching it.
+func updateValue(ctx context.Context, tx *sql.Tx, id int64, in *valueInput) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE option_values SET
+			numeric_value = CASE WHEN ? IS NOT NULL THEN ? WHEN value <> ? THEN NULL ELSE numeric_value END,
+			value = COALESCE(?, value),
+			step = COALESCE(?, step)
+		WHERE id = ?`, in.NumericValue, in.NumericValue, in.Value, in.Value, in.Step, id)
+	if err != nil {
+		return fmt.Errorf("error updating value: %w", err)
+	}
+	return nil
+}
+
+type optionInput struct {
+	Name        *string `json:"name"`
+	DisplayName *string `json:"display_name"`
+}
+
+func (in *optionInput) validate(create bool) error {
+	if err := checkText("name", in.Name, 100, create || in.Name != nil); err != nil {
+		return err
+	}
+	if err := checkText("display_name", in.DisplayName, 100, in.DisplayName != nil); err != nil {
+		return err
+	}
+	if create && in.DisplayName == nil {
+		in.DisplayName = in.Name
+	}
+	return nil
+}
+
+// checkOptionName rejects a name used by another option. Like checkBarcode it
+// locks the name in the unique key, so concurrent writes of it are serialized.
+func checkOptionName(ctx context.Context, tx *sql.Tx, name string, optionID int64) error {
+	var other int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM options WHERE name = ? AND id <> ? FOR UPDATE", name, optionID).Scan(&other)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return conflict("option name %q is already used by option %d", name, other)
+}
+
+type valueInput struct {
+	Value        *string  `json:"value"`
+	NumericValue *float64 `json:"numeric_value"`
+	Step         *float64 `json:"step"`
+}
+
+func (in *valueInput) validate(create bool) error {
+	if err := checkText("value", in.Value, 255, create || in.Value != nil); err != nil {
+		return err
+	}
+	if in.Step != nil && *in.Step <= 0 {
+		return badRequest("step must be positive")
+	}
+	// Numeric values get numeric_value for range filters, as on import
+	if in.Value != nil && in.NumericValue == nil {
+		if n, err := strconv.ParseFloat(strings.Replace(*in.Value, ",", ".", 1), 64); err == nil {
+			in.NumericValue = &n
+		}
+	}
+	return nil
+}
+
+// checkValueName rejects a value that already exists in the option
+func checkValueName(ctx context.Context, tx *sql.Tx, optionID int64, value string, valueID int64) error {
+	var other int64
+	err := tx.QueryRowContext(ctx,
+		"SELECT id FROM option_values WHERE option_id = ? AND value = ? AND id <> ? LIMIT 1", optionID, value, valueID).Scan(&other)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return conflict("value %q already exists as %d, merge instead", value, other)
+}
+
+type orderInput struct {
+	IDs []int64 `json:"ids"`
+}
+
+type mergeInput struct {
+	Into int64 `json:"into"`
+}
+
+func listOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	options, err := readOptions(r.Context(), 0)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, options)
+}
+
+func createOptionHandler(w http.ResponseWriter, r *http.Request) {
+	var in optionInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(true); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var id int64
+	err := withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		if err := checkOptionName(r.Context(), tx, *in.Name, 0); err != nil {
+			return nil, err
+		}
+		result, err := tx.ExecContext(r.Context(), `
+			INSERT INTO options (name, display_name, position)
+			SELECT ?, ?, COALESCE(MAX(position), 0) + 1 FROM options`, *in.Name, *in.DisplayName)
+		if err != nil {
+			return nil, fmt.Errorf("error creating option: %w", err)
+		}
+		id, err = result.LastInsertId()
+		return nil, err
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	option, err := readOption(r.Context(), id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/options/%d", id))
+	writeJSON(w, http.StatusCreated, option)
+}
+
+func updateOptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in optionInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(false); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		valueIDs, err := lockOption(r.Context(), tx, id)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := productIDsByOptionValues(r.Context(), tx, valueIDs)
+		if err != nil {
+			return nil, err
+		}
+		if in.Name != nil {
+			if err := checkOptionName(r.Context(), tx, *in.Name, id); err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.ExecContext(r.Context(),
+			"UPDATE options SET name = COALESCE(?, name), display_name = COALESCE(?, display_name) WHERE id = ?",
+			in.Name, in.DisplayName, id)
+		if err != nil {
+			return nil, fmt.Errorf("error updating option: %w", err)
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	option, err := readOption(r.Context(), id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, option)
+}
+
+// reorder sets position = index + 1 for the given IDs of a table
+func reorder(ctx context.Context, tx *sql.Tx, table, scope string, scopeArgs []interface{}, ids []int64) error {
+	if len(ids) == 0 {
+		return badRequest("ids must not be empty")
+	}
+	if len(uniqueIDs(ids)) != len(ids) {
+		return badRequest("ids must not repeat")
+	}
+
+	placeholders, args := inPlaceholders(ids)
+	var found int
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id IN (%s) %s", table, placeholders, scope),
+		append(args, scopeArgs...)...).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != len(ids) {
+		return badRequest("ids contain %d unknown IDs", len(ids)-found)
+	}
+
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET position = ? WHERE id = ?", table), i+1, id); err != nil {
+			return fmt.Errorf("error updating position: %w", err)
+		}
+	}
+	return nil
+}
+
+func reorderOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	var in orderInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err := withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		// Order is not part of the indexed documents, nothing to reindex
+		return nil, reorder(r.Context(), tx, "options", "", nil, in.IDs)
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	listOptionsHandler(w, r)
+}
+
+func reorderValuesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in orderInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		return nil, reorder(r.Context(), tx, "option_values", "AND option_id = ?", []interface{}{id}, in.IDs)
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	option, err := readOption(r.Context(), id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, option)
+}
+
+func optionImpactHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if _, err := readOption(r.Context(), id); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	valueIDs, err := optionValueIDs(r.Context(), db, id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	impact, err := valuesImpact(r.Context(), db, valueIDs)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, impact)
+}
+
+func deleteOptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var impact *optionImpact
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		valueIDs, err := lockOption(r.Context(), tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if impact, err = valuesImpact(r.Context(), tx, valueIDs); err != nil {
+			return nil, err
+		}
+		if !impact.empty() && !confirmed(r) {
+			return nil, &impactConflict{impact: impact}
+		}
+		affected, err := productIDsByOptionValues(r.Context(), tx, valueIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(r.Context(), "DELETE FROM options WHERE id = ?", id); err != nil {
+			return nil, fmt.Errorf("error deleting option: %w", err)
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeOptionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id, "impact": impact})
+}
+
+func mergeOptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in mergeInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if in.Into == id {
+		writeAPIError(w, badRequest("cannot merge an option into itself"))
+		return
+	}
+
+	var impact *optionImpact
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		ctx := r.Context()
+		// Lock in ID order so opposite merges of the same pair cannot deadlock
+		first, second := id, in.Into
+		if second < first {
+			first, second = second, first
+		}
+		var valueIDs []int64
+		for _, optionID := range []int64{first, second} {
+			locked, err := lockOption(ctx, tx, optionID)
+			if err != nil {
+				return nil, err
+			}
+			if optionID == id {
+				valueIDs = locked
+			}
+		}
+
+		var err error
+		if impact, err = valuesImpact(ctx, tx, valueIDs); err != nil {
+			return nil, err
+		}
+		affected, err := productIDsByOptionValues(ctx, tx, valueIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := moveValues(ctx, tx, valueIDs, in.Into); err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM options WHERE id = ?", id); err != nil {
+			return nil, fmt.Errorf("error deleting merged option: %w", err)
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	option, err := readOption(r.Context(), in.Into)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"option": option, "impact": impact})
+}
+
+func createValueHandler(w http.ResponseWriter, r *http.Request) {
+	optionID, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in valueInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(true); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if _, err := readOption(r.Context(), optionID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var id int64
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		if err := checkValueName(r.Context(), tx, optionID, *in.Value, 0); err != nil {
+			return nil, err
+		}
+		step := 1.0
+		if in.Step != nil {
+			step = *in.Step
+		}
+		result, err := tx.ExecContext(r.Context(), `
+			INSERT INTO option_values (option_id, value, numeric_value, step, position)
+			SELECT ?, ?, ?, ?, COALESCE(MAX(position), 0) + 1 FROM option_values WHERE option_id = ?`,
+			optionID, *in.Value, in.NumericValue, step, optionID)
+		if err != nil {
+			return nil, fmt.Errorf("error creating value: %w", err)
+		}
+		id, err = result.LastInsertId()
+		return nil, err
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	option, err := readOption(r.Context(), optionID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/option-values/%d", id))
+	writeJSON(w, http.StatusCreated, option)
+}
+
+func updateValueHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in valueInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(false); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var optionID int64
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		var err error
+		if optionID, err = lockValue(r.Context(), tx, id); err != nil {
+			return nil, err
+		}
+		affected, err := productIDsByOptionValues(r.Context(), tx, []int64{id})
+		if err != nil {
+			return nil, err
+		}
+		if in.Value != nil {
+			if err := checkValueName(r.Context(), tx, optionID, *in.Value, id); err != nil {
+				return nil, err
+			}
+		}
+		return affected, updateValue(r.Context(), tx, id, &in)
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	option, err := readOption(r.Context(), optionID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, option)
+}
+
+func valueImpactHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if _, err := valueOption(r.Context(), db, id); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	impact, err := valuesImpact(r.Context(), db, []int64{id})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, impact)
+}
+
+func deleteValueHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var impact *optionImpact
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		if _, err := lockValue(r.Context(), tx, id); err != nil {
+			return nil, err
+		}
+		var err error
+		if impact, err = valuesImpact(r.Context(), tx, []int64{id}); err != nil {
+			return nil, err
+		}
+		if !impact.empty() && !confirmed(r) {
+			return nil, &impactConflict{impact: impact}
+		}
+		affected, err := productIDsByOptionValues(r.Context(), tx, []int64{id})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(r.Context(), "DELETE FROM option_values WHERE id = ?", id); err != nil {
+			return nil, fmt.Errorf("error deleting value: %w", err)
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeOptionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id, "impact": impact})
+}
+
+func mergeValueHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in mergeInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if in.Into == id {
+		writeAPIError(w, badRequest("cannot merge a value into itself"))
+		return
+	}
+
+	var optionID int64
+	var impact *optionImpact
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		// Lock in ID order so opposite merges of the same pair cannot deadlock
+		first, second := id, in.Into
+		if second < first {
+			first, second = second, first
+		}
+		options := map[int64]int64{}
+		for _, valueID := range []int64{first, second} {
+			valueOptionID, err := lockValue(r.Context(), tx, valueID)
+			if err != nil {
+				return nil, err
+			}
+			options[valueID] = valueOptionID
+		}
+		optionID = options[id]
+		if optionID != options[in.Into] {
+			return nil, badRequest("values %d and %d belong to different options", id, in.Into)
+		}
+
+		var err error
+		if impact, err = valuesImpact(r.Context(), tx, []int64{id}); err != nil {
+			return nil, err
+		}
+		affected, err := productIDsByOptionValues(r.Context(), tx, []int64{id})
+		if err != nil {
+			return nil, err
+		}
+		return affected, mergeValue(r.Context(), tx, id, in.Into)
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	option, err := readOption(r.Context(), optionID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"option": option, "impact": impact})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+// mockTx starts a transaction on a mocked database
+func mockTx(t *testing.T) (*sql.Tx, sqlmock.Sqlmock) {
+	t.Helper()
+	mock := mockDB(t)
+	mock.ExpectBegin()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx, mock
+}
+
+func TestOptionInputValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      optionInput
+		create  bool
+		wantErr bool
+	}{
+		{"create", optionInput{Name: strPtr("color")}, true, false},
+		{"create without name", optionInput{DisplayName: strPtr("Color")}, true, true},
+		{"blank display name", optionInput{Name: strPtr("color"), DisplayName: strPtr(" ")}, true, true},
+		{"name too long", optionInput{Name: strPtr(strings.Repeat("x", 101))}, true, true},
+		{"update display name", optionInput{DisplayName: strPtr("Colour")}, false, false},
+	}
+	for _, tt := range tests {
+		err := tt.in.validate(tt.create)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	in := optionInput{Name: strPtr(" color ")}
+	if err := in.validate(true); err != nil || in.DisplayName == nil || *in.DisplayName != "color" {
+		t.Errorf("display name = %v, err = %v; want the trimmed name", in.DisplayName, err)
+	}
+}
+
+func TestValueInputValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          valueInput
+		create      bool
+		wantErr     bool
+		wantNumeric *float64
+	}{
+		{"number", valueInput{Value: strPtr("42")}, true, false, floatPtr(42)},
+		{"decimal comma", valueInput{Value: strPtr("1,5")}, true, false, floatPtr(1.5)},
+		{"text", valueInput{Value: strPtr("red")}, true, false, nil},
+		{"explicit number wins", valueInput{Value: strPtr("XL"), NumericValue: floatPtr(3)}, true, false, floatPtr(3)},
+		{"create without value", valueInput{Step: floatPtr(1)}, true, true, nil},
+		{"zero step", valueInput{Value: strPtr("1"), Step: floatPtr(0)}, true, true, nil},
+		{"update step", valueInput{Step: floatPtr(0.5)}, false, false, nil},
+	}
+	for _, tt := range tests {
+		err := tt.in.validate(tt.create)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := tt.in.NumericValue
+		if (got == nil) != (tt.wantNumeric == nil) || got != nil && *got != *tt.wantNumeric {
+			t.Errorf("%s: numeric_value = %v, want %v", tt.name, got, tt.wantNumeric)
+		}
+	}
+}
+
+func TestValuesImpact(t *testing.T) {
+	tx, mock := mockTx(t)
+	mock.ExpectQuery(`SELECT COUNT\(\*\), COUNT\(DISTINCT so.sku_id\), COUNT\(DISTINCT s.product_id\)`).
+		WithArgs(1, 2, 1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"sku_options", "skus", "products"}).AddRow(5, 4, 2))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM option_params WHERE option_value_id IN (?,?)")).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"params"}).AddRow(1))
+	mock.ExpectRollback()
+	defer tx.Rollback()
+
+	impact, err := valuesImpact(context.Background(), tx, []int64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := optionImpact{Values: 2, SKUOptions: 5, SKUs: 4, Products: 2, Params: 1}
+	if *impact != want {
+		t.Errorf("impact = %+v, want %+v", *impact, want)
+	}
+
+	if impact, err := valuesImpact(context.Background(), tx, nil); err != nil || !impact.empty() {
+		t.Errorf("impact of no values = %+v, %v; want empty", impact, err)
+	}
+	if !(&optionImpact{Values: 3}).empty() || (&optionImpact{Params: 1}).empty() {
+		t.Error("empty() must only look at SKU options and params")
+	}
+}
+
+// expectMergeValue expects the statements of mergeValue(from, into)
+func expectMergeValue(mock sqlmock.Sqlmock, from, into int64) {
+	mock.ExpectExec(`DELETE a FROM sku_options a`).WithArgs(into, from).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE sku_options SET option_value_id = ? WHERE option_value_id = ?")).
+		WithArgs(into, from).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE sku_options SET range_end_value_id = ? WHERE range_end_value_id = ?")).
+		WithArgs(into, from).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT IGNORE INTO commerceml_product_options`).WithArgs(into, from).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE option_params SET option_value_id = \?`).WithArgs(into, from, into).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM option_values WHERE id = ?")).WithArgs(from).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestMergeValue(t *testing.T) {
+	tx, mock := mockTx(t)
+	expectMergeValue(mock, 7, 3)
+	mock.ExpectCommit()
+
+	if err := mergeValue(context.Background(), tx, 7, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveValuesMergesCollidingValues(t *testing.T) {
+	matchQuery := `SELECT t.id FROM option_values t\s+JOIN option_values v ON v.value = t.value`
+
+	tx, mock := mockTx(t)
+	// Value 11 ("red") exists in option 2 as value 21 and is merged into it
+	mock.ExpectQuery(matchQuery).WithArgs(11, 2).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(21))
+	expectMergeValue(mock, 11, 21)
+	// Value 12 ("blue") does not and moves over
+	mock.ExpectQuery(matchQuery).WithArgs(12, 2).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`UPDATE option_values SET option_id = \?`).WithArgs(2, 2, 12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := moveValues(context.Background(), tx, []int64{11, 12}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateValueNumericValue(t *testing.T) {
+	query := regexp.QuoteMeta("numeric_value = CASE WHEN ? IS NOT NULL THEN ? WHEN value <> ? THEN NULL ELSE numeric_value END")
+	tests := []struct {
+		name string
+		body string
+		args []driver.Value
+	}{
+		// Renamed to a number: the number is stored
+		{"numeric rename", `{"value": "42"}`, []driver.Value{42.0, 42.0, "42", "42", nil, 5}},
+		// Renamed to text: no number, so the CASE clears it unless the value is unchanged
+		{"text rename", `{"value": "large"}`, []driver.Value{nil, nil, "large", "large", nil, 5}},
+		// Only the step: value is NULL, so value <> NULL is not true and the number is kept
+		{"step only", `{"step": 0.5}`, []driver.Value{nil, nil, nil, nil, 0.5, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in valueInput
+			if err := json.Unmarshal([]byte(tt.body), &in); err != nil {
+				t.Fatal(err)
+			}
+			if err := in.validate(false); err != nil {
+				t.Fatal(err)
+			}
+
+			tx, mock := mockTx(t)
+			mock.ExpectExec(query).WithArgs(tt.args...).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			if err := updateValue(context.Background(), tx, 5, &in); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestConfirmed(t *testing.T) {
+	for query, want := range map[string]bool{"": false, "?confirm=true": true, "?confirm=1": true, "?confirm=no": false} {
+		if got := confirmed(httptest.NewRequest(http.MethodDelete, "/option-values/1"+query, nil)); got != want {
+			t.Errorf("confirmed(%q) = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestDeleteValueConfirmGate(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT option_id FROM option_values WHERE id = ? FOR UPDATE")).
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"option_id"}).AddRow(1))
+	mock.ExpectQuery(`SELECT COUNT\(\*\), COUNT\(DISTINCT so.sku_id\)`).
+		WithArgs(4, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"sku_options", "skus", "products"}).AddRow(3, 3, 2))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM option_params`).
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"params"}).AddRow(0))
+	mock.ExpectRollback()
+
+	r := httptest.NewRequest(http.MethodDelete, "/option-values/4", nil)
+	r.SetPathValue("id", "4")
+	w := httptest.NewRecorder()
+	deleteValueHandler(w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	var body struct {
+		Impact optionImpact `json:"impact"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if want := (optionImpact{Values: 1, SKUOptions: 3, SKUs: 3, Products: 2}); body.Impact != want {
+		t.Errorf("impact = %+v, want %+v", body.Impact, want)
+	}
+}
+
+func TestDeleteUnusedOptionNeedsNoConfirm(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM options WHERE id = ? FOR UPDATE")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM option_values WHERE option_id = ? ORDER BY id FOR UPDATE")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM options WHERE id = ?")).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	r := httptest.NewRequest(http.MethodDelete, "/options/2", nil)
+	r.SetPathValue("id", "2")
+	w := httptest.NewRecorder()
+	deleteOptionHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
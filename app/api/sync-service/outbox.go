@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Outbox consumer: reads catalog_outbox rows written by the triggers of
+// migrations/001_catalog_outbox.sql, reindexes the affected products and acks
+// the rows in the same MySQL transaction that locked them. Rows are only
+// acked after the index was updated, so delivery is at-least-once.
+
+const (
+	outboxRetryDelay    = 5 * time.Second
+	outboxPruneInterval = time.Minute
+	outboxPruneBatch    = 10000
+
+	// ER_NO_SUCH_TABLE
+	errNoSuchTable = 1146
+	// ER_BAD_FIELD_ERROR
+	errBadField = 1054
+	// ER_DUP_ENTRY
+	errDuplicateKey = 1062
+	// ER_LOCK_DEADLOCK
+	errDeadlock = 1213
+)
+
+func isMissingTable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errNoSuchTable
+}
+
+// isMissingColumn reports a column added by a migration that has not run yet
+func isMissingColumn(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errBadField
+}
+
+// runOutboxSync consumes the outbox forever
+func runOutboxSync() {
+	interval, err := time.ParseDuration(getEnv("OUTBOX_POLL_INTERVAL", "1s"))
+	if err != nil {
+		log.Printf("Invalid OUTBOX_POLL_INTERVAL, outbox sync disabled: %v", err)
+		return
+	}
+
+	batchSize, err := strconv.Atoi(getEnv("OUTBOX_BATCH_SIZE", "500"))
+	if err != nil || batchSize <= 0 {
+		log.Printf("Invalid OUTBOX_BATCH_SIZE, outbox sync disabled")
+		return
+	}
+
+	log.Printf("Outbox sync: polling every %s", interval)
+
+	namespace := getEnv("REINDEXER_DB", "products_db")
+
+	for {
+		started := time.Now()
+		processed, err := processOutbox(context.Background(), batchSize, reindexProducts)
+		if err != nil {
+			log.Printf("Outbox sync error: %v (retrying in %s)", err, outboxRetryDelay)
+			time.Sleep(outboxRetryDelay)
+			continue
+		}
+
+		// Keep going while there is a backlog
+		if processed < batchSize {
+			markSynced(namespace, started, false)
+			time.Sleep(interval)
+		}
+	}
+}
+
+// processOutbox handles one batch of pending rows and returns how many were acked
+func processOutbox(ctx context.Context, batchSize int, reindex func(context.Context, []int64) (*reindexResult, error)) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED lets several sync-service instances share the outbox
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, entity, entity_id, product_id
+		FROM catalog_outbox
+		WHERE processed_at IS NULL
+		ORDER BY id
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("error reading outbox: %w", err)
+	}
+
+	var ids, productIDs, skuIDs, valueIDs []int64
+	for rows.Next() {
+		var (
+			id, entityID int64
+			entity       string
+			productID    sql.NullInt64
+		)
+		if err := rows.Scan(&id, &entity, &entityID, &productID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning outbox row: %w", err)
+		}
+
+		ids = append(ids, id)
+		switch {
+		case productID.Valid:
+			productIDs = append(productIDs, productID.Int64)
+		case entity == "sku_options":
+			skuIDs = append(skuIDs, entityID)
+		case entity == "option_values":
+			valueIDs = append(valueIDs, entityID)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error iterating outbox: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	skuProducts, err := productIDsBySKUs(ctx, skuIDs)
+	if err != nil {
+		return 0, fmt.Errorf("error resolving SKUs: %w", err)
+	}
+	productIDs = append(productIDs, skuProducts...)
+
+	valueProducts, err := productIDsByOptionValues(ctx, db, valueIDs)
+	if err != nil {
+		return 0, fmt.Errorf("error resolving option values: %w", err)
+	}
+	productIDs = append(productIDs, valueProducts...)
+
+	// Products that could not be written are dead-lettered and retried from
+	// there, so the batch is acked; only a failed reindex as a whole keeps the
+	// rows pending, otherwise one product would block every later change
+	result, err := reindex(ctx, productIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	placeholders, args := inPlaceholders(ids)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE catalog_outbox SET processed_at = CURRENT_TIMESTAMP(3) WHERE id IN (%s)", placeholders), args...)
+	if err != nil {
+		return 0, fmt.Errorf("error acking outbox rows: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing outbox ack: %w", err)
+	}
+
+	log.Printf("Outbox sync: processed %d changes (%d products failed)", len(ids), result.Failed)
+	return len(ids), nil
+}
+
+// outboxHighWater returns the newest outbox row ID
+func outboxHighWater() (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM catalog_outbox").Scan(&id)
+	return id, err
+}
+
+// ackOutboxUpTo marks rows up to id as processed; used after a full load,
+// which covers every change committed before it started
+func ackOutboxUpTo(id int64) error {
+	_, err := db.Exec("UPDATE catalog_outbox SET processed_at = CURRENT_TIMESTAMP(3) WHERE processed_at IS NULL AND id <= ?", id)
+	return err
+}
+
+// outboxPruneQuery deletes one batch of rows older than the retention. The
+// triggers are installed in every sync mode, so when nothing consumes the
+// outbox its rows are never acked and are pruned by age as well.
+func outboxPruneQuery(consumed bool) string {
+	if !consumed {
+		return `
+			DELETE FROM catalog_outbox
+			WHERE COALESCE(processed_at, created_at) < NOW(3) - INTERVAL ? SECOND
+			LIMIT ?`
+	}
+	return `
+		DELETE FROM catalog_outbox
+		WHERE processed_at IS NOT NULL AND processed_at < NOW(3) - INTERVAL ? SECOND
+		LIMIT ?`
+}
+
+// runOutboxPruner deletes rows older than OUTBOX_RETENTION: acked ones when
+// the outbox is consumed, all of them otherwise
+func runOutboxPruner(consumed bool) {
+	retention, err := time.ParseDuration(getEnv("OUTBOX_RETENTION", "24h"))
+	if err != nil {
+		log.Printf("Invalid OUTBOX_RETENTION, outbox pruning disabled: %v", err)
+		return
+	}
+	query := outboxPruneQuery(consumed)
+
+	for {
+		for {
+			result, err := db.Exec(query, int64(retention.Seconds()), outboxPruneBatch)
+			if err != nil {
+				if !isMissingTable(err) {
+					log.Printf("Error pruning outbox: %v", err)
+				}
+				break
+			}
+
+			deleted, _ := result.RowsAffected()
+			if deleted > 0 {
+				log.Printf("Pruned %d outbox rows", deleted)
+			}
+			if deleted < outboxPruneBatch {
+				break
+			}
+		}
+
+		time.Sleep(outboxPruneInterval)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// mockDB replaces the MySQL connection for the duration of a test
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockedDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = mockedDB
+	t.Cleanup(func() {
+		db = previous
+		mockedDB.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+// expectOutboxBatch queues a batch of three changes: products 5 and 6
+// directly, and product 7 through SKU 30
+func expectOutboxBatch(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, entity, entity_id, product_id\s+FROM catalog_outbox`).
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "entity", "entity_id", "product_id"}).
+			AddRow(1, "products", 5, 5).
+			AddRow(2, "skus", 60, 6).
+			AddRow(3, "sku_options", 30, nil))
+	mock.ExpectQuery(`SELECT DISTINCT product_id FROM skus WHERE id IN \(\?\)`).
+		WithArgs(30).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id"}).AddRow(7))
+}
+
+func TestProcessOutboxAcksPartialFailures(t *testing.T) {
+	mock := mockDB(t)
+	expectOutboxBatch(mock)
+	mock.ExpectExec(`UPDATE catalog_outbox SET processed_at = CURRENT_TIMESTAMP\(3\) WHERE id IN \(\?,\?,\?\)`).
+		WithArgs(1, 2, 3).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	var reindexed []int64
+	reindex := func(ctx context.Context, ids []int64) (*reindexResult, error) {
+		reindexed = append([]int64{}, ids...)
+		// Product 6 cannot be written and is dead-lettered
+		return &reindexResult{ProductIDs: ids, Failed: 1, firstErr: errors.New("write failed")}, nil
+	}
+
+	processed, err := processOutbox(context.Background(), 10, reindex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed != 3 {
+		t.Errorf("processed = %d, want 3", processed)
+	}
+	sort.Slice(reindexed, func(i, j int) bool { return reindexed[i] < reindexed[j] })
+	if want := []int64{5, 6, 7}; !reflect.DeepEqual(reindexed, want) {
+		t.Errorf("reindexed %v, want %v", reindexed, want)
+	}
+}
+
+func TestProcessOutboxKeepsRowsWhenReindexFails(t *testing.T) {
+	mock := mockDB(t)
+	expectOutboxBatch(mock)
+	mock.ExpectRollback()
+
+	reindex := func(ctx context.Context, ids []int64) (*reindexResult, error) {
+		return nil, sql.ErrConnDone
+	}
+
+	processed, err := processOutbox(context.Background(), 10, reindex)
+	if !errors.Is(err, sql.ErrConnDone) {
+		t.Fatalf("err = %v, want %v", err, sql.ErrConnDone)
+	}
+	if processed != 0 {
+		t.Errorf("processed = %d, want 0", processed)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/restream/reindexer/v5"
+)
+
+// reindexChunkSize limits how many IDs go into a single IN clause
+const reindexChunkSize = 1000
+
+// inPlaceholders builds the "?,?,?" list and arguments for an IN clause
+func inPlaceholders(ids []int64) (string, []interface{}) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	return strings.Join(placeholders, ","), args
+}
+
+// uniqueIDs returns the sorted set of IDs
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	result := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// queryer is satisfied by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// queryIDs runs a query returning a single int64 column for each chunk of ids.
+// The query must contain one %s per IN clause; every IN clause gets the same chunk.
+func queryIDs(ctx context.Context, q queryer, query string, inClauses int, ids []int64) ([]int64, error) {
+	var result []int64
+
+	for start := 0; start < len(ids); start += reindexChunkSize {
+		end := start + reindexChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		placeholders, args := inPlaceholders(ids[start:end])
+		formatArgs := make([]interface{}, inClauses)
+		var queryArgs []interface{}
+		for i := range formatArgs {
+			formatArgs[i] = placeholders
+			queryArgs = append(queryArgs, args...)
+		}
+
+		rows, err := q.QueryContext(ctx, fmt.Sprintf(query, formatArgs...), queryArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("database query error: %w", err)
+		}
+
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning ID: %w", err)
+			}
+			result = append(result, id)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error iterating IDs: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// productIDsBySKUs resolves SKU IDs to the IDs of their products
+func productIDsBySKUs(ctx context.Context, skuIDs []int64) ([]int64, error) {
+	return queryIDs(ctx, db, `SELECT DISTINCT product_id FROM skus WHERE id IN (%s)`, 1, uniqueIDs(skuIDs))
+}
+
+// productIDsByOptionValues resolves option value IDs to the products using them.
+// Products are looked up both in MySQL and in Reindexer, so products that lost
+// the value through a cascade delete are still found. MySQL is read through q,
+// so a transaction that locked the values sees the rows it is about to change.
+func productIDsByOptionValues(ctx context.Context, q queryer, valueIDs []int64) ([]int64, error) {
+	valueIDs = uniqueIDs(valueIDs)
+	if len(valueIDs) == 0 {
+		return nil, nil
+	}
+
+	result, err := queryIDs(ctx, q, `
+		SELECT DISTINCT s.product_id
+		FROM sku_options so
+		JOIN skus s ON s.id = so.sku_id
+		WHERE so.option_value_id IN (%s) OR so.range_end_value_id IN (%s)`, 2, valueIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	dbName := getEnv("REINDEXER_DB", "products_db")
+	iterator := rx.Query(dbName).WhereInt64("option_value_ids", reindexer.SET, valueIDs...).ExecCtx(ctx)
+	defer iterator.Close()
+
+	for iterator.Next() {
+		result = append(result, iterator.Object().(*ReindexerProduct).ProductID)
+	}
+
+	if err := iterator.Error(); err != nil {
+		return nil, fmt.Errorf("error querying Reindexer: %w", err)
+	}
+
+	return uniqueIDs(result), nil
+}
+
+// productIDsByOptions resolves option IDs to the products using any of their
+// values, in MySQL and in Reindexer like productIDsByOptionValues
+func productIDsByOptions(ctx context.Context, optionIDs []int64) ([]int64, error) {
+	optionIDs = uniqueIDs(optionIDs)
+	if len(optionIDs) == 0 {
+		return nil, nil
+	}
+
+	result, err := queryIDs(ctx, db, `
+		SELECT DISTINCT s.product_id
+		FROM option_values ov
+		JOIN sku_options so ON so.option_value_id = ov.id OR so.range_end_value_id = ov.id
+		JOIN skus s ON s.id = so.sku_id
+		WHERE ov.option_id IN (%s)`, 1, optionIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	dbName := getEnv("REINDEXER_DB", "products_db")
+	iterator := rx.Query(dbName).WhereInt64("option_ids", reindexer.SET, optionIDs...).ExecCtx(ctx)
+	defer iterator.Close()
+
+	for iterator.Next() {
+		result = append(result, iterator.Object().(*ReindexerProduct).ProductID)
+	}
+
+	if err := iterator.Error(); err != nil {
+		return nil, fmt.Errorf("error querying Reindexer: %w", err)
+	}
+
+	return uniqueIDs(result), nil
+}
+
+// existingProductIDs returns which of the given product IDs still exist in MySQL
+func existingProductIDs(ctx context.Context, ids []int64) ([]int64, error) {
+	return queryIDs(ctx, db, `SELECT id FROM products WHERE id IN (%s) ORDER BY id`, 1, ids)
+}
+
+// reindexResult summarizes a targeted reindex
+type reindexResult struct {
+	ProductIDs []int64 `json:"product_ids"`
+	WriteStats
+	Failed int `json:"failed"`
+
+	firstErr error
+}
+
+// failure describes the products that were dead-lettered, or is nil when all
+// of them were written
+func (r *reindexResult) failure() error {
+	if r.Failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d products failed and were queued for retry: %w", r.Failed, len(r.ProductIDs), r.firstErr)
+}
+
+// reindexProducts rebuilds the Reindexer documents of the given products.
+// Products that no longer exist in MySQL are removed from the index.
+// Products that cannot be written are dead-lettered for retry and the
+// remaining ones are still processed; they are counted in result.Failed and
+// not returned as an error. An error means the reindex itself broke down
+// (MySQL, context) and nothing was queued.
+func reindexProducts(ctx context.Context, ids []int64) (*reindexResult, error) {
+	ids = uniqueIDs(ids)
+	result := &reindexResult{ProductIDs: ids}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	dbName := getEnv("REINDEXER_DB", "products_db")
+
+	existing, err := existingProductIDs(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("error checking products: %w", err)
+	}
+
+	failed := func(ids []int64, err error) {
+		logDeadLetterError(recordDeadLetters(ids, err))
+		result.Failed += len(ids)
+		if result.firstErr == nil {
+			result.firstErr = err
+		}
+	}
+
+	exists := make(map[int64]bool, len(existing))
+	var written []int64
+	for start := 0; start < len(existing); start += reindexChunkSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		end := start + reindexChunkSize
+		if end > len(existing) {
+			end = len(existing)
+		}
+
+		products, err := assembleProductIDs(existing[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("error getting product IDs: %w", err)
+		}
+
+		for _, productIDs := range products {
+			exists[productIDs.ProductID] = true
+		}
+
+		stats, err := writeBatch(dbName, products)
+		if err != nil {
+			failed(existing[start:end], batchError(products, err))
+			continue
+		}
+		written = append(written, existing[start:end]...)
+		result.add(stats)
+	}
+
+	for _, id := range ids {
+		if exists[id] {
+			continue
+		}
+		if err := rx.Delete(dbName, &ReindexerProduct{ProductID: id}); err != nil {
+			failed([]int64{id}, fmt.Errorf("error deleting product %d from Reindexer: %w", id, err))
+			continue
+		}
+		written = append(written, id)
+		result.Removed++
+	}
+
+	if _, err := clearDeadLetters(ctx, written); err != nil {
+		logDeadLetterError(err)
+	}
+
+	if result.New+result.Updated+result.Removed > 0 {
+		bumpIndexVersion(dbName)
+	}
+
+	log.Printf("Reindexed %d products (%d new, %d updated, %d skipped, %d removed, %d failed)",
+		len(ids), result.New, result.Updated, result.Skipped, result.Removed, result.Failed)
+	if err := result.failure(); err != nil {
+		log.Printf("Reindex: %v", err)
+	}
+	return result, nil
+}
+
+// ReindexRequest selects the products to rebuild. SKU and option value IDs
+// are resolved to the products using them.
+type ReindexRequest struct {
+	ProductIDs     []int64 `json:"product_ids"`
+	SKUIDs         []int64 `json:"sku_ids"`
+	OptionValueIDs []int64 `json:"option_value_ids"`
+	Async          bool    `json:"async"`
+	Timeout        string  `json:"timeout"`
+}
+
+// maxReindexIDs limits the size of a single /reindex request
+const maxReindexIDs = 10000
+
+// resolveProductIDs returns all products selected by the request
+func (req *ReindexRequest) resolveProductIDs(ctx context.Context) ([]int64, error) {
+	ids := append([]int64{}, req.ProductIDs...)
+
+	skuProducts, err := productIDsBySKUs(ctx, req.SKUIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving SKUs: %w", err)
+	}
+	ids = append(ids, skuProducts...)
+
+	valueProducts, err := productIDsByOptionValues(ctx, db, req.OptionValueIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving option values: %w", err)
+	}
+	ids = append(ids, valueProducts...)
+
+	return uniqueIDs(ids), nil
+}
+
+func (req *ReindexRequest) run(ctx context.Context, job *Job) error {
+	job.phase("resolve products")
+	ids, err := req.resolveProductIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	job.phase("reindex")
+	result, err := reindexProducts(ctx, ids)
+	if err != nil {
+		return err
+	}
+	job.addRows(result.total())
+	job.addDocuments(result.WriteStats)
+	if err := result.failure(); err != nil {
+		job.addError(err)
+	}
+	return nil
+}
+
+func reindexHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReindexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	total := len(req.ProductIDs) + len(req.SKUIDs) + len(req.OptionValueIDs)
+	if total == 0 || total > maxReindexIDs {
+		http.Error(w, fmt.Sprintf("Provide 1-%d product_ids, sku_ids or option_value_ids", maxReindexIDs), http.StatusBadRequest)
+		return
+	}
+
+	if req.Async {
+		job := jobs.create("reindex", "http")
+		job.start(req.run)
+
+		w.Header().Set("Location", "/jobs/"+job.id())
+		writeJSON(w, http.StatusAccepted, job.info())
+		return
+	}
+
+	timeout, err := time.ParseDuration(getEnv("REINDEX_TIMEOUT", "30s"))
+	if err != nil {
+		http.Error(w, "Invalid REINDEX_TIMEOUT", http.StatusInternalServerError)
+		return
+	}
+	if req.Timeout != "" {
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	ids, err := req.resolveProductIDs(ctx)
+	if err == nil {
+		var result *reindexResult
+		if result, err = reindexProducts(ctx, ids); err == nil {
+			writeJSON(w, http.StatusOK, result)
+			return
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "Reindex timed out, retry with async=true", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, "Reindex error", http.StatusInternalServerError)
+	log.Printf("Error reindexing products: %v", err)
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stock reservations for checkout. A cart holds quantities of SKUs until the
+// hold expires; active holds are subtracted from the count as available
+// stock in getProducts and in the in_stock index data. Reserving locks the
+// SKU rows in ID order and is all-or-nothing: repeating it for a SKU replaces
+// the quantity and extends the hold, quantity 0 releases it. Confirming
+// subtracts the held quantities from stock and removes the holds. Plain SKUs
+// lose the quantity from their count whatever warehouse is given; SKUs
+// stocked per warehouse lose it in the warehouse given for the item or the
+// request, and without one from as few warehouses as possible. Expired holds
+// stop counting at once; the sweeper deletes them and reindexes their
+// products.
+//
+//	GET    /carts/{cart}/reservations
+//	POST   /carts/{cart}/reservations          {"items": [{"sku_id": 1, "quantity": 2}], "ttl_seconds"?: 900}
+//	POST   /carts/{cart}/reservations/confirm  {"warehouse_id"?: 1, "items"?: [{"sku_id": 1, "warehouse_id": 2}]}
+//	DELETE /carts/{cart}/reservations
+
+type reservationConfig struct {
+	TTL           time.Duration
+	MaxTTL        time.Duration
+	SweepInterval time.Duration
+}
+
+func getReservationConfig() (*reservationConfig, error) {
+	cfg := &reservationConfig{}
+	for _, setting := range []struct {
+		name, fallback string
+		value          *time.Duration
+	}{
+		{"RESERVATION_TTL", "15m", &cfg.TTL},
+		{"RESERVATION_MAX_TTL", "2h", &cfg.MaxTTL},
+		{"RESERVATION_SWEEP_INTERVAL", "30s", &cfg.SweepInterval},
+	} {
+		value, err := time.ParseDuration(getEnv(setting.name, setting.fallback))
+		if err != nil || value < time.Second {
+			return nil, fmt.Errorf("invalid %s", setting.name)
+		}
+		*setting.value = value
+	}
+	if cfg.TTL > cfg.MaxTTL {
+		return nil, fmt.Errorf("RESERVATION_TTL exceeds RESERVATION_MAX_TTL")
+	}
+	return cfg, nil
+}
+
+type reservation struct {
+	SKUID     int64  `json:"sku_id"`
+	ProductID int64  `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type cartReservations struct {
+	CartID string        `json:"cart_id"`
+	Items  []reservation `json:"items"`
+}
+
+type reservationItem struct {
+	SKUID    int64 `json:"sku_id"`
+	Quantity int   `json:"quantity"`
+}
+
+type reserveRequest struct {
+	Items      []reservationItem `json:"items"`
+	TTLSeconds *int              `json:"ttl_seconds"`
+}
+
+type confirmItem struct {
+	SKUID       int64 `json:"sku_id"`
+	WarehouseID int64 `json:"warehouse_id"`
+}
+
+type confirmRequest struct {
+	WarehouseID *int64 `json:"warehouse_id"`
+	// Items override the warehouse for single SKUs
+	Items []confirmItem `json:"items"`
+}
+
+func (req *confirmRequest) validate() error {
+	if req.WarehouseID != nil && *req.WarehouseID <= 0 {
+		return badRequest("invalid warehouse_id")
+	}
+	if len(req.Items) > maxStockItems {
+		return badRequest("provide at most %d items", maxStockItems)
+	}
+	seen := make(map[int64]bool, len(req.Items))
+	for _, item := range req.Items {
+		switch {
+		case item.SKUID <= 0:
+			return badRequest("invalid sku_id %d", item.SKUID)
+		case item.WarehouseID <= 0:
+			return badRequest("invalid warehouse_id for SKU %d", item.SKUID)
+		case seen[item.SKUID]:
+			return badRequest("SKU %d is listed twice", item.SKUID)
+		}
+		seen[item.SKUID] = true
+	}
+	return nil
+}
+
+// warehouse returns the warehouse to confirm a SKU from, nil for any
+func (req *confirmRequest) warehouse(skuID int64) *int64 {
+	for _, item := range req.Items {
+		if item.SKUID == skuID {
+			return &item.WarehouseID
+		}
+	}
+	return req.WarehouseID
+}
+
+type confirmResponse struct {
+	CartID string         `json:"cart_id"`
+	Items  []*stockResult `json:"items"`
+}
+
+// cartID reads and checks the cart ID of the path
+func cartID(r *http.Request) (string, error) {
+	id := strings.TrimSpace(r.PathValue("cart"))
+	if err := checkText("cart_id", &id, 100, true); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// readReservations returns the active holds of a cart
+func readReservations(ctx context.Context, cart string) (*cartReservations, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.sku_id, s.product_id, r.quantity, r.expires_at
+		FROM stock_reservations r
+		JOIN skus s ON s.id = r.sku_id
+		WHERE r.cart_id = ? AND r.expires_at > NOW(3)
+		ORDER BY r.sku_id`, cart)
+	if err != nil {
+		return nil, fmt.Errorf("error querying reservations: %w", err)
+	}
+	defer rows.Close()
+
+	result := &cartReservations{CartID: cart, Items: []reservation{}}
+	for rows.Next() {
+		var item reservation
+		if err := rows.Scan(&item.SKUID, &item.ProductID, &item.Quantity, &item.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("error scanning reservation: %w", err)
+		}
+		result.Items = append(result.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating reservations: %w", err)
+	}
+	return result, nil
+}
+
+// lockStockSKU locks a SKU row and returns its product and count
+func lockStockSKU(ctx context.Context, tx *sql.Tx, skuID int64) (productID int64, count int, err error) {
+	err = tx.QueryRowContext(ctx, "SELECT product_id, count FROM skus WHERE id = ? FOR UPDATE", skuID).Scan(&productID, &count)
+	if err == sql.ErrNoRows {
+		return 0, 0, notFound("SKU %d not found", skuID)
+	}
+	return productID, count, err
+}
+
+// warehouseStock is the quantity of a SKU in one warehouse
+type warehouseStock struct {
+	WarehouseID int64
+	Quantity    int
+}
+
+// lockWarehouseStocks locks and returns the warehouse quantities of a SKU
+func lockWarehouseStocks(ctx context.Context, tx *sql.Tx, skuID int64) ([]warehouseStock, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT warehouse_id, quantity FROM sku_stocks WHERE sku_id = ? ORDER BY warehouse_id FOR UPDATE", skuID)
+	if isMissingTable(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading warehouse stock of SKU %d: %w", skuID, err)
+	}
+	defer rows.Close()
+
+	var stocks []warehouseStock
+	for rows.Next() {
+		var stock warehouseStock
+		if err := rows.Scan(&stock.WarehouseID, &stock.Quantity); err != nil {
+			return nil, fmt.Errorf("error scanning warehouse stock: %w", err)
+		}
+		stocks = append(stocks, stock)
+	}
+	return stocks, rows.Err()
+}
+
+// allocateStock splits a quantity over warehouses, largest stock first (lowest
+// ID on ties), so it is taken from as few warehouses as possible
+func allocateStock(skuID int64, stocks []warehouseStock, quantity int) ([]warehouseStock, error) {
+	sorted := append([]warehouseStock(nil), stocks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Quantity != sorted[j].Quantity {
+			return sorted[i].Quantity > sorted[j].Quantity
+		}
+		return sorted[i].WarehouseID < sorted[j].WarehouseID
+	})
+
+	var takes []warehouseStock
+	left := quantity
+	for _, stock := range sorted {
+		if left == 0 {
+			break
+		}
+		if stock.Quantity <= 0 {
+			continue
+		}
+		take := min(stock.Quantity, left)
+		takes = append(takes, warehouseStock{WarehouseID: stock.WarehouseID, Quantity: take})
+		left -= take
+	}
+	if left > 0 {
+		return nil, conflict("SKU %d: insufficient stock: %d available in all warehouses, %d held",
+			skuID, quantity-left, quantity)
+	}
+	return takes, nil
+}
+
+// confirmSKU subtracts a held quantity from a SKU locked by the caller, whose
+// product and count are in sku, and returns one result per changed count
+func confirmSKU(ctx context.Context, tx *sql.Tx, sku stockResult, quantity int, warehouseID *int64) ([]*stockResult, error) {
+	stocks, err := lockWarehouseStocks(ctx, tx, sku.SKUID)
+	if err != nil {
+		return nil, err
+	}
+
+	var takes []warehouseStock
+	switch {
+	case len(stocks) == 0:
+		// A plain count, any warehouse given does not apply
+		delta := -quantity
+		result := sku
+		if err := applyStock(ctx, tx, &result, &stockChange{Delta: &delta}); err != nil {
+			return nil, err
+		}
+		return []*stockResult{&result}, nil
+	case warehouseID != nil:
+		takes = []warehouseStock{{WarehouseID: *warehouseID, Quantity: quantity}}
+	default:
+		if takes, err = allocateStock(sku.SKUID, stocks, quantity); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []*stockResult
+	for _, take := range takes {
+		delta := -take.Quantity
+		result := &stockResult{SKUID: sku.SKUID, ProductID: sku.ProductID}
+		if err := applyStock(ctx, tx, result, &stockChange{Delta: &delta, WarehouseID: &take.WarehouseID}); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// reserve sets the hold of a cart on a locked SKU with the given count
+func reserve(ctx context.Context, tx *sql.Tx, cart string, item reservationItem, count int, ttl time.Duration) error {
+	if item.Quantity == 0 {
+		_, err := tx.ExecContext(ctx, "DELETE FROM stock_reservations WHERE cart_id = ? AND sku_id = ?", cart, item.SKUID)
+		return err
+	}
+
+	var held int
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(quantity), 0) FROM stock_reservations
+		WHERE sku_id = ? AND cart_id <> ? AND expires_at > NOW(3)`, item.SKUID, cart).Scan(&held)
+	if err != nil {
+		return fmt.Errorf("error reading reservations of SKU %d: %w", item.SKUID, err)
+	}
+	if available := max(count-held, 0); available < item.Quantity {
+		return conflict("SKU %d: %d available, %d requested", item.SKUID, available, item.Quantity)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO stock_reservations (cart_id, sku_id, quantity, expires_at)
+		VALUES (?, ?, ?, NOW(3) + INTERVAL ? SECOND)
+		ON DUPLICATE KEY UPDATE quantity = VALUES(quantity), expires_at = VALUES(expires_at)`,
+		cart, item.SKUID, item.Quantity, int64(ttl.Seconds()))
+	if err != nil {
+		return fmt.Errorf("error reserving SKU %d: %w", item.SKUID, err)
+	}
+	return nil
+}
+
+func getReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	cart, err := cartID(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	reservations, err := readReservations(r.Context(), cart)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, reservations)
+}
+
+func reserveHandler(w http.ResponseWriter, r *http.Request) {
+	cart, err := cartID(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	cfg, err := getReservationConfig()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var req reserveRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxStockItems {
+		writeAPIError(w, badRequest("provide 1-%d items", maxStockItems))
+		return
+	}
+	ttl := cfg.TTL
+	if req.TTLSeconds != nil {
+		ttl = time.Duration(*req.TTLSeconds) * time.Second
+		if ttl < time.Second || ttl > cfg.MaxTTL {
+			writeAPIError(w, badRequest("ttl_seconds must be 1-%d", int64(cfg.MaxTTL.Seconds())))
+			return
+		}
+	}
+
+	// SKU rows are locked in ID order, so concurrent reservations cannot deadlock
+	items := append([]reservationItem(nil), req.Items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].SKUID < items[j].SKUID })
+	for i, item := range items {
+		switch {
+		case item.SKUID <= 0:
+			writeAPIError(w, badRequest("invalid sku_id %d", item.SKUID))
+			return
+		case item.Quantity < 0:
+			writeAPIError(w, badRequest("quantity of SKU %d must not be negative", item.SKUID))
+			return
+		case i > 0 && items[i-1].SKUID == item.SKUID:
+			writeAPIError(w, badRequest("SKU %d is listed twice", item.SKUID))
+			return
+		}
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		var affected []int64
+		for _, item := range items {
+			productID, count, err := lockStockSKU(r.Context(), tx, item.SKUID)
+			if err != nil {
+				return nil, err
+			}
+			if err := reserve(r.Context(), tx, cart, item, count, ttl); err != nil {
+				return nil, err
+			}
+			affected = append(affected, productID)
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	reservations, err := readReservations(r.Context(), cart)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, reservations)
+}
+
+func confirmReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	cart, err := cartID(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	// The body is optional
+	var req confirmRequest
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &req); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+	if err := req.validate(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	response := &confirmResponse{CartID: cart}
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		skuIDs, err := queryTxIDs(r.Context(), tx, `
+			SELECT sku_id FROM stock_reservations
+			WHERE cart_id = ? AND expires_at > NOW(3)
+			ORDER BY sku_id`, cart)
+		if err != nil {
+			return nil, err
+		}
+		if len(skuIDs) == 0 {
+			return nil, notFound("cart %s has no active reservations", cart)
+		}
+
+		var affected, confirmed []int64
+		for _, skuID := range skuIDs {
+			result := &stockResult{SKUID: skuID}
+			if result.ProductID, result.Previous, err = lockStockSKU(r.Context(), tx, skuID); err != nil {
+				return nil, err
+			}
+
+			// Read again under the SKU lock; the hold may have expired meanwhile
+			var quantity int
+			err := tx.QueryRowContext(r.Context(), `
+				SELECT quantity FROM stock_reservations
+				WHERE cart_id = ? AND sku_id = ? AND expires_at > NOW(3) FOR UPDATE`, cart, skuID).Scan(&quantity)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error reading reservation of SKU %d: %w", skuID, err)
+			}
+
+			results, err := confirmSKU(r.Context(), tx, *result, quantity, req.warehouse(skuID))
+			if err != nil {
+				return nil, err
+			}
+			response.Items = append(response.Items, results...)
+			affected = append(affected, result.ProductID)
+			confirmed = append(confirmed, skuID)
+		}
+		if len(confirmed) == 0 {
+			return nil, notFound("cart %s has no active reservations", cart)
+		}
+
+		// Expired holds of the cart go too
+		placeholders, args := inPlaceholders(confirmed)
+		args = append([]interface{}{cart}, args...)
+		_, err = tx.ExecContext(r.Context(), fmt.Sprintf(`
+			DELETE FROM stock_reservations
+			WHERE cart_id = ? AND (sku_id IN (%s) OR expires_at <= NOW(3))`, placeholders), args...)
+		if err != nil {
+			return nil, fmt.Errorf("error removing confirmed reservations: %w", err)
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func releaseReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	cart, err := cartID(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var released int64
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		affected, err := queryTxIDs(r.Context(), tx, `
+			SELECT DISTINCT s.product_id
+			FROM stock_reservations r
+			JOIN skus s ON s.id = r.sku_id
+			WHERE r.cart_id = ?`, cart)
+		if err != nil {
+			return nil, err
+		}
+		result, err := tx.ExecContext(r.Context(), "DELETE FROM stock_reservations WHERE cart_id = ?", cart)
+		if err != nil {
+			return nil, fmt.Errorf("error releasing reservations: %w", err)
+		}
+		released, _ = result.RowsAffected()
+		return affected, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cart_id": cart, "released": released})
+}
+
+// sweepReservations deletes expired holds and reindexes their products
+func sweepReservations(ctx context.Context) (int64, error) {
+	var swept int64
+	err := withTx(ctx, nil, func(tx *sql.Tx) ([]int64, error) {
+		// Deleted by ID, so every swept hold has its product reindexed
+		rows, err := tx.QueryContext(ctx, `
+			SELECT r.id, s.product_id
+			FROM stock_reservations r
+			JOIN skus s ON s.id = r.sku_id
+			WHERE r.expires_at <= NOW(3)
+			FOR UPDATE`)
+		if err != nil {
+			return nil, fmt.Errorf("error querying expired reservations: %w", err)
+		}
+		var ids, affected []int64
+		for rows.Next() {
+			var id, productID int64
+			if err := rows.Scan(&id, &productID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning expired reservation: %w", err)
+			}
+			ids = append(ids, id)
+			affected = append(affected, productID)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil || len(ids) == 0 {
+			return nil, err
+		}
+
+		placeholders, args := inPlaceholders(ids)
+		result, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM stock_reservations WHERE id IN (%s)", placeholders), args...)
+		if err != nil {
+			return nil, fmt.Errorf("error deleting expired reservations: %w", err)
+		}
+		swept, _ = result.RowsAffected()
+		return uniqueIDs(affected), nil
+	})
+	return swept, err
+}
+
+// runReservationSweeper removes expired holds forever
+func runReservationSweeper() {
+	cfg, err := getReservationConfig()
+	if err != nil {
+		log.Printf("Reservation sweeper disabled: %v", err)
+		return
+	}
+
+	for {
+		time.Sleep(cfg.SweepInterval)
+
+		swept, err := sweepReservations(context.Background())
+		if err != nil {
+			if !isMissingTable(err) {
+				log.Printf("Error sweeping reservations: %v", err)
+			}
+			continue
+		}
+		if swept > 0 {
+			log.Printf("Swept %d expired reservations", swept)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllocateStock(t *testing.T) {
+	tests := []struct {
+		name     string
+		stocks   []warehouseStock
+		quantity int
+		want     []warehouseStock
+		wantErr  bool
+	}{
+		{"one warehouse", []warehouseStock{{1, 5}}, 3, []warehouseStock{{1, 3}}, false},
+		{"largest first", []warehouseStock{{1, 2}, {2, 6}}, 3, []warehouseStock{{2, 3}}, false},
+		{"split", []warehouseStock{{1, 2}, {2, 2}}, 3, []warehouseStock{{1, 2}, {2, 1}}, false},
+		{"exact total", []warehouseStock{{3, 1}, {1, 2}, {2, 4}}, 7, []warehouseStock{{2, 4}, {1, 2}, {3, 1}}, false},
+		{"empty warehouses skipped", []warehouseStock{{1, 0}, {2, -1}, {3, 2}}, 2, []warehouseStock{{3, 2}}, false},
+		{"insufficient", []warehouseStock{{1, 2}, {2, 2}}, 5, nil, true},
+		{"no warehouses", nil, 1, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := allocateStock(7, tt.stocks, tt.quantity)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: allocateStock() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: allocateStock() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllocateStockKeepsInput(t *testing.T) {
+	stocks := []warehouseStock{{1, 2}, {2, 6}}
+	if _, err := allocateStock(7, stocks, 3); err != nil {
+		t.Fatal(err)
+	}
+	if want := []warehouseStock{{1, 2}, {2, 6}}; !reflect.DeepEqual(stocks, want) {
+		t.Errorf("stocks = %v after allocation, want %v", stocks, want)
+	}
+}
+
+func TestConfirmRequest(t *testing.T) {
+	var warehouse, badWarehouse int64 = 1, 0
+	tests := []struct {
+		name    string
+		req     confirmRequest
+		wantErr bool
+	}{
+		{"empty", confirmRequest{}, false},
+		{"warehouse", confirmRequest{WarehouseID: &warehouse}, false},
+		{"items", confirmRequest{Items: []confirmItem{{1, 2}, {2, 3}}}, false},
+		{"bad warehouse", confirmRequest{WarehouseID: &badWarehouse}, true},
+		{"bad item SKU", confirmRequest{Items: []confirmItem{{0, 2}}}, true},
+		{"bad item warehouse", confirmRequest{Items: []confirmItem{{1, 0}}}, true},
+		{"duplicate SKU", confirmRequest{Items: []confirmItem{{1, 2}, {1, 3}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.req.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	req := confirmRequest{WarehouseID: &warehouse, Items: []confirmItem{{SKUID: 5, WarehouseID: 3}}}
+	if got := req.warehouse(5); got == nil || *got != 3 {
+		t.Errorf("warehouse(5) = %v, want the item warehouse 3", got)
+	}
+	if got := req.warehouse(6); got == nil || *got != 1 {
+		t.Errorf("warehouse(6) = %v, want the request warehouse 1", got)
+	}
+	if got := (&confirmRequest{}).warehouse(6); got != nil {
+		t.Errorf("warehouse(6) = %v without warehouses, want nil", *got)
+	}
+}
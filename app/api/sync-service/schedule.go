@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LOAD_SCHEDULE runs full loads from a cron expression: five fields
+// (minute hour day-of-month month day-of-week) supporting *, lists, ranges
+// and steps, or one of @hourly, @daily, @weekly, @monthly. Scheduled runs
+// take the same run lock as /load and are skipped while another run holds it.
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// cronSchedule holds the allowed values of each field as bit sets
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Standard cron matches either day field when both are restricted; as in
+	// Vixie cron, a field starting with * (such as */2) is unrestricted
+	domAny, dowAny bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronField parses one field such as "*/15", "1-5" or "0,30"
+func parseCronField(expr string, field cronField) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangeExpr = part[:i]
+			parsed, err := strconv.Atoi(part[i+1:])
+			if err != nil || parsed <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field: %q", field.name, part)
+			}
+			step = parsed
+		}
+
+		low, high := field.min, field.max
+		switch {
+		case rangeExpr == "*":
+		case strings.Contains(rangeExpr, "-"):
+			bounds := strings.SplitN(rangeExpr, "-", 2)
+			var err1, err2 error
+			low, err1 = strconv.Atoi(bounds[0])
+			high, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range in %s field: %q", field.name, part)
+			}
+		default:
+			value, err := strconv.Atoi(rangeExpr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %s field: %q", field.name, part)
+			}
+			low, high = value, value
+			// "5/10" means from 5 to the end in steps of 10
+			if step > 1 {
+				high = field.max
+			}
+		}
+
+		if low < field.min || high > field.max || low > high {
+			return 0, fmt.Errorf("%s field out of range %d-%d: %q", field.name, field.min, field.max, part)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseCron parses a cron expression or macro
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression must have %d fields, got %d", len(cronFields), len(parts))
+	}
+
+	var values [5]uint64
+	for i, field := range cronFields {
+		bits, err := parseCronField(parts[i], field)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = bits
+	}
+
+	// Sunday is both 0 and 7
+	if values[4]&(1<<7) != 0 {
+		values[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute: values[0],
+		hour:   values[1],
+		dom:    values[2],
+		month:  values[3],
+		dow:    values[4],
+		domAny: strings.HasPrefix(parts[2], "*"),
+		dowAny: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dowMatch
+	case s.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
+
+// next returns the first matching minute after t
+func (s *cronSchedule) next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Five years covers every satisfiable expression, including Feb 29
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+
+	return time.Time{}, errors.New("cron expression never matches")
+}
+
+// runScheduledLoads starts a full load at every time matching LOAD_SCHEDULE
+func runScheduledLoads(expr string) {
+	schedule, err := parseCron(expr)
+	if err != nil {
+		log.Printf("Invalid LOAD_SCHEDULE %q, scheduled loads disabled: %v", expr, err)
+		return
+	}
+
+	for {
+		next, err := schedule.next(time.Now())
+		if err != nil {
+			log.Printf("LOAD_SCHEDULE %q: %v, scheduled loads disabled", expr, err)
+			return
+		}
+
+		log.Printf("Next scheduled load at %s", next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+
+		job, load, err := startLoad("schedule")
+		if err != nil {
+			var running *runningJobError
+			if errors.As(err, &running) {
+				log.Printf("Skipping scheduled load: %v", err)
+			} else {
+				log.Printf("Error starting scheduled load: %v", err)
+			}
+			continue
+		}
+
+		// Run inline, so a long load delays the next check instead of piling up
+		if err := job.run(context.Background(), load); err != nil {
+			log.Printf("Scheduled load failed: %v", err)
+		}
+	}
+}
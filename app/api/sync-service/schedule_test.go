@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"0 3 * * *", false},
+		{"*/15 * * * *", false},
+		{"0,30 9-17 * * 1-5", false},
+		{"5/10 * * * *", false},
+		{"0 0 * * 7", false},
+		{"@daily", false},
+		{" @hourly ", false},
+		{"0 3 * *", true},
+		{"0 3 * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"a * * * *", true},
+		{"1-x * * * *", true},
+		{"@yearly", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseCron(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCron(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	// 2025-01-01 is a Wednesday
+	tests := []struct {
+		expr, from, want string
+	}{
+		{"0 3 * * *", "2025-01-01 02:59", "2025-01-01 03:00"},
+		{"0 3 * * *", "2025-01-01 03:00", "2025-01-02 03:00"},
+		{"*/15 * * * *", "2025-01-01 10:07", "2025-01-01 10:15"},
+		{"5/20 * * * *", "2025-01-01 10:26", "2025-01-01 10:45"},
+		{"0,30 9-17 * * *", "2025-01-01 17:30", "2025-01-02 09:00"},
+		{"@hourly", "2025-01-01 10:00", "2025-01-01 11:00"},
+		{"@weekly", "2025-01-01 00:00", "2025-01-05 00:00"},
+		{"0 0 * * 7", "2025-01-01 00:00", "2025-01-05 00:00"},
+		{"@monthly", "2025-01-15 12:00", "2025-02-01 00:00"},
+		{"0 0 31 * *", "2025-02-01 00:00", "2025-03-31 00:00"},
+		{"0 0 29 2 *", "2025-01-01 00:00", "2028-02-29 00:00"},
+		{"0 0 1 1 *", "2025-12-31 23:59", "2026-01-01 00:00"},
+		// Both day fields restricted: either matches
+		{"0 0 15 * 1", "2025-01-01 00:00", "2025-01-06 00:00"},
+		{"0 0 2 * 1", "2025-01-01 00:00", "2025-01-02 00:00"},
+		// Only one restricted: it alone decides
+		{"0 0 * * 1", "2025-01-01 00:00", "2025-01-06 00:00"},
+		{"0 0 15 * *", "2025-01-01 00:00", "2025-01-15 00:00"},
+		// A stepped star is unrestricted, so only the day of week counts
+		{"0 0 */2 * 1", "2025-01-01 00:00", "2025-01-06 00:00"},
+		{"0 0 1 * */7", "2025-01-01 00:00", "2025-02-01 00:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" from "+tt.from, func(t *testing.T) {
+			schedule, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := schedule.next(at(tt.from))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := at(tt.want); !got.Equal(want) {
+				t.Errorf("next = %s, want %s", got.Format("2006-01-02 15:04 Mon"), want.Format("2006-01-02 15:04 Mon"))
+			}
+		})
+	}
+}
+
+func TestCronNextNeverMatches(t *testing.T) {
+	schedule, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schedule.next(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected an error for Feb 30")
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sitemap command writes sitemap.xml as a sitemap index pointing to
+// shards of at most 50,000 URLs: one URL per product with lastmod from the
+// latest product or SKU update, and optionally filter landing pages. Filter
+// pages come from SITEMAP_FILTERS, a comma separated whitelist of option
+// combinations such as "color,color+size"; a page is listed for every
+// combination of values that the index has products for, which is the same
+// option_value_ids data product-service builds its facets from.
+
+const (
+	sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	sitemapMaxURLs   = 50000
+)
+
+type sitemapConfig struct {
+	Dir         string
+	BaseURL     string
+	ProductURL  string
+	FilterURL   string
+	Filters     [][]string
+	MinProducts int
+	ShardSize   int
+	BatchSize   int
+}
+
+func loadSitemapConfig() (*sitemapConfig, error) {
+	config := &sitemapConfig{
+		Dir:        getEnv("SITEMAP_DIR", "."),
+		BaseURL:    strings.TrimSuffix(getEnv("SITEMAP_BASE_URL", "https://example.com"), "/"),
+		ProductURL: getEnv("SITEMAP_PRODUCT_URL", getEnv("FEED_PRODUCT_URL", "https://example.com/products/{id}")),
+		FilterURL:  getEnv("SITEMAP_FILTER_URL", "https://example.com/catalog?{filters}"),
+	}
+
+	var err error
+	if config.MinProducts, err = strconv.Atoi(getEnv("SITEMAP_FILTER_MIN_PRODUCTS", "1")); err != nil || config.MinProducts <= 0 {
+		return nil, errors.New("invalid SITEMAP_FILTER_MIN_PRODUCTS: must be a positive number")
+	}
+	if config.ShardSize, err = strconv.Atoi(getEnv("SITEMAP_SHARD_SIZE", strconv.Itoa(sitemapMaxURLs))); err != nil ||
+		config.ShardSize <= 0 || config.ShardSize > sitemapMaxURLs {
+		return nil, fmt.Errorf("invalid SITEMAP_SHARD_SIZE: must be between 1 and %d", sitemapMaxURLs)
+	}
+	if config.BatchSize, err = strconv.Atoi(getEnv("SITEMAP_BATCH_SIZE", "500")); err != nil || config.BatchSize <= 0 {
+		return nil, errors.New("invalid SITEMAP_BATCH_SIZE: must be a positive number")
+	}
+
+	for _, combination := range strings.Split(getEnv("SITEMAP_FILTERS", ""), ",") {
+		var options []string
+		for _, option := range strings.Split(combination, "+") {
+			if option = strings.TrimSpace(option); option != "" {
+				options = append(options, option)
+			}
+		}
+		if len(options) > 0 {
+			config.Filters = append(config.Filters, options)
+		}
+	}
+
+	return config, nil
+}
+
+// sitemapShards writes URLs into numbered shard files, starting a new shard
+// when the current one is full
+type sitemapShards struct {
+	config  *sitemapConfig
+	prefix  string
+	file    *atomicFile
+	encoder *xml.Encoder
+	inShard int
+	names   []string
+}
+
+var (
+	sitemapURLSet = xml.StartElement{
+		Name: xml.Name{Local: "urlset"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: sitemapNamespace}},
+	}
+	sitemapIndex = xml.StartElement{
+		Name: xml.Name{Local: "sitemapindex"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: sitemapNamespace}},
+	}
+)
+
+type sitemapURL struct {
+	XMLName xml.Name `xml:"url"`
+	Loc     string   `xml:"loc"`
+	LastMod string   `xml:"lastmod,omitempty"`
+}
+
+type sitemapEntry struct {
+	XMLName xml.Name `xml:"sitemap"`
+	Loc     string   `xml:"loc"`
+	LastMod string   `xml:"lastmod"`
+}
+
+func startSitemapXML(w io.Writer, root xml.StartElement) (*xml.Encoder, error) {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return nil, err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder, encoder.EncodeToken(root)
+}
+
+func (s *sitemapShards) add(loc string, lastMod *time.Time) error {
+	if s.file != nil && s.inShard >= s.config.ShardSize {
+		if err := s.finishShard(); err != nil {
+			return err
+		}
+	}
+
+	if s.file == nil {
+		name := fmt.Sprintf("%s-%d.xml", s.prefix, len(s.names)+1)
+		file, err := createAtomic(filepath.Join(s.config.Dir, name))
+		if err != nil {
+			return err
+		}
+		s.file, s.inShard = file, 0
+		if s.encoder, err = startSitemapXML(file, sitemapURLSet); err != nil {
+			return err
+		}
+		s.names = append(s.names, name)
+	}
+
+	entry := sitemapURL{Loc: loc}
+	if lastMod != nil {
+		entry.LastMod = lastMod.UTC().Format(time.RFC3339)
+	}
+	if err := s.encoder.Encode(&entry); err != nil {
+		return err
+	}
+	s.inShard++
+	return nil
+}
+
+func (s *sitemapShards) finishShard() error {
+	file := s.file
+	s.file = nil
+	if err := s.encoder.EncodeToken(sitemapURLSet.End()); err != nil {
+		file.abort()
+		return err
+	}
+	if err := s.encoder.Flush(); err != nil {
+		file.abort()
+		return err
+	}
+	return file.commit()
+}
+
+// close finishes the last shard
+func (s *sitemapShards) close() error {
+	if s.file != nil {
+		return s.finishShard()
+	}
+	return nil
+}
+
+// removeStale removes shards left over from a larger previous run. It must
+// only run once the new index no longer lists them.
+func (s *sitemapShards) removeStale() {
+	stale, _ := filepath.Glob(filepath.Join(s.config.Dir, s.prefix+"-*.xml"))
+	for _, path := range stale {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), s.prefix+"-"), ".xml"))
+		if err == nil && n > len(s.names) {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error removing stale sitemap shard: %v", err)
+			}
+		}
+	}
+}
+
+func (s *sitemapShards) abort() {
+	if s.file != nil {
+		s.file.abort()
+		s.file = nil
+	}
+}
+
+// parseDBTime parses a timestamp scanned into a string, with or without
+// parseTime in the DSN
+func parseDBTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// productLastMod returns the latest update of a product or its SKUs
+func productLastMod(product *Product) *time.Time {
+	var latest *time.Time
+	stamps := []string{product.UpdatedAt}
+	for i := range product.SKUs {
+		stamps = append(stamps, product.SKUs[i].UpdatedAt)
+	}
+	for _, stamp := range stamps {
+		if t, ok := parseDBTime(stamp); ok && (latest == nil || t.After(*latest)) {
+			latest = &t
+		}
+	}
+	return latest
+}
+
+// filterPage is one combination of values with products in the index
+type filterPage struct {
+	optionIDs []int64
+	valueIDs  []int64
+}
+
+// query renders the page filters in the product-service format
+func (p *filterPage) query() string {
+	parts := make([]string, len(p.valueIDs))
+	for i := range p.valueIDs {
+		parts[i] = url.QueryEscape(fmt.Sprintf("filters[%d]", p.optionIDs[i])) + "=" + strconv.FormatInt(p.valueIDs[i], 10)
+	}
+	return strings.Join(parts, "&")
+}
+
+// findFilterPages counts the products of every value combination of the
+// whitelisted options and returns those with enough products
+func findFilterPages(ctx context.Context, config *sitemapConfig) ([]filterPage, error) {
+	names := make(map[string]bool)
+	for _, combination := range config.Filters {
+		for _, name := range combination {
+			names[name] = true
+		}
+	}
+
+	placeholders := make([]string, 0, len(names))
+	args := make([]interface{}, 0, len(names))
+	for name := range names {
+		placeholders = append(placeholders, "?")
+		args = append(args, name)
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT ov.id, o.id, o.name FROM option_values ov
+		JOIN options o ON o.id = ov.option_id
+		WHERE o.name IN (%s)`, strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading filter options: %w", err)
+	}
+	type valueOption struct {
+		id   int64
+		name string
+	}
+	valueOptions := make(map[int64]valueOption)
+	for rows.Next() {
+		var valueID int64
+		var option valueOption
+		if err := rows.Scan(&valueID, &option.id, &option.name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning filter options: %w", err)
+		}
+		valueOptions[valueID] = option
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	pages := make(map[string]filterPage)
+	stream := &indexProductStream{ctx: ctx, namespace: getEnv("REINDEXER_DB", "products_db"), batchSize: config.BatchSize}
+	for {
+		doc, err := stream.next()
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			break
+		}
+
+		byOption := make(map[string][]int64)
+		optionIDs := make(map[string]int64)
+		for _, valueID := range uniqueIDs(doc.OptionValueIDs) {
+			if option, ok := valueOptions[valueID]; ok {
+				byOption[option.name] = append(byOption[option.name], valueID)
+				optionIDs[option.name] = option.id
+			}
+		}
+
+		for _, combination := range config.Filters {
+			// Every combination of one value per option is a page with this product
+			partial := [][]int64{nil}
+			for _, name := range combination {
+				var extended [][]int64
+				for _, prefix := range partial {
+					for _, valueID := range byOption[name] {
+						extended = append(extended, append(append([]int64(nil), prefix...), valueID))
+					}
+				}
+				partial = extended
+			}
+
+			for _, valueIDs := range partial {
+				page := filterPage{valueIDs: valueIDs}
+				for _, name := range combination {
+					page.optionIDs = append(page.optionIDs, optionIDs[name])
+				}
+				key := page.query()
+				counts[key]++
+				pages[key] = page
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(pages))
+	for key := range pages {
+		if counts[key] >= config.MinProducts {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]filterPage, len(keys))
+	for i, key := range keys {
+		result[i] = pages[key]
+	}
+	return result, nil
+}
+
+// writeSitemapIndex replaces sitemap.xml with an index of the shards
+func writeSitemapIndex(config *sitemapConfig, shardSets []*sitemapShards) error {
+	return writeFileAtomic(filepath.Join(config.Dir, "sitemap.xml"), func(w io.Writer) error {
+		encoder, err := startSitemapXML(w, sitemapIndex)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		for _, set := range shardSets {
+			for _, name := range set.names {
+				if err := encoder.Encode(&sitemapEntry{Loc: config.BaseURL + "/" + name, LastMod: now}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := encoder.EncodeToken(sitemapIndex.End()); err != nil {
+			return err
+		}
+		return encoder.Flush()
+	})
+}
+
+// writeSitemaps writes the product and filter shards, then the index, and
+// only then removes shards the previous index listed and the new one does not
+func writeSitemaps(ctx context.Context, config *sitemapConfig) error {
+	var shardSets []*sitemapShards
+
+	products := &sitemapShards{config: config, prefix: "sitemap-products"}
+	defer products.abort()
+	count := 0
+	err := walkProducts(ctx, config.BatchSize, func(product *Product) error {
+		count++
+		return products.add(expandProductURL(config.ProductURL, product), productLastMod(product))
+	})
+	if err != nil {
+		return err
+	}
+	if err := products.close(); err != nil {
+		return err
+	}
+	shardSets = append(shardSets, products)
+	log.Printf("Sitemap: %d product URLs in %d shards", count, len(products.names))
+
+	filters := &sitemapShards{config: config, prefix: "sitemap-filters"}
+	defer filters.abort()
+	if len(config.Filters) > 0 {
+		pages, err := findFilterPages(ctx, config)
+		if err != nil {
+			return err
+		}
+		for i := range pages {
+			loc := strings.ReplaceAll(config.FilterURL, "{filters}", pages[i].query())
+			if err := filters.add(loc, nil); err != nil {
+				return err
+			}
+		}
+		log.Printf("Sitemap: %d filter URLs in %d shards", len(pages), len(filters.names))
+	}
+	if err := filters.close(); err != nil {
+		return err
+	}
+	shardSets = append(shardSets, filters)
+
+	if err := writeSitemapIndex(config, shardSets); err != nil {
+		return err
+	}
+	for _, set := range shardSets {
+		set.removeStale()
+	}
+	return nil
+}
+
+// runSitemap implements the sitemap CLI command
+func runSitemap(args []string) error {
+	config, err := loadSitemapConfig()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("sitemap", flag.ExitOnError)
+	flags.StringVar(&config.Dir, "dir", config.Dir, "output directory (SITEMAP_DIR)")
+	flags.StringVar(&config.BaseURL, "base-url", config.BaseURL, "URL the output directory is served from (SITEMAP_BASE_URL)")
+	flags.Parse(args)
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return err
+	}
+	if err := writeSitemaps(context.Background(), config); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", filepath.Join(config.Dir, "sitemap.xml"))
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readSitemapLocs(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		URLs     []sitemapURL   `xml:"url"`
+		Sitemaps []sitemapEntry `xml:"sitemap"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	var locs []string
+	for _, u := range doc.URLs {
+		locs = append(locs, u.Loc)
+	}
+	for _, s := range doc.Sitemaps {
+		locs = append(locs, s.Loc)
+	}
+	return locs
+}
+
+func TestSitemapShards(t *testing.T) {
+	dir := t.TempDir()
+	config := &sitemapConfig{Dir: dir, BaseURL: "https://example.com/sitemaps", ShardSize: 2}
+
+	// Left over from a previous run with more products
+	for _, name := range []string{"sitemap-products-3.xml", "sitemap-products-4.xml", "sitemap-products-x.xml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("old"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shards := &sitemapShards{config: config, prefix: "sitemap-products"}
+	defer shards.abort()
+	lastMod := time.Date(2025, 1, 2, 3, 4, 5, 0, time.FixedZone("MSK", 3*3600))
+	for i := 1; i <= 3; i++ {
+		if err := shards.add(fmt.Sprintf("https://example.com/p/%d?a=1&b=2", i), &lastMod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := shards.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"sitemap-products-1.xml", "sitemap-products-2.xml"}; !reflect.DeepEqual(shards.names, want) {
+		t.Fatalf("names = %v, want %v", shards.names, want)
+	}
+	if got := readSitemapLocs(t, filepath.Join(dir, "sitemap-products-1.xml")); !reflect.DeepEqual(got,
+		[]string{"https://example.com/p/1?a=1&b=2", "https://example.com/p/2?a=1&b=2"}) {
+		t.Errorf("first shard = %v", got)
+	}
+	if got := readSitemapLocs(t, filepath.Join(dir, "sitemap-products-2.xml")); len(got) != 1 {
+		t.Errorf("second shard = %v", got)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "sitemap-products-1.xml"))
+	var urlset struct {
+		URLs []sitemapURL `xml:"url"`
+	}
+	if err := xml.Unmarshal(data, &urlset); err != nil || urlset.URLs[0].LastMod != "2025-01-02T00:04:05Z" {
+		t.Errorf("lastmod = %+v, %v", urlset.URLs, err)
+	}
+
+	// Stale shards stay until the new index is written
+	if _, err := os.Stat(filepath.Join(dir, "sitemap-products-3.xml")); err != nil {
+		t.Errorf("stale shard removed before the index was replaced: %v", err)
+	}
+
+	empty := &sitemapShards{config: config, prefix: "sitemap-filters"}
+	if err := empty.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSitemapIndex(config, []*sitemapShards{shards, empty}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://example.com/sitemaps/sitemap-products-1.xml",
+		"https://example.com/sitemaps/sitemap-products-2.xml",
+	}
+	if got := readSitemapLocs(t, filepath.Join(dir, "sitemap.xml")); !reflect.DeepEqual(got, want) {
+		t.Errorf("index = %v, want %v", got, want)
+	}
+
+	shards.removeStale()
+	for name, kept := range map[string]bool{
+		"sitemap-products-1.xml": true,
+		"sitemap-products-2.xml": true,
+		"sitemap-products-3.xml": false,
+		"sitemap-products-4.xml": false,
+		"sitemap-products-x.xml": true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != kept {
+			t.Errorf("%s exists = %v, want %v", name, exists, kept)
+		}
+	}
+
+	// No temporary files are left behind
+	entries, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(entries) != 0 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
+
+func TestFilterPageQuery(t *testing.T) {
+	page := filterPage{optionIDs: []int64{3, 5}, valueIDs: []int64{10, 20}}
+	if got, want := page.query(), "filters%5B3%5D=10&filters%5B5%5D=20"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+}
+
+func TestProductLastMod(t *testing.T) {
+	product := &Product{
+		UpdatedAt: "2025-01-01 10:00:00",
+		SKUs:      []SKU{{UpdatedAt: "2025-01-03T10:00:00Z"}, {UpdatedAt: "2025-01-02 10:00:00"}, {UpdatedAt: "bad"}},
+	}
+	got := productLastMod(product)
+	if want := time.Date(2025, 1, 3, 10, 0, 0, 0, time.UTC); got == nil || !got.Equal(want) {
+		t.Errorf("lastmod = %v, want %v", got, want)
+	}
+	if productLastMod(&Product{UpdatedAt: ""}) != nil {
+		t.Error("lastmod without timestamps must be nil")
+	}
+}
+
+func TestLoadSitemapConfigFilters(t *testing.T) {
+	t.Setenv("SITEMAP_FILTERS", " color , color+ size ,, +")
+	config, err := loadSitemapConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"color"}, {"color", "size"}}; !reflect.DeepEqual(config.Filters, want) {
+		t.Errorf("filters = %v, want %v", config.Filters, want)
+	}
+
+	t.Setenv("SITEMAP_SHARD_SIZE", "50001")
+	if _, err := loadSitemapConfig(); err == nil {
+		t.Error("expected an error for a shard size over 50,000")
+	}
+}
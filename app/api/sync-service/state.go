@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/restream/reindexer/v5"
+)
+
+// SyncState is a key/value record persisted in Reindexer next to the index.
+// It lives in its own namespace, so full loads that drop the products
+// namespace keep it.
+type SyncState struct {
+	Key       string `reindex:"key,hash,pk" json:"key"`
+	Value     string `json:"value"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+func stateNamespace() string {
+	return getEnv("REINDEXER_STATE_DB", "sync_state")
+}
+
+func initSyncState() error {
+	if err := rx.OpenNamespace(stateNamespace(), reindexer.DefaultNamespaceOptions(), SyncState{}); err != nil {
+		return fmt.Errorf("error opening namespace %s: %w", stateNamespace(), err)
+	}
+	return nil
+}
+
+// getState decodes the state stored under key into v and reports whether it was found
+func getState(key string, v interface{}) (bool, error) {
+	item, found := rx.Query(stateNamespace()).WhereString("key", reindexer.EQ, key).Get()
+	if !found {
+		return false, nil
+	}
+
+	if err := json.Unmarshal([]byte(item.(*SyncState).Value), v); err != nil {
+		return false, fmt.Errorf("error decoding state %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// putState stores v under key
+func putState(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding state %s: %w", key, err)
+	}
+
+	state := &SyncState{
+		Key:       key,
+		Value:     string(data),
+		UpdatedAt: time.Now().Unix(),
+	}
+	if err := rx.Upsert(stateNamespace(), state); err != nil {
+		return fmt.Errorf("error saving state %s: %w", key, err)
+	}
+	return nil
+}
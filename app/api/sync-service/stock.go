@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Stock updates. A change either sets the count or adds a delta to it; the
+// SKU row is locked while the new count is computed, so concurrent deltas
+// serialize and a delta that would take the count below zero is refused.
+// The affected products are reindexed before the response, which keeps the
+// in_stock index data current.
+//
+// With warehouse_id the change applies to the quantity in that warehouse and
+// skus.count follows as the total (see migration 005). A SKU that has
+// per-warehouse quantities only accepts changes with a warehouse_id.
+//
+//	PATCH /skus/{id}/stock  {"set": 10} or {"delta": -2, "warehouse_id"?: 1}
+//	PATCH /stock            {"items": [{"barcode": "...", "delta": -1}], "atomic": false}
+
+// maxStockItems limits the size of a bulk stock update
+const maxStockItems = 1000
+
+type stockChange struct {
+	Set         *int   `json:"set"`
+	Delta       *int   `json:"delta"`
+	WarehouseID *int64 `json:"warehouse_id"`
+}
+
+func (c *stockChange) validate() error {
+	switch {
+	case c.Set == nil && c.Delta == nil:
+		return badRequest("either set or delta is required")
+	case c.Set != nil && c.Delta != nil:
+		return badRequest("set and delta are mutually exclusive")
+	case c.Set != nil && *c.Set < 0:
+		return badRequest("set must not be negative")
+	case c.WarehouseID != nil && *c.WarehouseID <= 0:
+		return badRequest("invalid warehouse_id")
+	}
+	return nil
+}
+
+// apply returns the quantity after the change
+func (c *stockChange) apply(previous int) (int, error) {
+	quantity := previous
+	if c.Set != nil {
+		quantity = *c.Set
+	} else {
+		quantity += *c.Delta
+	}
+	if quantity < 0 {
+		return 0, conflict("insufficient stock: %d available, delta %d", previous, *c.Delta)
+	}
+	return quantity, nil
+}
+
+// stockResult reports a change. With a warehouse, Previous and Count are the
+// quantities in it; Total is always skus.count afterwards.
+type stockResult struct {
+	SKUID       int64  `json:"sku_id,omitempty"`
+	ProductID   int64  `json:"product_id,omitempty"`
+	Barcode     string `json:"barcode,omitempty"`
+	WarehouseID *int64 `json:"warehouse_id,omitempty"`
+	Previous    int    `json:"previous"`
+	Count       int    `json:"count"`
+	Total       int    `json:"total"`
+	Error       string `json:"error,omitempty"`
+}
+
+// applyStock changes the count of a SKU locked by the caller, whose current
+// count is in result.Previous
+func applyStock(ctx context.Context, tx *sql.Tx, result *stockResult, change *stockChange) error {
+	if change.WarehouseID != nil {
+		return applyWarehouseStock(ctx, tx, result, change)
+	}
+
+	perWarehouse, err := hasWarehouseStock(ctx, tx, result.SKUID)
+	if err != nil {
+		return fmt.Errorf("error reading warehouse stock of SKU %d: %w", result.SKUID, err)
+	}
+	if perWarehouse {
+		return conflict("SKU %d keeps stock per warehouse, warehouse_id is required", result.SKUID)
+	}
+
+	count, err := change.apply(result.Previous)
+	if err != nil {
+		return err
+	}
+	if count != result.Previous {
+		if _, err := tx.ExecContext(ctx, "UPDATE skus SET count = ? WHERE id = ?", count, result.SKUID); err != nil {
+			return fmt.Errorf("error updating stock of SKU %d: %w", result.SKUID, err)
+		}
+	}
+	result.Count = count
+	result.Total = count
+	return nil
+}
+
+// applyWarehouseStock changes the quantity of a locked SKU in one warehouse.
+// The first warehouse quantity of a SKU replaces its plain count.
+func applyWarehouseStock(ctx context.Context, tx *sql.Tx, result *stockResult, change *stockChange) error {
+	warehouseID := *change.WarehouseID
+	result.WarehouseID = &warehouseID
+
+	previous := 0
+	err := tx.QueryRowContext(ctx,
+		"SELECT quantity FROM sku_stocks WHERE sku_id = ? AND warehouse_id = ? FOR UPDATE",
+		result.SKUID, warehouseID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		err = warehouseExists(ctx, tx, warehouseID)
+	}
+	if err != nil {
+		return err
+	}
+
+	quantity, err := change.apply(previous)
+	if err != nil {
+		return err
+	}
+	// The sku_stocks triggers recompute skus.count
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sku_stocks (sku_id, warehouse_id, quantity) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE quantity = VALUES(quantity)`, result.SKUID, warehouseID, quantity)
+	if err != nil {
+		return fmt.Errorf("error updating stock of SKU %d in warehouse %d: %w", result.SKUID, warehouseID, err)
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT count FROM skus WHERE id = ?", result.SKUID).Scan(&result.Total); err != nil {
+		return fmt.Errorf("error reading stock of SKU %d: %w", result.SKUID, err)
+	}
+
+	result.Previous = previous
+	result.Count = quantity
+	return nil
+}
+
+func updateStockHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var change stockChange
+	if err := decodeBody(r, &change); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := change.validate(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	result := &stockResult{SKUID: id}
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		err := tx.QueryRowContext(r.Context(), "SELECT product_id, count FROM skus WHERE id = ? FOR UPDATE", id).
+			Scan(&result.ProductID, &result.Previous)
+		if err == sql.ErrNoRows {
+			return nil, notFound("SKU %d not found", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := applyStock(r.Context(), tx, result, &change); err != nil {
+			return nil, err
+		}
+		return []int64{result.ProductID}, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+type bulkStockItem struct {
+	Barcode string `json:"barcode"`
+	stockChange
+}
+
+type bulkStockRequest struct {
+	Items []bulkStockItem `json:"items"`
+	// Atomic rolls everything back when any item fails
+	Atomic bool `json:"atomic"`
+}
+
+type bulkStockResponse struct {
+	Applied int            `json:"applied"`
+	Failed  int            `json:"failed"`
+	Items   []*stockResult `json:"items"`
+}
+
+// resolveBarcode finds the single SKU with the barcode without locking it,
+// so the rows of a bulk update can be locked in ID order afterwards
+func resolveBarcode(ctx context.Context, tx *sql.Tx, result *stockResult) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM skus WHERE barcode = ?", result.Barcode)
+	if err != nil {
+		return fmt.Errorf("error looking up barcode %s: %w", result.Barcode, err)
+	}
+	defer rows.Close()
+
+	found := 0
+	for rows.Next() {
+		if err := rows.Scan(&result.SKUID); err != nil {
+			return err
+		}
+		found++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case found == 0:
+		return notFound("no SKU with barcode %s", result.Barcode)
+	case found > 1:
+		return conflict("barcode %s is shared by %d SKUs", result.Barcode, found)
+	}
+	return nil
+}
+
+// lockResolvedSKU locks the SKU a barcode was resolved to. A SKU whose
+// barcode changed or that was deleted since then is refused.
+func lockResolvedSKU(ctx context.Context, tx *sql.Tx, result *stockResult) error {
+	err := tx.QueryRowContext(ctx, "SELECT product_id, count FROM skus WHERE id = ? AND barcode = ? FOR UPDATE",
+		result.SKUID, result.Barcode).Scan(&result.ProductID, &result.Previous)
+	if err == sql.ErrNoRows {
+		return conflict("barcode %s changed during the update, retry the item", result.Barcode)
+	}
+	if err != nil {
+		return fmt.Errorf("error locking SKU %d: %w", result.SKUID, err)
+	}
+	return nil
+}
+
+func bulkStockHandler(w http.ResponseWriter, r *http.Request) {
+	var req bulkStockRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxStockItems {
+		writeAPIError(w, badRequest("provide 1-%d items", maxStockItems))
+		return
+	}
+
+	response := &bulkStockResponse{Items: make([]*stockResult, len(req.Items))}
+	for i := range req.Items {
+		response.Items[i] = &stockResult{Barcode: req.Items[i].Barcode}
+		if req.Items[i].Barcode == "" {
+			response.Items[i].Error = "barcode is required"
+		} else if err := req.Items[i].validate(); err != nil {
+			response.Items[i].Error = err.Error()
+		}
+	}
+
+	err := withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		for _, result := range response.Items {
+			if result.Error != "" {
+				continue
+			}
+			if err := resolveBarcode(r.Context(), tx, result); err != nil {
+				var apiErr *apiError
+				if !errors.As(err, &apiErr) {
+					return nil, err
+				}
+				result.Error = err.Error()
+			}
+		}
+
+		// SKU rows are locked in ID order like reservations do, so concurrent
+		// stock updates and reservations cannot deadlock
+		order := make([]int, len(req.Items))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return response.Items[order[a]].SKUID < response.Items[order[b]].SKUID })
+
+		var affected []int64
+		for _, i := range order {
+			result := response.Items[i]
+			if result.Error != "" {
+				continue
+			}
+
+			err := lockResolvedSKU(r.Context(), tx, result)
+			if err == nil {
+				err = applyStock(r.Context(), tx, result, &req.Items[i].stockChange)
+			}
+			if err != nil {
+				var apiErr *apiError
+				if !errors.As(err, &apiErr) {
+					return nil, err
+				}
+				result.Error = err.Error()
+				continue
+			}
+			affected = append(affected, result.ProductID)
+		}
+
+		for _, result := range response.Items {
+			if result.Error != "" {
+				response.Failed++
+			}
+		}
+		if req.Atomic && response.Failed > 0 {
+			return nil, conflict("atomic update rolled back")
+		}
+		response.Applied = len(affected)
+		return affected, nil
+	})
+
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, response)
+	case req.Atomic && response.Failed > 0:
+		// Report which items failed; nothing was applied
+		writeJSON(w, http.StatusConflict, response)
+	default:
+		writeAPIError(w, err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestStockChangeValidate(t *testing.T) {
+	var warehouse, badWarehouse int64 = 2, 0
+	tests := []struct {
+		name    string
+		change  stockChange
+		wantErr bool
+	}{
+		{"set", stockChange{Set: intPtr(10)}, false},
+		{"set zero", stockChange{Set: intPtr(0)}, false},
+		{"negative delta", stockChange{Delta: intPtr(-3)}, false},
+		{"warehouse", stockChange{Delta: intPtr(1), WarehouseID: &warehouse}, false},
+		{"empty", stockChange{}, true},
+		{"set and delta", stockChange{Set: intPtr(1), Delta: intPtr(1)}, true},
+		{"negative set", stockChange{Set: intPtr(-1)}, true},
+		{"bad warehouse", stockChange{Set: intPtr(1), WarehouseID: &badWarehouse}, true},
+	}
+	for _, tt := range tests {
+		err := tt.change.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var apiErr *apiError
+		if err != nil && (!errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest) {
+			t.Errorf("%s: validate() error = %v, want a 400 apiError", tt.name, err)
+		}
+	}
+}
+
+func TestStockChangeApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   stockChange
+		previous int
+		want     int
+		wantErr  bool
+	}{
+		{"set", stockChange{Set: intPtr(7)}, 3, 7, false},
+		{"set below previous", stockChange{Set: intPtr(0)}, 3, 0, false},
+		{"delta", stockChange{Delta: intPtr(2)}, 3, 5, false},
+		{"delta to zero", stockChange{Delta: intPtr(-3)}, 3, 0, false},
+		{"delta below zero", stockChange{Delta: intPtr(-4)}, 3, 0, true},
+		{"delta on empty stock", stockChange{Delta: intPtr(-1)}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.change.apply(tt.previous)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: apply(%d) error = %v, want error %v", tt.name, tt.previous, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) || apiErr.Status != http.StatusConflict {
+				t.Errorf("%s: apply(%d) error = %v, want a 409 apiError", tt.name, tt.previous, err)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: apply(%d) = %d, want %d", tt.name, tt.previous, got, tt.want)
+		}
+	}
+}
+
+func TestBulkStockHandlerItemLimit(t *testing.T) {
+	tooMany := `{"items": [` + strings.Repeat(`{"barcode": "1", "delta": 1},`, maxStockItems) + `{"barcode": "1", "delta": 1}]}`
+	for _, body := range []string{`{"items": []}`, `{}`, tooMany} {
+		w := httptest.NewRecorder()
+		bulkStockHandler(w, httptest.NewRequest(http.MethodPatch, "/stock", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("bulk stock with %d bytes: status %d, want %d", len(body), w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBulkStockLocksInIDOrder(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectBegin()
+	resolve := regexp.QuoteMeta("SELECT id FROM skus WHERE barcode = ?")
+	mock.ExpectQuery(resolve).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectQuery(resolve).WithArgs("B").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectQuery(resolve).WithArgs("C").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	// Barcode B sorts after A but its SKU is locked first
+	lock := regexp.QuoteMeta("SELECT product_id, count FROM skus WHERE id = ? AND barcode = ? FOR UPDATE")
+	for _, sku := range []struct {
+		id      int64
+		barcode string
+	}{{3, "B"}, {9, "A"}} {
+		mock.ExpectQuery(lock).WithArgs(sku.id, sku.barcode).
+			WillReturnRows(sqlmock.NewRows([]string{"product_id", "count"}).AddRow(sku.id*10, 5))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM sku_stocks WHERE sku_id = ?)")).
+			WithArgs(sku.id).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE skus SET count = ? WHERE id = ?")).
+			WithArgs(4, sku.id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	// The unknown barcode C fails the atomic update
+	mock.ExpectRollback()
+
+	body := `{"items": [{"barcode": "A", "delta": -1}, {"barcode": "B", "delta": -1}, {"barcode": "C", "delta": -1}], "atomic": true}`
+	w := httptest.NewRecorder()
+	bulkStockHandler(w, httptest.NewRequest(http.MethodPatch, "/stock", strings.NewReader(body)))
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	var response bulkStockResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Failed != 1 || response.Items[2].Error == "" || response.Items[0].SKUID != 9 || response.Items[1].SKUID != 3 {
+		t.Errorf("unexpected response %s", w.Body)
+	}
+}
+
+func TestBulkStockBarcodeChanged(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM skus WHERE barcode = ?")).
+		WithArgs("A").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	// Renamed by a concurrent write before the lock was taken
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT product_id, count FROM skus WHERE id = ? AND barcode = ? FOR UPDATE")).
+		WithArgs(9, "A").
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "count"}))
+	mock.ExpectCommit()
+
+	w := httptest.NewRecorder()
+	bulkStockHandler(w, httptest.NewRequest(http.MethodPatch, "/stock", strings.NewReader(`{"items": [{"barcode": "A", "set": 1}]}`)))
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "changed during the update") {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/restream/reindexer/v5"
+)
+
+// verifyReport lists the differences between MySQL and the index
+type verifyReport struct {
+	Checked   int     `json:"checked"`
+	Missing   []int64 `json:"missing"`
+	Extra     []int64 `json:"extra"`
+	Divergent []int64 `json:"divergent"`
+	Repaired  int     `json:"repaired"`
+}
+
+// mysqlProductStream yields assembled products from MySQL in product_id order
+type mysqlProductStream struct {
+	ctx       context.Context
+	batchSize int
+	fromID    int64
+	buffer    []ProductIDs
+	done      bool
+}
+
+func (s *mysqlProductStream) next() (*ProductIDs, error) {
+	if len(s.buffer) == 0 && !s.done {
+		ids, err := productIDPage(s.ctx, s.fromID, s.batchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) < s.batchSize {
+			s.done = true
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+
+		s.fromID = ids[len(ids)-1] + 1
+		if s.buffer, err = assembleProductIDs(ids); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.buffer) == 0 {
+		return nil, nil
+	}
+	product := &s.buffer[0]
+	s.buffer = s.buffer[1:]
+	return product, nil
+}
+
+// indexProductStream yields documents from Reindexer in product_id order
+type indexProductStream struct {
+	ctx       context.Context
+	namespace string
+	batchSize int
+	afterID   int64
+	started   bool
+	buffer    []*ReindexerProduct
+	done      bool
+}
+
+func (s *indexProductStream) next() (*ReindexerProduct, error) {
+	if len(s.buffer) == 0 && !s.done {
+		query := rx.Query(s.namespace).Sort("product_id", false).Limit(s.batchSize)
+		if s.started {
+			query = query.WhereInt64("product_id", reindexer.GT, s.afterID)
+		}
+
+		iterator := query.ExecCtx(s.ctx)
+		for iterator.Next() {
+			s.buffer = append(s.buffer, iterator.Object().(*ReindexerProduct))
+		}
+		err := iterator.Error()
+		iterator.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error querying Reindexer: %w", err)
+		}
+
+		s.started = true
+		if len(s.buffer) < s.batchSize {
+			s.done = true
+		}
+		if len(s.buffer) > 0 {
+			s.afterID = s.buffer[len(s.buffer)-1].ProductID
+		}
+	}
+
+	if len(s.buffer) == 0 {
+		return nil, nil
+	}
+	product := s.buffer[0]
+	s.buffer = s.buffer[1:]
+	return product, nil
+}
+
+// sameIDs compares two ID lists as sets
+func sameIDs(a, b []int64) bool {
+	a, b = uniqueIDs(a), uniqueIDs(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyIndex walks MySQL and Reindexer side by side and reports products that
+// are missing from the index, left over in it, or indexed with other options.
+// With repair set the differing products are reindexed as they are found.
+func verifyIndex(ctx context.Context, job *Job, repair bool) (*verifyReport, error) {
+	cfg, err := getLoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &verifyReport{Missing: []int64{}, Extra: []int64{}, Divergent: []int64{}}
+	source := &mysqlProductStream{ctx: ctx, batchSize: cfg.BatchSize}
+	index := &indexProductStream{ctx: ctx, namespace: getEnv("REINDEXER_DB", "products_db"), batchSize: cfg.BatchSize}
+
+	var pending []int64
+	flush := func() error {
+		if !repair || len(pending) == 0 {
+			return nil
+		}
+		result, err := reindexProducts(ctx, pending)
+		if err != nil {
+			return err
+		}
+		// The failed ones are dead-lettered and retried later
+		report.Repaired += len(pending) - result.Failed
+		pending = nil
+		return nil
+	}
+
+	job.phase("compare")
+
+	want, err := source.next()
+	if err != nil {
+		return nil, err
+	}
+	have, err := index.next()
+	if err != nil {
+		return nil, err
+	}
+
+	for want != nil || have != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case have == nil || want != nil && want.ProductID < have.ProductID:
+			report.Missing = append(report.Missing, want.ProductID)
+			pending = append(pending, want.ProductID)
+			if want, err = source.next(); err != nil {
+				return nil, err
+			}
+		case want == nil || have.ProductID < want.ProductID:
+			report.Extra = append(report.Extra, have.ProductID)
+			pending = append(pending, have.ProductID)
+			if have, err = index.next(); err != nil {
+				return nil, err
+			}
+		default:
+			if !sameIDs(want.OptionIDs, have.OptionIDs) || !sameIDs(want.OptionValueIDs, have.OptionValueIDs) ||
+				want.InStock != have.InStock || !sameIDs(want.InStockOptionValueIDs, have.InStockOptionValueIDs) ||
+				!sameIDs(want.InStockWarehouseIDs, have.InStockWarehouseIDs) {
+				report.Divergent = append(report.Divergent, want.ProductID)
+				pending = append(pending, want.ProductID)
+			}
+			if want, err = source.next(); err != nil {
+				return nil, err
+			}
+			if have, err = index.next(); err != nil {
+				return nil, err
+			}
+		}
+
+		report.Checked++
+		job.addRows(1)
+
+		if len(pending) >= reindexChunkSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func printIDs(title string, ids []int64, limit int) {
+	fmt.Printf("%s: %d\n", title, len(ids))
+	if len(ids) == 0 {
+		return
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	shown := ids
+	if limit > 0 && len(shown) > limit {
+		shown = shown[:limit]
+	}
+	fmt.Printf("  %v", shown)
+	if len(shown) < len(ids) {
+		fmt.Printf(" ... and %d more", len(ids)-len(shown))
+	}
+	fmt.Println()
+}
+
+// runVerify implements the verify CLI command
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "reindex missing, extra and divergent products")
+	limit := flags.Int("limit", 100, "maximum number of product IDs to print per category")
+	flags.Parse(args)
+
+	job := newJob("verify", "cli")
+	release, err := acquireRunLock(job.id())
+	if err != nil {
+		return err
+	}
+	defer release()
+	jobs.add(job)
+
+	var report *verifyReport
+	err = job.run(context.Background(), func(ctx context.Context, job *Job) error {
+		var err error
+		report, err = verifyIndex(ctx, job, *repair)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked: %d\n", report.Checked)
+	printIDs("Missing from index", report.Missing, *limit)
+	printIDs("Extra in index", report.Extra, *limit)
+	printIDs("Divergent", report.Divergent, *limit)
+	if *repair {
+		fmt.Printf("Repaired: %d\n", report.Repaired)
+	}
+
+	if !*repair && len(report.Missing)+len(report.Extra)+len(report.Divergent) > 0 {
+		log.Printf("Index differs from MySQL, run 'verify -repair' to fix it")
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// Warehouse management. Quantities per warehouse live in sku_stocks and are
+// changed through the stock API with a warehouse_id; skus.count is their
+// total. Deleting a warehouse that still holds quantities is refused unless
+// repeated with ?confirm=true, and removes them from the SKU totals.
+//
+//	GET    /warehouses
+//	POST   /warehouses                  {"code", "name"?}
+//	PATCH  /warehouses/{id}             {"code"?, "name"?}
+//	DELETE /warehouses/{id}[?confirm=true]
+
+type warehouseInfo struct {
+	ID   int64  `json:"id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// SKUs and Quantity count the stock held in the warehouse
+	SKUs     int `json:"skus"`
+	Quantity int `json:"quantity"`
+}
+
+// readWarehouses returns all warehouses, or the one with the ID
+func readWarehouses(ctx context.Context, id int64) ([]warehouseInfo, error) {
+	filter, args := "", []interface{}{}
+	if id > 0 {
+		filter, args = "WHERE w.id = ?", append(args, id)
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT w.id, w.code, w.name, COUNT(ss.sku_id), COALESCE(SUM(ss.quantity), 0)
+		FROM warehouses w
+		LEFT JOIN sku_stocks ss ON ss.warehouse_id = w.id AND ss.quantity > 0
+		%s
+		GROUP BY w.id, w.code, w.name
+		ORDER BY w.id`, filter), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying warehouses: %w", err)
+	}
+	defer rows.Close()
+
+	warehouses := []warehouseInfo{}
+	for rows.Next() {
+		var w warehouseInfo
+		if err := rows.Scan(&w.ID, &w.Code, &w.Name, &w.SKUs, &w.Quantity); err != nil {
+			return nil, fmt.Errorf("error scanning warehouse: %w", err)
+		}
+		warehouses = append(warehouses, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating warehouses: %w", err)
+	}
+	return warehouses, nil
+}
+
+func readWarehouse(ctx context.Context, id int64) (*warehouseInfo, error) {
+	warehouses, err := readWarehouses(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(warehouses) == 0 {
+		return nil, notFound("warehouse %d not found", id)
+	}
+	return &warehouses[0], nil
+}
+
+// warehouseExists checks the warehouse inside a transaction
+func warehouseExists(ctx context.Context, tx *sql.Tx, id int64) error {
+	var found int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM warehouses WHERE id = ?", id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return notFound("warehouse %d not found", id)
+	}
+	return err
+}
+
+// hasWarehouseStock reports whether the SKU keeps its count per warehouse
+func hasWarehouseStock(ctx context.Context, tx *sql.Tx, skuID int64) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM sku_stocks WHERE sku_id = ?)", skuID).Scan(&exists)
+	if isMissingTable(err) {
+		return false, nil
+	}
+	return exists, err
+}
+
+type warehouseInput struct {
+	Code *string `json:"code"`
+	Name *string `json:"name"`
+}
+
+func (in *warehouseInput) validate(create bool) error {
+	if err := checkText("code", in.Code, 50, create || in.Code != nil); err != nil {
+		return err
+	}
+	if err := checkText("name", in.Name, 255, in.Name != nil); err != nil {
+		return err
+	}
+	if create && in.Name == nil {
+		in.Name = in.Code
+	}
+	return nil
+}
+
+// checkWarehouseCode rejects a code used by another warehouse
+func checkWarehouseCode(ctx context.Context, tx *sql.Tx, code string, warehouseID int64) error {
+	var other int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM warehouses WHERE code = ? AND id <> ?", code, warehouseID).Scan(&other)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return conflict("warehouse code %q is already used by warehouse %d", code, other)
+}
+
+func listWarehousesHandler(w http.ResponseWriter, r *http.Request) {
+	warehouses, err := readWarehouses(r.Context(), 0)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, warehouses)
+}
+
+func createWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	var in warehouseInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(true); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var id int64
+	err := withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		if err := checkWarehouseCode(r.Context(), tx, *in.Code, 0); err != nil {
+			return nil, err
+		}
+		result, err := tx.ExecContext(r.Context(), "INSERT INTO warehouses (code, name) VALUES (?, ?)", *in.Code, *in.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error creating warehouse: %w", err)
+		}
+		id, err = result.LastInsertId()
+		return nil, err
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	warehouse, err := readWarehouse(r.Context(), id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/warehouses/%d", id))
+	writeJSON(w, http.StatusCreated, warehouse)
+}
+
+func updateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var in warehouseInput
+	if err := decodeBody(r, &in); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := in.validate(false); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	// The index only holds warehouse IDs, so nothing is reindexed
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		if err := warehouseExists(r.Context(), tx, id); err != nil {
+			return nil, err
+		}
+		if in.Code != nil {
+			if err := checkWarehouseCode(r.Context(), tx, *in.Code, id); err != nil {
+				return nil, err
+			}
+		}
+		_, err := tx.ExecContext(r.Context(),
+			"UPDATE warehouses SET code = COALESCE(?, code), name = COALESCE(?, name) WHERE id = ?",
+			in.Code, in.Name, id)
+		if err != nil {
+			return nil, fmt.Errorf("error updating warehouse: %w", err)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	warehouse, err := readWarehouse(r.Context(), id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, warehouse)
+}
+
+func deleteWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	warehouse, err := readWarehouse(r.Context(), id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if warehouse.SKUs > 0 && !confirmed(r) {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":     "warehouse holds stock, repeat with ?confirm=true",
+			"warehouse": warehouse,
+		})
+		return
+	}
+
+	err = withTx(r.Context(), w.Header(), func(tx *sql.Tx) ([]int64, error) {
+		affected, err := queryTxIDs(r.Context(), tx, `
+			SELECT DISTINCT s.product_id
+			FROM sku_stocks ss
+			JOIN skus s ON s.id = ss.sku_id
+			WHERE ss.warehouse_id = ?`, id)
+		if err != nil {
+			return nil, err
+		}
+		// Row by row, so the triggers recompute the SKU totals
+		if _, err := tx.ExecContext(r.Context(), "DELETE FROM sku_stocks WHERE warehouse_id = ?", id); err != nil {
+			return nil, fmt.Errorf("error deleting warehouse stock: %w", err)
+		}
+		if _, err := tx.ExecContext(r.Context(), "DELETE FROM warehouses WHERE id = ?", id); err != nil {
+			return nil, fmt.Errorf("error deleting warehouse: %w", err)
+		}
+		return affected, nil
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id, "warehouse": warehouse})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectReadWarehouse expects readWarehouse(id) to find a warehouse holding
+// skus SKUs
+func expectReadWarehouse(mock sqlmock.Sqlmock, id int64, skus int) {
+	mock.ExpectQuery(`SELECT w.id, w.code, w.name, COUNT\(ss.sku_id\)`).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "code", "name", "skus", "quantity"}).
+			AddRow(id, "MAIN", "Main", skus, skus*3))
+}
+
+func deleteWarehouse(query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/warehouses/2"+query, nil)
+	r.SetPathValue("id", "2")
+	w := httptest.NewRecorder()
+	deleteWarehouseHandler(w, r)
+	return w
+}
+
+func TestDeleteWarehouseNeedsConfirm(t *testing.T) {
+	mock := mockDB(t)
+	expectReadWarehouse(mock, 2, 4)
+
+	w := deleteWarehouse("")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "confirm=true") {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+}
+
+func TestDeleteWarehouse(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		skus  int
+		query string
+	}{
+		{"confirmed", 4, "?confirm=true"},
+		{"empty warehouse", 0, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			expectReadWarehouse(mock, 2, tt.skus)
+			mock.ExpectBegin()
+			// The stock is gone by the time the transaction runs, so no
+			// product needs a reindex
+			mock.ExpectQuery(`SELECT DISTINCT s.product_id\s+FROM sku_stocks ss`).
+				WithArgs(2).
+				WillReturnRows(sqlmock.NewRows([]string{"product_id"}))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM sku_stocks WHERE warehouse_id = ?")).
+				WithArgs(2).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM warehouses WHERE id = ?")).
+				WithArgs(2).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			if w := deleteWarehouse(tt.query); w.Code != http.StatusOK {
+				t.Errorf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+		})
+	}
+}
+
+func TestWarehouseCodeConflict(t *testing.T) {
+	checkCode := regexp.QuoteMeta("SELECT id FROM warehouses WHERE code = ? AND id <> ?")
+
+	t.Run("create", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(checkCode).WithArgs("MAIN", 0).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		createWarehouseHandler(w, httptest.NewRequest(http.MethodPost, "/warehouses", strings.NewReader(`{"code": "MAIN"}`)))
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "warehouse 1") {
+			t.Errorf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+		}
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM warehouses WHERE id = ?")).
+			WithArgs(2).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+		mock.ExpectQuery(checkCode).WithArgs("MAIN", 2).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectRollback()
+
+		r := httptest.NewRequest(http.MethodPatch, "/warehouses/2", strings.NewReader(`{"code": "MAIN"}`))
+		r.SetPathValue("id", "2")
+		w := httptest.NewRecorder()
+		updateWarehouseHandler(w, r)
+		if w.Code != http.StatusConflict {
+			t.Errorf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+		}
+	})
+
+	t.Run("same warehouse", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(checkCode).WithArgs("MAIN", 2).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectRollback()
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := checkWarehouseCode(context.Background(), tx, "MAIN", 2); err != nil {
+			t.Errorf("keeping its own code: %v", err)
+		}
+	})
+}
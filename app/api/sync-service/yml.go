@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Yandex Market YML (yml_catalog). Every SKU is an offer grouped by product
+// through group_id; option values become param elements named after the
+// option display_name. The catalog has no categories, so all offers share
+// one category named by FEED_CATEGORY.
+
+type ymlParam struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type ymlOffer struct {
+	XMLName    xml.Name   `xml:"offer"`
+	ID         int64      `xml:"id,attr"`
+	GroupID    int64      `xml:"group_id,attr"`
+	Available  bool       `xml:"available,attr"`
+	Name       string     `xml:"name"`
+	URL        string     `xml:"url,omitempty"`
+	Price      string     `xml:"price"`
+	CurrencyID string     `xml:"currencyId"`
+	CategoryID int        `xml:"categoryId"`
+	VendorCode string     `xml:"vendorCode,omitempty"`
+	Barcode    string     `xml:"barcode,omitempty"`
+	Params     []ymlParam `xml:"param"`
+	Count      int        `xml:"count"`
+}
+
+// ymlCategoryID is the ID of the single FEED_CATEGORY category
+const ymlCategoryID = 1
+
+func ymlStart(name string, attrs ...xml.Attr) xml.StartElement {
+	return xml.StartElement{Name: xml.Name{Local: name}, Attr: attrs}
+}
+
+func ymlAttr(name, value string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Local: name}, Value: value}
+}
+
+// ymlOffers builds the offers of a product, skipping SKUs without a price
+func ymlOffers(product *Product, config *feedConfig) []ymlOffer {
+	var offers []ymlOffer
+	for i := range product.SKUs {
+		sku := &product.SKUs[i]
+		price, ok := config.skuPrice(sku)
+		if !ok {
+			continue
+		}
+
+		offer := ymlOffer{
+			ID:         sku.ID,
+			GroupID:    product.ID,
+			Available:  sku.Available > 0,
+			Name:       product.Name,
+			URL:        config.productURL(product),
+			Price:      price,
+			CurrencyID: config.Currency,
+			CategoryID: ymlCategoryID,
+			VendorCode: product.Article,
+			Count:      sku.Available,
+		}
+		if sku.Barcode != nil {
+			offer.Barcode = *sku.Barcode
+		}
+		for j := range sku.Options {
+			option := &sku.Options[j]
+			if option.OptionName == config.PriceOption {
+				continue
+			}
+			offer.Params = append(offer.Params, ymlParam{Name: option.OptionDisplayName, Value: optionValue(option)})
+		}
+		offers = append(offers, offer)
+	}
+	return offers
+}
+
+// writeYMLFeed renders the catalog as a yml_catalog document
+func writeYMLFeed(ctx context.Context, w io.Writer, config *feedConfig) (int, error) {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return 0, err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	catalog := ymlStart("yml_catalog", ymlAttr("date", time.Now().Format(time.RFC3339)))
+	shop := ymlStart("shop")
+	if err := encoder.EncodeToken(catalog); err != nil {
+		return 0, err
+	}
+	if err := encoder.EncodeToken(shop); err != nil {
+		return 0, err
+	}
+
+	header := []struct {
+		name, value string
+	}{
+		{"name", config.ShopName},
+		{"company", config.Company},
+		{"url", config.ShopURL},
+	}
+	for _, field := range header {
+		if err := encoder.EncodeElement(field.value, ymlStart(field.name)); err != nil {
+			return 0, err
+		}
+	}
+
+	currencies := ymlStart("currencies")
+	currency := ymlStart("currency", ymlAttr("id", config.Currency), ymlAttr("rate", "1"))
+	categories := ymlStart("categories")
+	category := ymlStart("category", ymlAttr("id", strconv.Itoa(ymlCategoryID)))
+	offersStart := ymlStart("offers")
+	tokens := []xml.Token{
+		currencies, currency, currency.End(), currencies.End(),
+		categories, category, xml.CharData(config.Category), category.End(), categories.End(),
+		offersStart,
+	}
+	for _, token := range tokens {
+		if err := encoder.EncodeToken(token); err != nil {
+			return 0, err
+		}
+	}
+
+	offers := 0
+	err := walkProducts(ctx, config.BatchSize, func(product *Product) error {
+		for _, offer := range ymlOffers(product, config) {
+			if err := encoder.Encode(&offer); err != nil {
+				return err
+			}
+			offers++
+		}
+		return encoder.Flush()
+	})
+	if err != nil {
+		return offers, err
+	}
+
+	for _, end := range []xml.EndElement{offersStart.End(), shop.End(), catalog.End()} {
+		if err := encoder.EncodeToken(end); err != nil {
+			return offers, err
+		}
+	}
+	return offers, encoder.Flush()
+}